@@ -1,6 +1,8 @@
 package v3
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -25,6 +27,8 @@ const (
 
 var (
 	LRUMaxTime, _ = time.Parse("2006-01-02 15:04:05", "2030-12-13 00:00:00")
+	// Close之后，再调用Close返回ErrClosed
+	ErrClosed = errors.New("cache已关闭")
 )
 
 type MemoryErr struct {
@@ -96,6 +100,7 @@ type Cache interface {
 	Exists(key string) bool
 	Flush() bool
 	Keys() int64
+	Close() error
 }
 
 type lruCache struct {
@@ -110,25 +115,58 @@ type lruCache struct {
 	gcState  int64 //是否处于gc状态
 	gcTime   int64 //上次gc的unix时间
 	gcPeriod int64 // 自动gc周期
+	closed   int32 // 是否已关闭
+	cancel   context.CancelFunc
+	done     chan struct{} // gc goroutine退出后关闭
 }
 
 func NewLRUCache() *lruCache {
+	return NewLRUCacheContext(context.Background())
+}
+
+// NewLRUCacheContext ctx结束时，停止gc goroutine并关闭cache，效果等同于Close
+func NewLRUCacheContext(ctx context.Context) *lruCache {
 	cache := &lruCache{
 		maxMemory: LRUDefaultMemory,
 		l:         sync.Mutex{},
 		m:         make(map[string]*elem),
 		gcTime:    time.Now().UnixNano(),
 		gcPeriod:  int64(DefaultAutoGCPeriod),
+		done:      make(chan struct{}),
 	}
-	go func() {
-		for {
-			cache.gc()
-			time.Sleep(time.Second * 1)
-		}
-	}()
+	ctx, cache.cancel = context.WithCancel(ctx)
+	go cache.run(ctx)
 	return cache
 }
 
+// 定时触发gc，直到ctx结束
+func (c *lruCache) run(ctx context.Context) {
+	defer close(c.done)
+	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&c.closed, 1)
+			c.Flush()
+			return
+		case <-ticker.C:
+			c.gc()
+		}
+	}
+}
+
+// Close 停止gc goroutine，清空所有元素，关闭后Set不做任何操作
+// 重复调用，或者ctx已经结束时返回ErrClosed
+func (c *lruCache) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrClosed
+	}
+	c.cancel()
+	<-c.done
+	return nil
+}
+
 // 最大4GB，最小1KB
 func (c *lruCache) SetMaxMemory(size string) {
 	c.l.Lock()
@@ -149,6 +187,9 @@ func (c *lruCache) Set(key string, val interface{}, expire time.Duration) {
 	size := sizeof(key) + sizeof(val)
 	c.l.Lock()
 	defer c.l.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
 	// 如果存在，先删除，再新增
 	v, ok := c.get(key)
 	if ok {
@@ -1,7 +1,10 @@
 package v3
 
 import (
+	"context"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -542,6 +545,63 @@ func TestGC2(t *testing.T) {
 	assert.NotNil(cache.head)
 	assert.NotNil(cache.tail)
 }
+
+// 测试Close，且Close后gc goroutine退出
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	before := gcGoroutines()
+	cache := NewLRUCache()
+	cache.Set("a", 1, 0)
+	assert.Equal(before+1, waitGoroutines(before+1))
+	assert.Nil(cache.Close())
+	assert.Equal(ErrClosed, cache.Close())
+	assert.Equal(before, waitGoroutines(before))
+	cache.Set("b", 2, 0)
+	assert.False(cache.Exists("a"))
+	assert.False(cache.Exists("b"))
+	assert.Equal(int64(0), cache.Keys())
+}
+
+// 测试ctx结束后，cache自动关闭
+func TestCloseContext(t *testing.T) {
+	assert := assert.New(t)
+	before := gcGoroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := NewLRUCacheContext(ctx)
+	cache.Set("a", 1, 0)
+	cancel()
+	<-cache.done
+	assert.Equal(before, waitGoroutines(before))
+	assert.False(cache.Exists("a"))
+	cache.Set("b", 2, 0)
+	assert.Equal(int64(0), cache.Keys())
+	assert.Equal(ErrClosed, cache.Close())
+}
+
+// 统计当前仍在运行的gc goroutine数量
+func gcGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		// 还没有开始运行的goroutine没有run的栈帧，按创建位置统计
+		if strings.Contains(g, "created by cache/v3.NewLRUCacheContext") {
+			count++
+		}
+	}
+	return count
+}
+
+// 等待goroutine退出，超时后返回最终的数量
+func waitGoroutines(want int) int {
+	n := gcGoroutines()
+	for i := 0; i < 100 && n != want; i++ {
+		time.Sleep(time.Millisecond * 10)
+		n = gcGoroutines()
+	}
+	return n
+}
+
 func BenchmarkSetKB(b *testing.B) {
 	cache := NewLRUCache()
 	cache.SetMaxMemory("1KB")
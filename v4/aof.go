@@ -0,0 +1,519 @@
+package v4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy aof调用fsync的时机
+type FsyncPolicy int
+
+const (
+	FsyncEverySec FsyncPolicy = iota // 每秒一次，崩溃时最多丢失1秒的修改
+	FsyncAlways                      // 每次修改都fsync
+	FsyncNo                          // 从不主动fsync，由操作系统决定
+)
+
+func (p FsyncPolicy) valid() bool {
+	return p >= FsyncEverySec && p <= FsyncNo
+}
+
+// aof格式
+//
+//	头部: magic(4) 版本(2) 保留(2)
+//	记录: payload长度(4) payload的crc32(4) payload，整数都是大端
+//	payload: 操作(1) [key长度(uvarint) key] [value长度(uvarint) value] [标记(1) 软过期时间(varint) 有效期(varint)]
+//
+// 过期时间是绝对时间的UnixNano，重放时已经过期的元素被删除
+const (
+	aofMagic           = "V4AF"
+	AOFVersion         = 1
+	aofHeaderSize      = 8
+	aofRecordHeaderLen = 8
+	// 文件超过上次重写后的两倍，且不小于AOFRewriteMinSize时自动重写
+	AOFRewriteMinSize = 64 << 20
+	// 记录超出文件末尾时，在之后多大的范围内查找完整的记录
+	aofResyncWindow = 1 << 20
+)
+
+// aof中的操作
+const (
+	aofSet    byte = iota + 1 // 写入，包括key、value和过期时间
+	aofDel                    // 删除key
+	aofFlush                  // 清空
+	aofExpire                 // 修改过期时间
+)
+
+var (
+	// ErrAOF aof格式错误或者中间的记录校验失败，可以用errors.Is判断
+	// 只有最后一条记录不完整时认为是崩溃时没有写完，截断后继续
+	ErrAOF = errors.New("aof格式错误")
+	// ErrRewriting 已经在重写aof
+	ErrRewriting = errors.New("aof正在重写")
+)
+
+// 一条aof记录
+type aofRecord[K comparable, V any] struct {
+	op      byte
+	key     K
+	val     V
+	soft    int64
+	ttl     time.Duration
+	sliding bool
+}
+
+// 追加写入的操作日志，除了fl保护的f，其他字段都由cache的写锁保护
+type appendLog struct {
+	path  string
+	fsync FsyncPolicy
+	fl    sync.Mutex // 保护f，后台fsync时不需要cache的锁
+	f     *os.File
+	size  int64 // 当前文件大小
+	base  int64 // 上次重写后的大小
+	// 重写期间的修改同时写入buf，重写完成后追加到新文件
+	rewriting bool
+	buf       []byte
+	err       error          // 第一个写入或者重写的错误，由Close返回
+	wg        sync.WaitGroup // 重写goroutine
+	stopCh    chan struct{}
+	done      chan struct{} // 后台fsync goroutine退出后关闭
+}
+
+// 打开path，重放其中的操作，之后的修改都追加到path
+// 必须在cache对外使用之前调用
+func (c *lruCache[K, V]) openAOF(path string, fsync FsyncPolicy) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	size, err := c.replayAOF(f)
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a := &appendLog{
+		path:   path,
+		fsync:  fsync,
+		f:      f,
+		size:   size,
+		base:   size,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if fsync == FsyncEverySec {
+		go a.run(newTicker(c.clock, time.Second))
+	} else {
+		close(a.done)
+	}
+	c.l.Lock()
+	c.aof = a
+	c.l.Unlock()
+	return nil
+}
+
+// 重放f中的记录，返回有效内容的长度
+// 最后一条记录不完整或者校验失败时截断，中间的记录错误时返回ErrAOF
+func (c *lruCache[K, V]) replayAOF(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := info.Size()
+	// 空文件，或者崩溃时头部没有写完
+	if total < aofHeaderSize {
+		if err := f.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err := f.WriteAt(aofHeader(), 0); err != nil {
+			return 0, err
+		}
+		return aofHeaderSize, nil
+	}
+	r := bufio.NewReader(f)
+	header := make([]byte, aofHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != aofMagic {
+		return 0, fmt.Errorf("%w: %s不是aof文件", ErrAOF, f.Name())
+	}
+	if v := binary.BigEndian.Uint16(header[4:]); v != AOFVersion {
+		return 0, fmt.Errorf("%w: 不支持的版本%d", ErrAOF, v)
+	}
+	offset := int64(aofHeaderSize)
+	rh := make([]byte, aofRecordHeaderLen)
+	var payload []byte
+	for offset < total {
+		if _, err := io.ReadFull(r, rh); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(rh))
+		end := offset + aofRecordHeaderLen + n
+		if end > total {
+			// 之后还有完整的记录时，是中间记录的长度损坏，不是崩溃时没有写完
+			if p, ok := findAOFRecord[K, V](f, offset+1, total, c.codec); ok {
+				return 0, fmt.Errorf("%w: 偏移%d的记录长度错误，偏移%d之后还有记录", ErrAOF, offset, p)
+			}
+			break
+		}
+		if int64(cap(payload)) < n {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(rh[4:]) {
+			if end == total {
+				break
+			}
+			return 0, fmt.Errorf("%w: 偏移%d的记录校验失败", ErrAOF, offset)
+		}
+		rec, err := decodeAOF[K, V](payload, c.codec)
+		if err != nil {
+			return 0, fmt.Errorf("%w: 偏移%d: %v", ErrAOF, offset, err)
+		}
+		c.applyAOF(&rec)
+		offset = end
+	}
+	if offset < total {
+		if err := f.Truncate(offset); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// 在from之后aofResyncWindow的范围内查找一条完整并且校验通过的记录，返回它的偏移
+// 崩溃时没有写完的只能是最后一条记录，找到时说明前面的长度被损坏
+// 只查找不超过aofResyncWindow的记录，之后的记录都很大时仍然按没有写完处理
+func findAOFRecord[K comparable, V any](f *os.File, from, total int64, codec Codec) (int64, bool) {
+	size := total - from
+	if size > 2*aofResyncWindow+aofRecordHeaderLen {
+		size = 2*aofResyncWindow + aofRecordHeaderLen
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, from); err != nil {
+		return 0, false
+	}
+	for i := 0; i+aofRecordHeaderLen < len(buf) && i < aofResyncWindow; i++ {
+		n := int(binary.BigEndian.Uint32(buf[i:]))
+		end := i + aofRecordHeaderLen + n
+		// 崩溃后文件末尾可能是0，长度为0的记录不算
+		if n == 0 || n > aofResyncWindow || end > len(buf) {
+			continue
+		}
+		payload := buf[i+aofRecordHeaderLen : end]
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(buf[i+4:]) {
+			continue
+		}
+		if _, err := decodeAOF[K, V](payload, codec); err == nil {
+			return from + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// 重放一条记录，过期时间已经过去的元素被删除
+func (c *lruCache[K, V]) applyAOF(rec *aofRecord[K, V]) {
+	now := c.clock.Now().UnixNano()
+	expired := rec.soft != 0 && rec.soft <= now
+	if rec.op == aofSet && !expired {
+		c.set(rec.key, rec.val, rec.soft, rec.ttl, rec.sliding, false)
+		return
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	if rec.op == aofFlush {
+		c.flush()
+		return
+	}
+	e, ok := c.get(rec.key)
+	if !ok {
+		return
+	}
+	switch {
+	case rec.op == aofDel:
+		c.remove(e, ReasonExplicit)
+	case expired:
+		c.remove(e, ReasonExpired)
+	case rec.op == aofExpire:
+		e.setExpire(rec.soft, rec.ttl, c.grace)
+		e.sliding = rec.sliding
+		c.expirer.add(e)
+	}
+}
+
+func aofHeader() []byte {
+	header := make([]byte, aofHeaderSize)
+	copy(header, aofMagic)
+	binary.BigEndian.PutUint16(header[4:], AOFVersion)
+	return header
+}
+
+// 编码一条记录，包括长度和校验
+func encodeAOF[K comparable, V any](b []byte, rec *aofRecord[K, V], codec Codec) ([]byte, error) {
+	start := len(b)
+	b = append(b, make([]byte, aofRecordHeaderLen)...)
+	b = append(b, rec.op)
+	var err error
+	if rec.op != aofFlush {
+		if b, err = appendEncoded(b, codec, &rec.key); err != nil {
+			return nil, fmt.Errorf("编码key失败: %w", err)
+		}
+	}
+	if rec.op == aofSet {
+		if b, err = appendEncoded(b, codec, &rec.val); err != nil {
+			return nil, fmt.Errorf("编码value失败: %w", err)
+		}
+	}
+	if rec.op == aofSet || rec.op == aofExpire {
+		var flags byte
+		if rec.sliding {
+			flags |= snapshotSliding
+		}
+		b = append(b, flags)
+		b = appendVarint(b, rec.soft)
+		b = appendVarint(b, int64(rec.ttl))
+	}
+	payload := b[start+aofRecordHeaderLen:]
+	binary.BigEndian.PutUint32(b[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[start+4:], crc32.Checksum(payload, crcTable))
+	return b, nil
+}
+
+func decodeAOF[K comparable, V any](b []byte, codec Codec) (aofRecord[K, V], error) {
+	var rec aofRecord[K, V]
+	r := bytes.NewReader(b)
+	op, err := r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	rec.op = op
+	if op < aofSet || op > aofExpire {
+		return rec, fmt.Errorf("未知的操作%d", op)
+	}
+	if op != aofFlush {
+		if err := readDecoded(r, codec, &rec.key); err != nil {
+			return rec, fmt.Errorf("解码key失败: %w", err)
+		}
+	}
+	if op == aofSet {
+		if err := readDecoded(r, codec, &rec.val); err != nil {
+			return rec, fmt.Errorf("解码value失败: %w", err)
+		}
+	}
+	if op == aofSet || op == aofExpire {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return rec, err
+		}
+		rec.sliding = flags&snapshotSliding != 0
+		if rec.soft, err = binary.ReadVarint(r); err != nil {
+			return rec, err
+		}
+		ttl, err := binary.ReadVarint(r)
+		if err != nil {
+			return rec, err
+		}
+		rec.ttl = time.Duration(ttl)
+	}
+	return rec, nil
+}
+
+// 追加一条记录，必须持有cache的写锁
+// 文件增长到上次重写后的两倍时，在后台重写
+func (c *lruCache[K, V]) appendAOF(rec *aofRecord[K, V]) error {
+	a := c.aof
+	if a == nil {
+		return nil
+	}
+	b, err := encodeAOF(nil, rec, c.codec)
+	if err == nil {
+		err = a.write(b)
+	}
+	if err != nil {
+		if a.err == nil {
+			a.err = err
+		}
+		return err
+	}
+	if !a.rewriting && a.size >= AOFRewriteMinSize && a.size >= a.base*2 {
+		c.startRewrite()
+	}
+	return nil
+}
+
+func (c *lruCache[K, V]) logSet(key K, val V, soft int64, ttl time.Duration, sliding bool) error {
+	return c.appendAOF(&aofRecord[K, V]{op: aofSet, key: key, val: val, soft: soft, ttl: ttl, sliding: sliding})
+}
+
+func (c *lruCache[K, V]) logDel(key K) error {
+	return c.appendAOF(&aofRecord[K, V]{op: aofDel, key: key})
+}
+
+func (c *lruCache[K, V]) logFlush() error {
+	return c.appendAOF(&aofRecord[K, V]{op: aofFlush})
+}
+
+// 记录e当前的过期时间
+func (c *lruCache[K, V]) logExpire(e *elem[K, V]) error {
+	return c.appendAOF(&aofRecord[K, V]{op: aofExpire, key: e.key, soft: e.getSoft(), ttl: e.ttl, sliding: e.sliding})
+}
+
+func (a *appendLog) write(b []byte) error {
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if a.rewriting {
+		a.buf = append(a.buf, b...)
+	}
+	if err == nil && a.fsync == FsyncAlways {
+		err = a.f.Sync()
+	}
+	return err
+}
+
+// 每秒fsync一次，直到stop
+func (a *appendLog) run(ticker Ticker) {
+	defer close(a.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C():
+			a.fl.Lock()
+			f := a.f
+			a.fl.Unlock()
+			// 重写时可能已经换成新文件，旧文件关闭后的错误可以忽略
+			f.Sync()
+		}
+	}
+}
+
+// 等待重写完成，fsync并关闭文件，返回第一个错误
+// 调用前cache必须已经关闭，不会再有新的修改
+func (a *appendLog) close() error {
+	a.wg.Wait()
+	close(a.stopCh)
+	<-a.done
+	err := a.f.Sync()
+	if e := a.f.Close(); err == nil {
+		err = e
+	}
+	if a.err != nil {
+		return a.err
+	}
+	return err
+}
+
+// RewriteAOF 在后台按当前的元素重写aof，只保留每个元素最后的状态
+// 重写期间的修改同时追加到旧文件和缓冲区，完成后追加到新文件，再替换旧文件
+// 已经在重写时返回ErrRewriting，没有配置WithAOF时返回ErrOption
+func (c *lruCache[K, V]) RewriteAOF() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if c.aof == nil {
+		return fmt.Errorf("%w: 没有配置WithAOF", ErrOption)
+	}
+	return c.startRewrite()
+}
+
+// 复制元素，启动重写goroutine，必须持有写锁
+func (c *lruCache[K, V]) startRewrite() error {
+	a := c.aof
+	if a.rewriting {
+		return ErrRewriting
+	}
+	entries := c.copyEntries(c.clock.Now(), 0)
+	a.rewriting = true
+	a.buf = nil
+	a.wg.Add(1)
+	go c.rewriteAOF(entries)
+	return nil
+}
+
+// 把元素写入临时文件，持有写锁追加重写期间的修改，替换旧文件
+func (c *lruCache[K, V]) rewriteAOF(entries []snapshotEntry[K, V]) {
+	a := c.aof
+	defer a.wg.Done()
+	tmp := a.path + ".rewrite"
+	f, size, err := writeAOFEntries(tmp, entries, c.codec)
+	c.l.Lock()
+	defer c.l.Unlock()
+	if err == nil {
+		err = a.replace(f, size)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(tmp)
+		if a.err == nil {
+			a.err = err
+		}
+	}
+	a.rewriting = false
+	a.buf = nil
+}
+
+// 重写期间的修改追加到新文件，fsync后替换旧文件，必须持有写锁
+func (a *appendLog) replace(f *os.File, size int64) error {
+	n, err := f.Write(a.buf)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		return err
+	}
+	a.fl.Lock()
+	old := a.f
+	a.f = f
+	a.fl.Unlock()
+	old.Close()
+	a.size = size + int64(n)
+	a.base = a.size
+	return nil
+}
+
+// 把元素按顺序写入新文件，返回打开的文件和大小
+func writeAOFEntries[K comparable, V any](path string, entries []snapshotEntry[K, V], codec Codec) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := bufio.NewWriter(f)
+	size := int64(aofHeaderSize)
+	w.Write(aofHeader())
+	var b []byte
+	for i := range entries {
+		e := &entries[i]
+		b, err = encodeAOF(b[:0], &aofRecord[K, V]{op: aofSet, key: e.key, val: e.val, soft: e.soft, ttl: e.ttl, sliding: e.sliding}, codec)
+		if err != nil {
+			return f, 0, err
+		}
+		w.Write(b)
+		size += int64(len(b))
+	}
+	if err := w.Flush(); err != nil {
+		return f, 0, err
+	}
+	return f, size, nil
+}
@@ -0,0 +1,239 @@
+package v4
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 等待后台重写完成
+func waitRewrite[K comparable, V any](cache *lruCache[K, V]) bool {
+	for i := 0; i < 100; i++ {
+		cache.l.Lock()
+		rewriting := cache.aof.rewriting
+		cache.l.Unlock()
+		if !rewriting {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestAOFReplay(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	for _, fsync := range []FsyncPolicy{FsyncEverySec, FsyncAlways, FsyncNo} {
+		os.Remove(path)
+		cache := newTestCache[string, int](t, WithClock(clock), WithAOF(path, fsync))
+		cache.Set("a", 1, 0)
+		cache.Set("a", 2, 0)
+		cache.Set("b", 3, time.Minute)
+		cache.Set("c", 4, 0)
+		cache.Del("c")
+		cache.Set("d", 5, time.Hour)
+		cache.Expire("d", time.Second*5)
+		cache.Set("e", 6, time.Hour)
+		cache.Persist("e")
+		cache.SetSliding("f", 7, time.Minute)
+		assert.Nil(cache.Close())
+
+		// 重启期间d过期
+		clock.Advance(time.Second * 10)
+		cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, fsync))
+		assert.Equal(int64(4), cache.Keys(), fsync)
+		val, _ := cache.Get("a")
+		assert.Equal(2, val)
+		d, _ := cache.TTL("b")
+		assert.Equal(time.Second*50, d)
+		assert.False(cache.Exists("c"))
+		assert.False(cache.Exists("d"))
+		d, _ = cache.TTL("e")
+		assert.Equal(NoExpire, d)
+		cache.Get("f")
+		d, _ = cache.TTL("f")
+		assert.Equal(time.Minute, d)
+
+		cache.Flush()
+		cache.Set("g", 8, 0)
+		assert.Nil(cache.Close())
+		cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, fsync))
+		assert.Equal(int64(1), cache.Keys())
+		cache.Close()
+	}
+}
+
+// 在子进程中写入，当前进程重新打开，两个进程的hash种子不同时key会被分到错误的分片
+func TestShardedAOFRestart(t *testing.T) {
+	assert := assert.New(t)
+	if path := os.Getenv("SHARDED_AOF_PATH"); path != "" {
+		cache, err := NewShardedCache[string, int](4, WithAOF(path, FsyncNo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+		}
+		assert.Nil(cache.Close())
+		return
+	}
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShardedAOFRestart$")
+	cmd.Env = append(os.Environ(), "SHARDED_AOF_PATH="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	cache, err := NewShardedCache[string, int](4, WithAOF(path, FsyncNo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	assert.Equal(int64(100), cache.Keys())
+	for i := 0; i < 100; i++ {
+		val, ok := cache.Get(strconv.Itoa(i))
+		assert.True(ok, i)
+		assert.Equal(i, val)
+	}
+	cache.Set("0", -1, 0)
+	assert.Equal(int64(100), cache.Keys())
+}
+
+// 崩溃时最后一条记录没有写完，截断后继续
+func TestAOFTruncated(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	cache := newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncAlways))
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Close()
+	data, _ := os.ReadFile(path)
+
+	// 最后一条记录只写了一部分
+	os.WriteFile(path, data[:len(data)-3], 0o644)
+	cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncAlways))
+	assert.Equal(int64(1), cache.Keys())
+	assert.True(cache.Exists("a"))
+	// 截断后追加的记录可以正常重放
+	cache.Set("c", 3, 0)
+	cache.Close()
+	cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncAlways))
+	assert.True(cache.Exists("a"))
+	assert.True(cache.Exists("c"))
+	cache.Close()
+
+	// 最后一条记录校验失败
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+	cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncAlways))
+	assert.Equal(int64(1), cache.Keys())
+	cache.Close()
+
+	// 头部没有写完
+	os.WriteFile(path, data[:3], 0o644)
+	cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncAlways))
+	assert.Equal(int64(0), cache.Keys())
+	cache.Close()
+}
+
+// 中间的记录损坏时返回ErrAOF
+func TestAOFCorrupt(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	cache := newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncNo))
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Close()
+	data, _ := os.ReadFile(path)
+	corrupt := append([]byte(nil), data...)
+	corrupt[aofHeaderSize+aofRecordHeaderLen] ^= 0xff
+	os.WriteFile(path, corrupt, 0o644)
+	_, err := New[string, int](WithClock(clock), WithAOF(path, FsyncNo))
+	assert.True(errors.Is(err, ErrAOF))
+
+	// 第一条记录的长度超出文件末尾，之后的记录不能被截断
+	corrupt = append([]byte(nil), data...)
+	corrupt[aofHeaderSize] = 0x7f
+	os.WriteFile(path, corrupt, 0o644)
+	_, err = New[string, int](WithClock(clock), WithAOF(path, FsyncNo))
+	assert.True(errors.Is(err, ErrAOF))
+	stat, _ := os.Stat(path)
+	assert.Equal(int64(len(data)), stat.Size())
+
+	os.WriteFile(path, []byte("not an aof file"), 0o644)
+	_, err = New[string, int](WithClock(clock), WithAOF(path, FsyncNo))
+	assert.True(errors.Is(err, ErrAOF))
+}
+
+func TestAOFRewrite(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	cache := newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncEverySec))
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i%10), i, 0)
+	}
+	cache.Set("ttl", 1, time.Minute)
+	before, _ := os.Stat(path)
+	assert.Nil(cache.RewriteAOF())
+	// 重写期间的修改追加到新文件
+	cache.Set("new", 1, 0)
+	cache.Del("0")
+	assert.True(waitRewrite(cache))
+	after, _ := os.Stat(path)
+	assert.Less(after.Size(), before.Size()/10)
+	cache.Set("last", 1, 0)
+	assert.Nil(cache.Close())
+	_, err := os.Stat(path + ".rewrite")
+	assert.True(os.IsNotExist(err))
+
+	cache = newTestCache[string, int](t, WithClock(clock), WithAOF(path, FsyncEverySec))
+	assert.Equal(int64(12), cache.Keys())
+	val, _ := cache.Get("9")
+	assert.Equal(999, val)
+	assert.False(cache.Exists("0"))
+	assert.True(cache.Exists("new"))
+	assert.True(cache.Exists("last"))
+	d, _ := cache.TTL("ttl")
+	assert.Equal(time.Minute, d)
+}
+
+func TestAOFOptions(t *testing.T) {
+	assert := assert.New(t)
+	_, err := New[string, int](WithAOF("", FsyncNo))
+	assert.True(errors.Is(err, ErrOption))
+	_, err = New[string, int](WithAOF("a.aof", FsyncPolicy(10)))
+	assert.True(errors.Is(err, ErrOption))
+	_, err = New[string, int](WithAOF(filepath.Join(t.TempDir(), "none", "a.aof"), FsyncNo))
+	assert.NotNil(err)
+
+	cache := NewCache[string, int]()
+	assert.True(errors.Is(cache.RewriteAOF(), ErrOption))
+	cache.Close()
+	assert.Equal(ErrClosed, cache.RewriteAOF())
+
+	// 分片各自使用一个文件
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	sc, err := NewShardedCache[int, int](2, WithAOF(path, FsyncNo))
+	assert.Nil(err)
+	for i := 0; i < 100; i++ {
+		sc.Set(i, i, 0)
+	}
+	assert.Nil(sc.Close())
+	sc, err = NewShardedCache[int, int](2, WithAOF(path, FsyncNo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(int64(100), sc.Keys())
+	sc.Close()
+	_, err = os.Stat(path + ".1")
+	assert.Nil(err)
+}
@@ -0,0 +1,212 @@
+package v4
+
+// 幽灵元素的固定开销，elem结构体、map槽位的近似大小
+const ghostOverhead = 64
+
+// ARC中元素所在的链表
+const (
+	arcT1 uint8 = iota // 只访问过一次
+	arcT2              // 访问过多次
+	arcB1              // 从T1淘汰的幽灵元素
+	arcB2              // 从T2淘汰的幽灵元素
+)
+
+// 幽灵元素集合，只保存被淘汰元素的key，用于判断新写入的key是否刚被淘汰过
+// 幽灵元素不在cache的map中，占用计入元数据预算，不计入maxMemory
+type ghostSet[K comparable, V any] struct {
+	m      map[K]*elem[K, V]
+	bytes  int // 所有幽灵元素的元数据大小
+	budget int
+}
+
+func newGhostSet[K comparable, V any](budget int) ghostSet[K, V] {
+	return ghostSet[K, V]{
+		m:      make(map[K]*elem[K, V]),
+		budget: budget,
+	}
+}
+
+func (g *ghostSet[K, V]) get(key K) (*elem[K, V], bool) {
+	e, ok := g.m[key]
+	return e, ok
+}
+
+// 记录被淘汰的e，e.size保存元素原本的大小，用于自适应调整
+func (g *ghostSet[K, V]) push(l *list[K, V], e *elem[K, V], seg uint8) {
+	if old, ok := g.m[e.key]; ok {
+		g.del(l, old)
+	}
+	ghost := &elem[K, V]{key: e.key, size: e.size, seg: seg}
+	l.lpush(ghost)
+	g.m[e.key] = ghost
+	g.bytes += sizeof(e.key) + ghostOverhead
+}
+
+func (g *ghostSet[K, V]) del(l *list[K, V], ghost *elem[K, V]) {
+	l.del(ghost)
+	delete(g.m, ghost.key)
+	g.bytes -= sizeof(ghost.key) + ghostOverhead
+}
+
+func (g *ghostSet[K, V]) full() bool {
+	return g.bytes > g.budget
+}
+
+func (g *ghostSet[K, V]) reset() {
+	g.m = make(map[K]*elem[K, V])
+	g.bytes = 0
+}
+
+// 带有占用大小的链表
+type sizedList[K comparable, V any] struct {
+	list[K, V]
+	bytes int
+}
+
+func (l *sizedList[K, V]) push(e *elem[K, V]) {
+	l.lpush(e)
+	l.bytes += e.size
+}
+
+func (l *sizedList[K, V]) remove(e *elem[K, V]) {
+	l.del(e)
+	l.bytes -= e.size
+}
+
+func (l *sizedList[K, V]) clear() {
+	l.reset()
+	l.bytes = 0
+}
+
+// ARC，自适应替换
+//
+//	T1保存只访问过一次的元素，T2保存访问过多次的元素，B1、B2分别记录从T1、T2淘汰的key
+//	新写入的key命中B1，说明T1太小，增大T1的目标大小p；命中B2，说明T2太小，减小p
+//	淘汰时，T1超过p则淘汰T1尾部，否则淘汰T2尾部，在最近访问与访问频率之间自动调整
+//	原论文按元素个数计算，这里按元素大小计算，容量为cache的最大内存
+type arcPolicy[K comparable, V any] struct {
+	t1, t2   sizedList[K, V]
+	b1, b2   list[K, V]
+	ghosts   ghostSet[K, V]
+	p        int // T1的目标大小
+	capacity int
+	victim   *elem[K, V] // Victim选出的元素，删除时记录到幽灵链表
+}
+
+func newARCPolicy[K comparable, V any](ghostBudget int) *arcPolicy[K, V] {
+	return &arcPolicy[K, V]{
+		ghosts:   newGhostSet[K, V](ghostBudget),
+		capacity: LRUDefaultMemory,
+	}
+}
+
+func (p *arcPolicy[K, V]) setCapacity(maxMemory int) {
+	p.capacity = maxMemory
+	if p.p > maxMemory {
+		p.p = maxMemory
+	}
+}
+
+func (p *arcPolicy[K, V]) OnInsert(e *elem[K, V]) {
+	ghost, ok := p.ghosts.get(e.key)
+	if !ok {
+		e.seg = arcT1
+		p.t1.push(e)
+		return
+	}
+	if ghost.seg == arcB1 {
+		p.p = minInt(p.capacity, p.p+e.size*maxInt(1, p.b2.len/maxInt(1, p.b1.len)))
+		p.ghosts.del(&p.b1, ghost)
+	} else {
+		p.p = maxInt(0, p.p-e.size*maxInt(1, p.b1.len/maxInt(1, p.b2.len)))
+		p.ghosts.del(&p.b2, ghost)
+	}
+	e.seg = arcT2
+	p.t2.push(e)
+}
+
+func (p *arcPolicy[K, V]) OnAccess(e *elem[K, V]) {
+	if e.seg == arcT1 {
+		p.t1.remove(e)
+		e.seg = arcT2
+		p.t2.push(e)
+		return
+	}
+	p.t2.moveToHead(e)
+}
+
+func (p *arcPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) {
+	p.list(e.seg).bytes += e.size - oldSize
+	p.OnAccess(e)
+}
+
+func (p *arcPolicy[K, V]) OnRemove(e *elem[K, V]) {
+	l := p.list(e.seg)
+	l.remove(e)
+	if p.victim == e {
+		// 被淘汰的元素记录到对应的幽灵链表
+		if e.seg == arcT1 {
+			p.ghosts.push(&p.b1, e, arcB1)
+		} else {
+			p.ghosts.push(&p.b2, e, arcB2)
+		}
+		p.trimGhosts()
+		p.victim = nil
+	}
+	e.seg = 0
+}
+
+func (p *arcPolicy[K, V]) Victim() *elem[K, V] {
+	if p.t1.len > 0 && (p.t1.bytes > p.p || p.t2.len == 0) {
+		p.victim = p.t1.tail
+	} else {
+		p.victim = p.t2.tail
+	}
+	return p.victim
+}
+
+func (p *arcPolicy[K, V]) Len() int {
+	return p.t1.len + p.t2.len
+}
+
+func (p *arcPolicy[K, V]) Reset() {
+	p.t1.clear()
+	p.t2.clear()
+	p.b1.reset()
+	p.b2.reset()
+	p.ghosts.reset()
+	p.p = 0
+	p.victim = nil
+}
+
+func (p *arcPolicy[K, V]) list(seg uint8) *sizedList[K, V] {
+	if seg == arcT1 {
+		return &p.t1
+	}
+	return &p.t2
+}
+
+// 幽灵元素超过预算时，从较长的幽灵链表尾部删除
+func (p *arcPolicy[K, V]) trimGhosts() {
+	for p.ghosts.full() {
+		if p.b1.len >= p.b2.len {
+			p.ghosts.del(&p.b1, p.b1.tail)
+		} else {
+			p.ghosts.del(&p.b2, p.b2.tail)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package v4
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// 每个读缓冲区的容量，必须是2的幂
+	readBufferSize = 16
+	// 缓冲区中待回放的记录达到该值时，通知后台goroutine回放
+	readBufferDrainThreshold = readBufferSize / 2
+)
+
+// 读缓冲区，记录Get命中的元素，由持有写锁的一方批量回放到淘汰策略中
+// 多个读者通过CAS写入，只有一个消费者(持有写锁)读取，满了以后丢弃新的记录
+// 丢弃只会让淘汰策略的访问顺序略有偏差，不影响正确性
+type readBuffer struct {
+	head  uint64 // 下一个要回放的位置，只在写锁内修改
+	tail  uint64 // 下一个写入的位置
+	slots [readBufferSize]unsafe.Pointer
+	_     [64]byte // 避免相邻的缓冲区处于同一个cache line
+}
+
+// 写入一条记录，返回写入后待回放的记录数，缓冲区已满或者竞争失败时返回-1
+func (b *readBuffer) add(p unsafe.Pointer) int {
+	head := atomic.LoadUint64(&b.head)
+	tail := atomic.LoadUint64(&b.tail)
+	if tail-head >= readBufferSize {
+		return -1
+	}
+	if !atomic.CompareAndSwapUint64(&b.tail, tail, tail+1) {
+		return -1
+	}
+	atomic.StorePointer(&b.slots[tail&(readBufferSize-1)], p)
+	return int(tail + 1 - head)
+}
+
+// 回放所有已写入的记录，必须持有写锁
+func (b *readBuffer) drain(fn func(p unsafe.Pointer)) {
+	head := atomic.LoadUint64(&b.head)
+	tail := atomic.LoadUint64(&b.tail)
+	for ; head != tail; head++ {
+		slot := &b.slots[head&(readBufferSize-1)]
+		p := atomic.LoadPointer(slot)
+		if p == nil { // 读者已经占了位置，还没有写入
+			break
+		}
+		atomic.StorePointer(slot, nil)
+		fn(p)
+	}
+	atomic.StoreUint64(&b.head, head)
+}
+
+// 分段的读缓冲区，元素插入时计算的hash决定写入哪一段，降低读者之间的竞争
+func newReadBuffers() []readBuffer {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 {
+		n <<= 1
+	}
+	return make([]readBuffer, n)
+}
+
+// 记录一次Get命中，不获取写锁，hash为e.hash
+// 缓冲区过半时通知后台goroutine回放，已满时尝试直接回放，拿不到写锁则丢弃这次记录
+func (c *lruCache[K, V]) recordAccess(hash uint64, e *elem[K, V]) {
+	b := &c.reads[hash&uint64(len(c.reads)-1)]
+	n := b.add(unsafe.Pointer(e))
+	if n >= readBufferDrainThreshold {
+		select {
+		case c.drainCh <- struct{}{}:
+		default:
+		}
+	}
+	if n < 0 && c.l.TryLock() {
+		c.drainReads()
+		c.l.Unlock()
+		b.add(unsafe.Pointer(e))
+	}
+}
+
+// 把缓冲区中的访问记录回放到淘汰策略，必须持有写锁
+// 元素记录之后可能已经被删除，甚至被pool复用，只回放仍在map中的元素
+func (c *lruCache[K, V]) drainReads() {
+	for i := range c.reads {
+		c.reads[i].drain(func(p unsafe.Pointer) {
+			e := (*elem[K, V])(p)
+			if cur, ok := c.m[e.key]; ok && cur == e {
+				c.policy.OnAccess(e)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package v4
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBuffer(t *testing.T) {
+	assert := assert.New(t)
+	var b readBuffer
+	elems := make([]elem[string, int], readBufferSize+1)
+	for i := 0; i < readBufferSize; i++ {
+		assert.Equal(i+1, b.add(unsafe.Pointer(&elems[i])))
+	}
+	// 已满，丢弃
+	assert.Equal(-1, b.add(unsafe.Pointer(&elems[readBufferSize])))
+	drained := []unsafe.Pointer{}
+	b.drain(func(p unsafe.Pointer) {
+		drained = append(drained, p)
+	})
+	assert.Equal(readBufferSize, len(drained))
+	for i, p := range drained {
+		assert.Equal(unsafe.Pointer(&elems[i]), p)
+	}
+	// 回放后可以继续写入
+	assert.Equal(1, b.add(unsafe.Pointer(&elems[0])))
+}
+
+// 读缓冲区过半后，由后台goroutine回放
+func TestDrainReads(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[int, int]()
+	defer cache.Close()
+	for i := 0; i < 100; i++ {
+		cache.Set(i, i, 0)
+	}
+	for i := 0; i < 100; i++ {
+		cache.Get(i)
+	}
+	pending := func() uint64 {
+		var n uint64
+		for i := range cache.reads {
+			n += atomic.LoadUint64(&cache.reads[i].tail) - atomic.LoadUint64(&cache.reads[i].head)
+		}
+		return n
+	}
+	for i := 0; i < 100 && pending() >= readBufferDrainThreshold*uint64(len(cache.reads)); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Less(pending(), readBufferDrainThreshold*uint64(len(cache.reads)))
+}
+
+// 被删除或者复用的元素，回放时不会破坏淘汰策略
+func TestDrainReadsRemoved(t *testing.T) {
+	assert := assert.New(t)
+	cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(PolicyLRU), WithCost(policyCost))
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Get("a")
+	cache.Del("a")
+	// a的elem被pool复用
+	cache.Set("c", 3, 0)
+	cache.l.Lock()
+	cache.drainReads()
+	cache.l.Unlock()
+	assert.Equal(2, cache.policy.Len())
+	assert.Equal(2, len(cache.m))
+}
+
+// 并发读写删除，go test -race下检查数据竞争与链表的一致性
+func TestConcurrentGetSet(t *testing.T) {
+	for _, p := range []Policy{PolicyLRU, PolicyLFU, PolicyClock, PolicyTinyLFU, PolicyARC, Policy2Q} {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("4KB"), WithEvictionPolicy(p),
+			WithCost(func(string, int) int { return 32 }))
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					key := strconv.Itoa((g*7 + i) % 300)
+					switch i % 5 {
+					case 0:
+						cache.Set(key, i, 0)
+					case 1:
+						cache.Del(key)
+					default:
+						if val, ok := cache.Get(key); ok {
+							assert.GreaterOrEqual(val, 0)
+						}
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		cache.l.Lock()
+		cache.drainReads()
+		assert.Equal(len(cache.m), cache.policy.Len(), "policy %d", p)
+		assert.LessOrEqual(cache.elemSize, cache.maxMemory)
+		cache.l.Unlock()
+		cache.Close()
+	}
+}
+
+type structKey struct {
+	id   int
+	name string
+}
+
+// key不是string、整数时，Get也不分配内存
+func TestGetAllocs(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[structKey, int]()
+	defer cache.Close()
+	key := structKey{1, "a"}
+	cache.Set(key, 1, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		cache.Get(key)
+		cache.Get(structKey{2, "b"})
+	})
+	assert.Equal(float64(0), allocs)
+
+	// 没有hash的key也分散到不同的读缓冲区
+	stripes := make(map[uint64]bool)
+	for i := 0; i < 64; i++ {
+		cache.Set(structKey{i, "c"}, i, 0)
+	}
+	cache.l.RLock()
+	for _, e := range cache.m {
+		stripes[e.hash&uint64(len(cache.reads)-1)] = true
+	}
+	cache.l.RUnlock()
+	assert.Greater(len(stripes), 1)
+}
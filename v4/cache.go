@@ -1,7 +1,11 @@
 package v4
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,19 +22,27 @@ const (
 	MaxMemory           = 4 << 30   // 4GB
 	MinMemory           = 1 << 10   //	1KB
 	LRUDefaultMemory    = 100 << 20 // 100MB
+	DefaultGhostBudget  = 1 << 20   // 1MB，ARC、2Q幽灵链表的默认预算
 	DefaultMapElem      = 100
 	DefaultAutoGCPeriod = time.Second * 120
 	MinGCPeriod         = time.Second * 1 // 最小gc间隔
 )
 
 var (
+	// Deprecated: 永不过期的元素不再使用LRUMaxTime，过期时间为零值，不会因为到了2030年而过期
 	LRUMaxTime, _ = time.Parse("2006-01-02 15:04:05", "2030-12-13 00:00:00")
+	// UnixNano能表示的最大时间
+	maxDeadline = time.Unix(0, math.MaxInt64)
+	// Close之后，再调用Close、TrySet等返回ErrClosed
+	ErrClosed = errors.New("cache已关闭")
+	// 单个元素的大小超过了最大内存，无法存入
+	ErrTooLarge = errors.New("元素大小超过最大内存")
+	// CompareAndSet时元素的版本号不匹配
+	ErrVersion = errors.New("版本号不匹配")
+	// 用于errors.Is判断，任意MemoryErr、ExpireErr都与之匹配
+	ErrMemory = &MemoryErr{}
+	ErrExpire = &ExpireErr{}
 )
-var elemPool = sync.Pool{
-	New: func() interface{} {
-		return new(elem)
-	},
-}
 
 type MemoryErr struct {
 	size string
@@ -40,6 +52,11 @@ func (err *MemoryErr) Error() string {
 	return fmt.Sprintf("错误的内存大小%s", err.size)
 }
 
+func (err *MemoryErr) Is(target error) bool {
+	_, ok := target.(*MemoryErr)
+	return ok
+}
+
 type ExpireErr struct {
 	d time.Duration
 }
@@ -48,6 +65,11 @@ func (err *ExpireErr) Error() string {
 	return fmt.Sprintf("错误的有效期%d", err.d)
 }
 
+func (err *ExpireErr) Is(target error) bool {
+	_, ok := target.(*ExpireErr)
+	return ok
+}
+
 func getMemorySize(size string) (int, error) {
 	bSize := []byte(size)
 	if len(bSize) <= 2 {
@@ -77,305 +99,882 @@ func getMemorySize(size string) (int, error) {
 	return mem, nil
 }
 
-// 由于类型都同意转换为interface{}，这里固定返回16byte
-func sizeof(c interface{}) int {
-	//
-	// unsafe.Sizeof()返回的值介绍
-	//
-	// string类型，固定24byte
-	// 数值类型，如int64等，与真实内存大小一致
-	// struct值类型，与其内部元素有关
-	// struct引用类型，固定8byte
-	// map类型，实际上也是引用类型，固定8byte
-	// 数组类型，与T具体类型和长度有关
-	// slice类型，固定24byte
-
-	return int(unsafe.Sizeof(c))
-}
-
-type Cache interface {
+// Cache 泛型缓存接口，K为任意可比较类型，Get直接返回V，无需类型断言
+// 只包含基本的读写删除，其他功能在TTLCache、VersionedCache等可选接口中，
+// New返回的cache和ShardedCache实现了所有可选接口，需要时通过类型断言获取
+type Cache[K comparable, V any] interface {
 	SetMaxMemory(size string)
-	Set(key string, val interface{}, expire time.Duration)
-	Get(key string) (interface{}, bool)
-	Del(key string) bool
-	Exists(key string) bool
+	Set(key K, val V, expire time.Duration)
+	// 与SetMaxMemory、Set相同，参数错误时返回error而不是panic
+	TrySetMaxMemory(size string) error
+	TrySet(key K, val V, expire time.Duration) error
+	Get(key K) (V, bool)
+	Del(key K) bool
+	Exists(key K) bool
 	Flush() bool
 	Keys() int64
+	Close() error
+}
+
+// TTLCache 按截止时间、滑动有效期写入，以及查询、修改有效期
+type TTLCache[K comparable, V any] interface {
+	// 与Set相同，在deadline时过期，deadline为零值时永不过期，已经过去时删除key
+	SetWithDeadline(key K, val V, deadline time.Time)
+	TrySetWithDeadline(key K, val V, deadline time.Time) error
+	// 与Set相同，每次Get都把有效期延长为ttl，ttl必须大于0
+	SetSliding(key K, val V, ttl time.Duration)
+	TrySetSliding(key K, val V, ttl time.Duration) error
+	// 剩余的有效期，永不过期时返回NoExpire，key不存在时返回false
+	TTL(key K) (time.Duration, bool)
+	// 修改有效期，d的含义同Set，d<0时删除key
+	Expire(key K, d time.Duration) bool
+	// 修改过期时间，deadline的含义同SetWithDeadline
+	ExpireAt(key K, deadline time.Time) bool
+	// 改为永不过期
+	Persist(key K) bool
+	// 按设置时的有效期重新计算过期时间，并记录一次访问
+	Touch(key K) bool
 }
 
-type lruCache struct {
+// VersionedCache 按版本号读写，用于实现CAS
+type VersionedCache[K comparable, V any] interface {
+	// 与Get相同，同时返回元素的版本号，每次写入值或者修改有效期都会分配新的版本号
+	GetVersion(key K) (V, uint64, bool)
+	// 元素的版本号等于version时写入，version为0时只在key不存在时写入
+	CompareAndSet(key K, val V, expire time.Duration, version uint64) (uint64, error)
+	// 元素的版本号等于version时删除
+	CompareAndDelete(key K, version uint64) (bool, error)
+}
+
+// LoadingCache 未命中时调用loader加载并写入，同一个key的并发未命中只调用一次loader
+type LoadingCache[K comparable, V any] interface {
+	GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context) (V, time.Duration, error)) (V, error)
+}
+
+// EvictNotifier 注册元素被删除时的回调，回调不持有cache的锁
+type EvictNotifier[K comparable, V any] interface {
+	OnEvict(fn func(key K, val V, reason RemovalReason))
+}
+
+// StatsProvider 统计数据的快照
+type StatsProvider interface {
+	Stats() Stats
+	ResetStats()
+}
+
+// Snapshotter 把元素写入快照，或者从快照恢复，保留淘汰顺序和剩余的有效期
+type Snapshotter interface {
+	SaveSnapshot(w io.Writer) error
+	LoadSnapshot(r io.Reader) error
+}
+
+// AOFRewriter 在后台按当前的元素重写aof
+type AOFRewriter interface {
+	RewriteAOF() error
+}
+
+// LRUCache 原来的string/interface{}接口，保留给升级前的调用方
+type LRUCache = Cache[string, interface{}]
+
+type lruCache[K comparable, V any] struct {
 	elemCount int //元素个数
 	elemSize  int //元素占用内存大小
 	maxMemory int //最大内存大小
-	head      *elem
-	tail      *elem
 	l         sync.RWMutex
 	// 使用map存储key val，提高查询效率
-	m        map[string]*elem
+	m        map[K]*elem[K, V]
 	gcState  int64 //是否处于gc状态
-	gcTime   int64 //上次gc的unix时间
-	gcPeriod int64 // 自动gc周期
+	gcTime   int64 //上次gc的unix时间，原子操作
+	gcPeriod int64 // 自动gc周期，原子操作
+	clock    Clock
+	policy   EvictionPolicy[K, V] // 淘汰策略
+	expirer  expirer[K, V]        // 管理带有效期的元素，gc时只处理过期的元素
+	cost     func(K, V) int       // 自定义元素大小的计算方式，为nil时使用sizeof
+	hash     func(K) uint64       // key的hash，没有配置WithHasher并且key不是string、整数类型时为nil
+	closed   int32                // 是否已关闭
+	reported int32                // Close是否已经返回过closeErr，原子操作
+	cancel   context.CancelFunc
+	done     chan struct{} // gc goroutine退出后关闭
+	// 复用elem对象，泛型类型无法使用包级别的pool，每个cache单独持有
+	pool sync.Pool
+	// Get的访问记录，避免Get获取写锁
+	reads   []readBuffer
+	drainCh chan struct{} // 通知后台goroutine回放访问记录
+	// GetOrLoad正在执行的loader
+	loads loadGroup[K, V]
+	// WithLoader注册的loader，用于提前刷新和宽限期内的重新加载
+	loader       func(ctx context.Context, key K) (V, time.Duration, error)
+	refreshAhead time.Duration // 软过期前多久开始提前刷新
+	grace        time.Duration // 软过期后仍然可以返回旧值的时间
+	// 持久化存储，wb为nil时是write-through模式
+	store    Store[K, V]
+	wb       *writeBehind[K, V]
+	closeErr error // 关闭时写入store的错误，由Close返回
+	// 持有写锁期间淘汰了还没有写入store的元素，由写锁保护
+	evictedDirty bool
+	// OnEvict注册的回调，没有注册时为nil
+	evicted *dispatcher[K, V]
+	stats   statCounters
+	aof     *appendLog // WithAOF配置的操作日志，没有配置时为nil
+	codec   Codec      // 快照、aof编码key、value
+	// 最后分配的版本号，由写锁保护
+	// 从创建时的UnixNano开始递增，重启后从aof、快照恢复的元素不会得到重启前的版本号
+	version uint64
+}
+
+// NewLRUCache 保留原有的string/interface{}接口，是NewCache的简单封装，返回值可以赋给LRUCache
+func NewLRUCache() *lruCache[string, interface{}] {
+	return NewCache[string, interface{}]()
+}
+
+// NewLRU 使用配置项创建string/interface{}的cache，同New[string, interface{}]
+func NewLRU(opts ...Option) (LRUCache, error) {
+	return New[string, interface{}](opts...)
 }
 
-func NewLRUCache() *lruCache {
-	cache := &lruCache{
-		maxMemory: LRUDefaultMemory,
+// NewLRUCacheContext ctx结束时，cache自动关闭
+func NewLRUCacheContext(ctx context.Context) *lruCache[string, interface{}] {
+	return NewCacheContext[string, interface{}](ctx)
+}
+
+func NewCache[K comparable, V any]() *lruCache[K, V] {
+	return NewCacheContext[K, V](context.Background())
+}
+
+// NewCacheContext ctx结束时，停止gc goroutine并关闭cache，效果等同于Close
+func NewCacheContext[K comparable, V any](ctx context.Context) *lruCache[K, V] {
+	return newCache[K, V](ctx, defaultOptions())
+}
+
+// New 使用配置项创建cache，配置错误时返回error，不会panic
+func New[K comparable, V any](opts ...Option) (Cache[K, V], error) {
+	return NewContext[K, V](context.Background(), opts...)
+}
+
+// NewContext 同New，ctx结束时cache自动关闭
+func NewContext[K comparable, V any](ctx context.Context, opts ...Option) (Cache[K, V], error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOptions[K, V](o); err != nil {
+		return nil, err
+	}
+	c := newCache[K, V](ctx, o)
+	if o.aofPath != "" {
+		if err := c.openAOF(o.aofPath, o.aofFsync); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 检查与类型参数有关的配置项
+func checkOptions[K comparable, V any](o *options) error {
+	if o.cost != nil {
+		if _, ok := o.cost.(func(K, V) int); !ok {
+			return fmt.Errorf("%w: WithCost的类型%T与cache不匹配", ErrOption, o.cost)
+		}
+	}
+	if o.hasher != nil {
+		if _, ok := o.hasher.(func(K) uint64); !ok {
+			return fmt.Errorf("%w: WithHasher的类型%T与cache不匹配", ErrOption, o.hasher)
+		}
+	}
+	if o.loader != nil {
+		if _, ok := o.loader.(func(context.Context, K) (V, time.Duration, error)); !ok {
+			return fmt.Errorf("%w: WithLoader的类型%T与cache不匹配", ErrOption, o.loader)
+		}
+	} else if o.refreshAhead > 0 || o.grace > 0 {
+		return fmt.Errorf("%w: WithRefreshAhead、WithStaleGrace需要同时设置WithLoader", ErrOption)
+	}
+	if o.store != nil {
+		if _, ok := o.store.(Store[K, V]); !ok {
+			return fmt.Errorf("%w: store的类型%T与cache不匹配", ErrOption, o.store)
+		}
+	}
+	if o.policy == PolicyTinyLFU && newHasher[K](o) == nil {
+		return fmt.Errorf("%w: PolicyTinyLFU需要通过WithHasher配置key的类型%T的hash", ErrOption, *new(K))
+	}
+	return nil
+}
+
+func newCache[K comparable, V any](ctx context.Context, o *options) *lruCache[K, V] {
+	cache := &lruCache[K, V]{
+		maxMemory: o.maxMemory,
 		l:         sync.RWMutex{},
-		m:         make(map[string]*elem),
-		gcTime:    time.Now().UnixNano(),
-		gcPeriod:  int64(DefaultAutoGCPeriod),
-	}
-	go func() {
-		for {
-			cache.l.Lock()
-			cache.gc()
-			cache.l.Unlock()
-			time.Sleep(time.Second * 1)
+		m:         make(map[K]*elem[K, V]),
+		gcTime:    o.clock.Now().UnixNano(),
+		gcPeriod:  int64(o.gcPeriod),
+		clock:     o.clock,
+		policy:    newPolicy[K, V](o),
+		expirer:   newExpirer[K, V](o),
+		done:      make(chan struct{}),
+		reads:     newReadBuffers(),
+		drainCh:   make(chan struct{}, 1),
+		stats:     newStatCounters(),
+		codec:     o.codec,
+		version:   uint64(o.clock.Now().UnixNano()),
+	}
+	if cost, ok := o.cost.(func(K, V) int); ok {
+		cache.cost = cost
+	}
+	cache.hash = newHasher[K](o)
+	if loader, ok := o.loader.(func(context.Context, K) (V, time.Duration, error)); ok {
+		cache.loader = loader
+		cache.refreshAhead = o.refreshAhead
+		cache.grace = o.grace
+	}
+	if store, ok := o.store.(Store[K, V]); ok {
+		cache.store = store
+		if o.writeBehind {
+			cache.wb = newWriteBehind[K, V](store, o.flushBatch)
+			go cache.wb.run(newTicker(o.clock, o.flushInterval))
 		}
-	}()
+	}
+	cache.setPolicyCapacity()
+	cache.pool.New = func() interface{} {
+		return new(elem[K, V])
+	}
+	ctx, cache.cancel = context.WithCancel(ctx)
+	cache.loads.ctx = ctx
+	// 在启动goroutine之前创建定时器，创建cache之后推进FakeClock一定能触发定时器
+	go cache.run(ctx, newTicker(o.clock, time.Second*1))
 	return cache
 }
 
-// 最大4GB，最小1KB
-func (c *lruCache) SetMaxMemory(size string) {
+// 定时触发gc，直到ctx结束
+func (c *lruCache[K, V]) run(ctx context.Context, ticker Ticker) {
+	defer close(c.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.shutdown()
+			// loader随ctx取消，等待它们返回，之后不会再写入cache
+			c.loads.wait()
+			// 关闭之后不会再有新的修改，写入队列中剩余的修改
+			if c.wb != nil {
+				c.closeErr = c.wb.stop()
+			}
+			if c.aof != nil {
+				if err := c.aof.close(); c.closeErr == nil {
+					c.closeErr = err
+				}
+			}
+			if c.evicted != nil {
+				c.evicted.stop()
+			}
+			return
+		case <-ticker.C():
+			c.l.Lock()
+			c.drainReads()
+			c.gc()
+			c.l.Unlock()
+		case <-c.drainCh:
+			c.l.Lock()
+			c.drainReads()
+			c.l.Unlock()
+		}
+	}
+}
+
+// Close 停止gc goroutine，释放所有元素
+// 关闭后Set,SetMaxMemory不做任何操作，Get,Exists返回不存在，Del,Flush返回false，Keys返回0
+// 取消并等待正在执行的loader，包括后台刷新
+// write-behind模式下写入队列中剩余的修改，写入失败时返回错误
+// 配置了aof时等待重写完成后关闭文件，写入aof失败过时返回第一个错误
+// 重复调用返回ErrClosed，通过ctx关闭时，第一次调用Close仍然等待关闭完成并返回关闭时的错误
+func (c *lruCache[K, V]) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.reported, 0, 1) {
+		return ErrClosed
+	}
+	c.cancel()
+	<-c.done
+	return c.closeErr
+}
+
+func (c *lruCache[K, V]) shutdown() {
 	c.l.Lock()
 	defer c.l.Unlock()
+	atomic.StoreInt32(&c.closed, 1)
+	c.flush()
+}
+
+func (c *lruCache[K, V]) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// 最大4GB，最小1KB
+func (c *lruCache[K, V]) SetMaxMemory(size string) {
+	if err := c.TrySetMaxMemory(size); errors.Is(err, ErrMemory) {
+		panic(err)
+	}
+}
+
+// TrySetMaxMemory 参数错误时返回*MemoryErr，可以用errors.Is(err, ErrMemory)判断
+// 新的内存小于当前占用时，立即淘汰元素
+func (c *lruCache[K, V]) TrySetMaxMemory(size string) error {
 	siz, err := getMemorySize(size)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	c.maxMemory = siz
+	return c.setMaxMemory(siz)
 }
-func (c *lruCache) SetGCPeriod(d time.Duration) {
-	c.gcPeriod = int64(d)
+
+func (c *lruCache[K, V]) setMaxMemory(size int) error {
+	c.l.Lock()
+	defer c.unlock()
+	if c.isClosed() {
+		return ErrClosed
+	}
+	c.maxMemory = size
+	c.setPolicyCapacity()
+	c.evict(0)
+	return nil
+}
+func (c *lruCache[K, V]) SetGCPeriod(d time.Duration) {
+	atomic.StoreInt64(&c.gcPeriod, int64(d))
 }
-func (c *lruCache) Set(key string, val interface{}, expire time.Duration) {
+
+// 元素大小超过最大内存时不会存入，也不会panic
+func (c *lruCache[K, V]) Set(key K, val V, expire time.Duration) {
+	if err := c.TrySet(key, val, expire); errors.Is(err, ErrExpire) {
+		panic(err)
+	}
+}
+
+// TrySet expire<0时返回*ExpireErr，可以用errors.Is(err, ErrExpire)判断
+// 元素大小超过最大内存时返回ErrTooLarge，write-through模式下写入store失败时返回store的错误
+// 写入aof失败时返回错误，cache中的元素已经修改
+func (c *lruCache[K, V]) TrySet(key K, val V, expire time.Duration) error {
 	if expire < 0 {
-		panic(&ExpireErr{expire})
+		return &ExpireErr{expire}
+	}
+	return c.write(key, val, expireAt(expire, c.clock.Now()), expire, false)
+}
+
+// 元素大小超过最大内存时不会存入
+func (c *lruCache[K, V]) SetWithDeadline(key K, val V, deadline time.Time) {
+	c.TrySetWithDeadline(key, val, deadline)
+}
+
+// TrySetWithDeadline 元素大小超过最大内存时返回ErrTooLarge
+func (c *lruCache[K, V]) TrySetWithDeadline(key K, val V, deadline time.Time) error {
+	expire, ttl := deadlineAt(deadline, c.clock.Now())
+	return c.write(key, val, expire, ttl, false)
+}
+
+// 调用方写入元素，配置了store时同时写入store
+// write-through模式下先检查cache是否已关闭、元素是否超过最大内存，再写入store，成功后再写入cache
+// 同一个key的并发写入，store与cache中的顺序可能不同
+func (c *lruCache[K, V]) write(key K, val V, expire int64, ttl time.Duration, sliding bool) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if c.store != nil && c.wb == nil {
+		if err := c.checkWrite(c.sizeof(key, val)); err != nil {
+			return err
+		}
+		if err := c.saveThrough(key, val); err != nil {
+			return err
+		}
 	}
-	size := sizeof(key) + sizeof(val)
+	return c.set(key, val, expire, ttl, sliding, true)
+}
+
+// 与setVersion相同的检查，cache不会接受的写入不写入store
+func (c *lruCache[K, V]) checkWrite(size int) error {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if size > c.maxMemory {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// 写入元素，expire为过期时间的UnixNano，0表示永不过期
+// ttl为设置时的有效期，sliding为true时每次Get按ttl延长有效期
+// dirty为true时write-behind模式下加入写入队列，从store或者loader加载的值不需要写回
+func (c *lruCache[K, V]) set(key K, val V, expire int64, ttl time.Duration, sliding, dirty bool) error {
+	_, err := c.setVersion(key, val, expire, ttl, sliding, dirty, false, 0, nil)
+	return err
+}
+
+// 写入前的元素，写入store失败时用于恢复
+type prevValue[V any] struct {
+	ok      bool // 写入前元素存在并且没有过期
+	val     V
+	soft    int64
+	ttl     time.Duration
+	sliding bool
+}
+
+// 与set相同，check为true时只在元素的版本号等于version时写入，已经过期的元素版本号为0
+// 返回写入后的版本号，没有写入时返回0，prev不为nil时保存写入前的元素
+func (c *lruCache[K, V]) setVersion(key K, val V, expire int64, ttl time.Duration, sliding, dirty, check bool, version uint64, prev *prevValue[V]) (uint64, error) {
+	size := c.sizeof(key, val)
 	c.l.Lock()
-	defer c.l.Unlock()
+	defer c.unlock()
+	return c.setLocked(key, val, size, expire, ttl, sliding, dirty, check, version, prev)
+}
+
+// setVersion持有写锁之后的部分，size为元素大小，必须持有写锁
+func (c *lruCache[K, V]) setLocked(key K, val V, size int, expire int64, ttl time.Duration, sliding, dirty, check bool, version uint64, prev *prevValue[V]) (uint64, error) {
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+	now := c.clock.Now()
 	// 如果存在，直接修改
 	v, ok := c.get(key)
+	if check {
+		var cur uint64
+		if ok && v.alive(now) {
+			cur = v.version
+		}
+		if cur != version {
+			return 0, ErrVersion
+		}
+	}
+	if prev != nil && ok && v.alive(now) {
+		*prev = prevValue[V]{ok: true, val: v.val, soft: atomic.LoadInt64(&v.soft), ttl: v.ttl, sliding: v.sliding}
+	}
+	if size > c.maxMemory {
+		return 0, ErrTooLarge
+	}
+	if dirty {
+		c.markDirty(key, pendingWrite[V]{val: val})
+	}
+	err := c.logSet(key, val, expire, ttl, sliding)
+	// 写入时已经过期，等同于删除
+	if expire != 0 && expire <= now.UnixNano() {
+		if ok {
+			c.remove(v, ReasonExpired)
+		}
+		return 0, err
+	}
+	c.version++
 	if ok {
-		// 目前大小不变
-		v.setVal(key, val)
-		v.setExpire(expire)
-		c.lpush(v)
-		return
+		oldSize := v.size
+		if v.alive(now) {
+			c.notifyRemoval(v, ReasonReplaced)
+		} else {
+			// 已经过期、还没有被gc回收的元素按过期通知
+			c.notifyRemoval(v, ReasonExpired)
+			c.countRemoval(ReasonExpired)
+		}
+		c.elemSize += size - oldSize
+		v.setVal(key, val, size)
+		v.setExpire(expire, ttl, c.grace)
+		v.sliding = sliding
+		v.version = c.version
+		c.expirer.add(v)
+		c.policy.OnUpdate(v, oldSize)
+		// 新值可能更大，继续淘汰
+		c.evict(0)
+		c.stats.add(0, statSets, 1)
+		return v.version, err
 	}
 	// 如果当前内存占用率大于1,则触发gc
 	if c.elemSize+size > c.maxMemory {
 		c.gc()
 	}
 	// 可能gc后，内存占用率仍高于1
-	for c.elemSize+size > c.maxMemory {
-		e := c.rpop()
-		c.elemCount--
-		c.elemSize -= e.size
-		e.reset()
-		elemPool.Put(e)
+	c.evict(size)
+	v1 := c.pool.Get().(*elem[K, V])
+	v1.setVal(key, val, size)
+	if c.hash != nil {
+		v1.hash = c.hash(key)
+	} else {
+		// 没有hash时只用于选择读缓冲区，按版本号分散
+		v1.hash = mix64(c.version)
 	}
-	v1 := elemPool.Get().(*elem)
-	v1.setVal(key, val)
-	v1.setExpire(expire)
-	c.lpush(v1)
+	v1.setExpire(expire, ttl, c.grace)
+	v1.sliding = sliding
+	v1.version = c.version
+	c.expirer.add(v1)
+	c.m[key] = v1
+	c.policy.OnInsert(v1)
 
 	c.elemCount++
 	c.elemSize += v1.size
+	c.stats.add(0, statSets, 1)
+	return c.version, err
 }
 
-// get部分使用读锁,movieToHead部分使用写锁
-func (c *lruCache) Get(key string) (interface{}, bool) {
+// 按淘汰策略淘汰元素，直到能再放下size大小的元素
+func (c *lruCache[K, V]) evict(size int) {
+	if c.elemSize+size > c.maxMemory {
+		// 淘汰前先回放访问记录，使淘汰策略的顺序是最新的
+		c.drainReads()
+	}
+	for c.elemSize+size > c.maxMemory {
+		e := c.policy.Victim()
+		if e == nil {
+			return
+		}
+		c.writeBack(e.key)
+		c.remove(e, ReasonCapacity)
+	}
+}
+
+// 从map和淘汰策略中删除e，通知OnEvict的回调，elem放回pool
+func (c *lruCache[K, V]) remove(e *elem[K, V], reason RemovalReason) {
+	c.notifyRemoval(e, reason)
+	c.countRemoval(reason)
+	c.policy.OnRemove(e)
+	c.expirer.del(e)
+	delete(c.m, e.key)
+	c.elemCount--
+	c.elemSize -= e.size
+	e.reset()
+	c.pool.Put(e)
+}
+
+// 通知需要知道最大内存的淘汰策略
+func (c *lruCache[K, V]) setPolicyCapacity() {
+	if p, ok := c.policy.(capacityAware); ok {
+		p.setCapacity(c.maxMemory)
+	}
+}
+
+// 元素占用的内存大小，设置了cost时使用cost
+func (c *lruCache[K, V]) sizeof(key K, val V) int {
+	if c.cost != nil {
+		return c.cost(key, val)
+	}
+	return sizeof(key) + sizeof(val)
+}
+
+// 只使用读锁，访问记录写入读缓冲区，由后台goroutine或者下一次淘汰前批量回放到淘汰策略
+// 滑动过期的元素按设置时的有效期延长
+// 设置了loader时，快要过期或者处于宽限期的元素返回当前的值，并在后台重新加载
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	v, _, ok := c.GetVersion(key)
+	return v, ok
+}
+
+// GetVersion 版本号在每次写入时分配，同一个cache中不会重复，Expire、Touch等修改有效期时也分配新的版本号
+func (c *lruCache[K, V]) GetVersion(key K) (V, uint64, bool) {
 	c.l.RLock()
+	now := c.clock.Now()
 	val, ok := c.get(key)
-	if !ok || !val.alive() {
+	if !ok || !val.alive(now) || c.isClosed() {
 		c.l.RUnlock()
-		return nil, false
+		c.stats.add(c.missStripe(key), statMisses, 1)
+		var zero V
+		return zero, 0, false
 	}
+	// 读缓冲区和统计计数的分段使用插入时计算的hash
+	v, version, h := val.val, val.version, val.hash
+	if val.sliding {
+		val.slide(now, c.grace)
+	}
+	refresh := c.loader != nil && val.needRefresh(now, c.refreshAhead)
 	c.l.RUnlock()
+	c.stats.add(h, statHits, 1)
+	c.recordAccess(h, val)
+	if refresh {
+		c.refresh(key, version)
+	}
+	return v, version, true
+}
+
+// 未命中时选择统计计数的分段，只用于分散竞争，同一个key不需要落在同一段
+// 没有hash时按当前goroutine栈上变量的地址选择，不同goroutine的栈不同，不写共享的计数器，也不格式化key
+func (c *lruCache[K, V]) missStripe(key K) uint64 {
+	if c.hash != nil {
+		return c.hash(key)
+	}
+	var x byte
+	return mix64(uint64(uintptr(unsafe.Pointer(&x))))
+}
+
+// CompareAndSet 元素当前的版本号等于version时写入，version为0表示key不存在或者已经过期时才写入
+// 成功时返回新的版本号，版本号不匹配时返回ErrVersion，其他错误同TrySet
+// write-through模式下先比较版本号并写入cache，再写入store，写入store失败时恢复原来的元素并返回store的错误
+func (c *lruCache[K, V]) CompareAndSet(key K, val V, expire time.Duration, version uint64) (uint64, error) {
+	if expire < 0 {
+		return 0, &ExpireErr{expire}
+	}
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+	var prev prevValue[V]
+	newVersion, err := c.setVersion(key, val, expireAt(expire, c.clock.Now()), expire, false, true, true, version, &prev)
+	if newVersion == 0 {
+		return 0, err
+	}
+	if serr := c.saveThrough(key, val); serr != nil {
+		c.undo(key, newVersion, prev)
+		return 0, serr
+	}
+	return newVersion, err
+}
+
+// 写入store失败时恢复修改前的元素，cur为修改后的版本号，key不存在时为0
+// 之后又被其他调用修改过时保留新的值
+func (c *lruCache[K, V]) undo(key K, cur uint64, prev prevValue[V]) {
+	if prev.ok {
+		c.setVersion(key, prev.val, prev.soft, prev.ttl, prev.sliding, false, true, cur, nil)
+		return
+	}
 	c.l.Lock()
-	c.moveToHead(val)
-	c.l.Unlock()
-	return val.val, true
+	defer c.l.Unlock()
+	if e, ok := c.get(key); ok && !c.isClosed() && e.version == cur {
+		c.logDel(key)
+		c.remove(e, ReasonExplicit)
+	}
 }
-func (c *lruCache) Del(key string) bool {
+
+// Del 配置了store时同时删除store中的key，即使key不在cache中
+// write-through模式下删除store失败时不修改cache，返回false
+func (c *lruCache[K, V]) Del(key K) bool {
+	if c.isClosed() {
+		return false
+	}
+	if err := c.deleteThrough(key); err != nil {
+		return false
+	}
 	c.l.Lock()
 	defer c.l.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.markDirty(key, pendingWrite[V]{del: true})
+	c.invalidateLoad(key)
 	val, ok := c.get(key)
 	if !ok {
 		return false
 	}
-	c.del(val)
-	c.elemCount--
-	c.elemSize -= val.size
-	val.reset()
-	elemPool.Put(val)
+	c.logDel(key)
+	c.remove(val, ReasonExplicit)
 	return true
 }
 
-func (c *lruCache) Exists(key string) bool {
+// CompareAndDelete 元素的版本号等于version时删除，返回true
+// key不存在或者已经过期时返回false，版本号不匹配时返回ErrVersion
+// write-through模式下先删除cache中的元素，再删除store中的key，删除store失败时恢复cache中的元素
+func (c *lruCache[K, V]) CompareAndDelete(key K, version uint64) (bool, error) {
+	c.l.Lock()
+	if c.isClosed() {
+		c.l.Unlock()
+		return false, ErrClosed
+	}
+	e, ok := c.get(key)
+	if !ok || !e.alive(c.clock.Now()) {
+		c.l.Unlock()
+		return false, nil
+	}
+	if e.version != version {
+		c.l.Unlock()
+		return false, ErrVersion
+	}
+	prev := prevValue[V]{ok: true, val: e.val, soft: atomic.LoadInt64(&e.soft), ttl: e.ttl, sliding: e.sliding}
+	c.markDirty(key, pendingWrite[V]{del: true})
+	c.invalidateLoad(key)
+	c.logDel(key)
+	c.remove(e, ReasonExplicit)
+	c.l.Unlock()
+	if err := c.deleteThrough(key); err != nil {
+		c.undo(key, 0, prev)
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *lruCache[K, V]) Exists(key K) bool {
 	c.l.RLock()
 	defer c.l.RUnlock()
 	val, ok := c.get(key)
-	if ok && !val.alive() {
+	if ok && !val.alive(c.clock.Now()) || c.isClosed() {
 		return false
 	}
 	return ok
 }
-func (c *lruCache) Flush() bool {
+func (c *lruCache[K, V]) Flush() bool {
 	c.l.Lock()
 	defer c.l.Unlock()
-	c.head = nil
-	c.tail = nil
+	if c.isClosed() {
+		return false
+	}
+	c.logFlush()
+	c.flush()
+	return true
+}
+
+// 清空所有元素，elem放回pool
+func (c *lruCache[K, V]) flush() {
+	c.policy.Reset()
+	c.expirer.reset()
 	c.elemCount = 0
 	c.elemSize = 0
 	// 重制哈希表
 	oldm := c.m
-	c.m = make(map[string]*elem)
+	c.m = make(map[K]*elem[K, V])
 	for _, v := range oldm {
+		c.notifyRemoval(v, ReasonFlushed)
 		v.reset()
-		elemPool.Put(v)
+		c.pool.Put(v)
 	}
-	return true
 }
 
-func (c *lruCache) Keys() int64 {
+func (c *lruCache[K, V]) Keys() int64 {
 	c.l.RLock()
 	defer c.l.RUnlock()
 	return int64(c.elemCount)
 }
 
-func (c *lruCache) get(key string) (*elem, bool) {
+func (c *lruCache[K, V]) get(key K) (*elem[K, V], bool) {
 	// 通过遍历哈希表，查询元素
 	e, ok := c.m[key]
 	return e, ok
 }
 
-// 将e移到第一个
-func (c *lruCache) moveToHead(e *elem) {
-	c.del(e)
-	c.lpush(e)
-}
-
-// 删除e,e必定是链表中的一个元素
-func (c *lruCache) del(e *elem) {
-	if e.next == nil && e.prev == nil { // 只有e一个元素
-		c.head = nil
-		c.tail = nil
-	} else if e.next == nil { // e是最后一个元素
-		prev := e.prev
-		prev.next = nil
-		c.tail = prev
-	} else if e.prev == nil { // e是第一个元素
-		next := e.next
-		next.prev = nil
-		c.head = next
-	} else {
-		prev := e.prev
-		prev.next = e.next
-		e.next.prev = prev
+// 回收过期元素，由时间轮或者随机采样找出过期的元素，不遍历全部元素
+// 触发条件,必须同时满足
+//		1. 当前gcState==0
+//		2. gc间隔>最小gc间隔
+//		3. gc间隔过了gcPeriod秒,或者cache内存使用率>3/4
+// 触发时机
+//  1. cache创建后，自启动一个goroutine定时调用
+//  2. 调用Set时，如果内存使用率达到1
+func (c *lruCache[K, V]) gc() {
+	if c.testgc() && atomic.CompareAndSwapInt64(&c.gcState, 0, 1) {
+		now := c.clock.Now()
+		atomic.StoreInt64(&c.gcTime, now.UnixNano())
+		c.expirer.advance(now, c.expire)
+		c.countGC(c.clock.Now().Sub(now))
+		atomic.StoreInt64(&c.gcState, 0)
 	}
-	delete(c.m, e.key)
-	e.free()
 }
 
-// 把元素插入第一个
-func (c *lruCache) lpush(e *elem) {
-	if c.head == nil { // 没有元素
-		c.tail = e
-	} else {
-		e.next = c.head
-		e.prev = nil
-		c.head.prev = e
+// 删除过期的元素
+func (c *lruCache[K, V]) expire(e *elem[K, V]) {
+	c.remove(e, ReasonExpired)
+}
+
+func (c *lruCache[K, V]) testgc() bool {
+	state := atomic.LoadInt64(&c.gcState)
+	interval := c.clock.Now().UnixNano() - atomic.LoadInt64(&c.gcTime)
+	result := state == 0 && interval > int64(MinGCPeriod) && (interval > atomic.LoadInt64(&c.gcPeriod) || c.elemSize > c.maxMemory*3/4)
+
+	return result
+}
+
+type elem[K comparable, V any] struct {
+	key  K
+	val  V   //存储内容
+	size int //元素大小
+	// 硬过期时间的UnixNano，超过后删除，0表示永不过期
+	// 滑动过期的元素在Get时延长有效期，Get只持有读锁，需要原子操作
+	expire int64
+	// 软过期时间，即有效期结束的时间，配置了宽限期时，硬过期时间为软过期时间+宽限期
+	// 软过期之后、硬过期之前，Get返回旧值并在后台重新加载
+	soft    int64
+	ttl     time.Duration // 设置时的有效期，Touch和滑动过期按它延长
+	sliding bool          // 每次Get都延长有效期
+	next    *elem[K, V]
+	prev    *elem[K, V]
+	freq    int   // LFU的访问次数
+	ref     bool  // CLOCK的访问标记
+	index   int   // Random中所在slice的下标
+	seg     uint8 // 多链表策略中元素所在的链表
+	wnext   *elem[K, V]
+	wprev   *elem[K, V]
+	wslot   *wheelSlot[K, V] // 所在的时间轮槽，不在时间轮中时为nil
+	tindex  int              // 采样过期中的下标+1，0表示不在其中
+	version uint64           // 写入时分配的版本号
+	hash    uint64           // key的hash，插入时计算一次，淘汰策略和Get选择读缓冲区时复用
+	// 下一次可以开始后台刷新的UnixNano，开始刷新时设置，修改有效期时清零，Get只持有读锁，需要原子操作
+	retry int64
+}
+
+// 有效期为d时的过期时间，d为0时永不过期，返回0
+func expireAt(d time.Duration, now time.Time) int64 {
+	if d == 0 {
+		return 0
 	}
-	c.m[e.key] = e
-	c.head = e
+	// 超出UnixNano范围时按最大值处理，与deadlineAt相同
+	if t := now.Add(d); t.Before(maxDeadline) {
+		return t.UnixNano()
+	}
+	return maxDeadline.UnixNano()
 }
 
-// 弹出最后一个elem
-func (c *lruCache) rpop() *elem {
-	if c.head == nil { // 如果没有元素，返回nil
-		return nil
+// deadline对应的过期时间和有效期，deadline为零值时永不过期
+// 已经过去的deadline按now处理，超出UnixNano范围的deadline按最大值处理
+func deadlineAt(deadline, now time.Time) (int64, time.Duration) {
+	if deadline.IsZero() {
+		return 0, 0
+	}
+	if !deadline.After(now) {
+		return now.UnixNano(), 0
 	}
-	//如果只有一个元素，需要清空tail和head
-	if c.head.next == nil && c.tail.prev == nil {
-		e := c.head
-		c.tail = nil
-		c.head = nil
-		delete(c.m, e.key)
-		return e
+	if deadline.After(maxDeadline) {
+		deadline = maxDeadline
 	}
-	tail := c.tail
-	newTail := tail.prev
-	newTail.next = nil
-	c.tail = newTail
-	delete(c.m, tail.key)
-	tail.free()
-	return tail
+	return deadline.UnixNano(), deadline.Sub(now)
 }
 
-// 回收过期元素
-// 触发条件,必须同时满足
-//		1. 当前gcState==0
-//		2. gc间隔>最小gc间隔
-//		3. gc间隔过了gcPeriod秒,或者cache内存使用率>3/4
-// 触发时机
-//		1. cache创建后，自启动一个goroutine定时调用
-//		2. 调用Set时，如果内存使用率达到1
-func (c *lruCache) gc() {
-	if c.testgc() && atomic.CompareAndSwapInt64(&c.gcState, 0, 1) {
-		c.gcTime = time.Now().UnixNano()
-		for _, v := range c.m {
-			if !v.alive() {
-				c.elemCount--
-				c.elemSize -= v.size
-				c.del(v)
-				v.reset()
-				elemPool.Put(v)
-			}
+// 修改有效期，soft为软过期时间，硬过期时间再加上宽限期grace，必须持有写锁
+func (e *elem[K, V]) setExpire(soft int64, ttl, grace time.Duration) {
+	e.storeExpire(soft, grace)
+	e.ttl = ttl
+	atomic.StoreInt64(&e.retry, 0)
+}
+
+func (e *elem[K, V]) storeExpire(soft int64, grace time.Duration) {
+	hard := soft
+	if soft != 0 && grace > 0 {
+		hard = soft + int64(grace)
+		if hard < soft {
+			hard = math.MaxInt64
 		}
-		atomic.StoreInt64(&c.gcState, 0)
 	}
+	atomic.StoreInt64(&e.soft, soft)
+	atomic.StoreInt64(&e.expire, hard)
 }
-func (c *lruCache) testgc() bool {
-	state := atomic.LoadInt64(&c.gcState)
-	interval := time.Now().UnixNano() - c.gcTime
-	result := state == 0 && interval > int64(MinGCPeriod) && (interval > int64(c.gcPeriod) || c.elemSize > c.maxMemory*3/4)
 
-	return result
+func (e *elem[K, V]) getExpire() int64 {
+	return atomic.LoadInt64(&e.expire)
 }
 
-type elem struct {
-	key    string
-	val    interface{} //存储内容
-	size   int         //元素大小
-	expire time.Time
-	next   *elem
-	prev   *elem
+func (e *elem[K, V]) getSoft() int64 {
+	return atomic.LoadInt64(&e.soft)
 }
 
-func (e *elem) setExpire(d time.Duration) {
-	if d == 0 {
-		e.expire = LRUMaxTime
-	} else if d > 0 {
-		e.expire = time.Now().Add(d)
-	} else {
-		panic(&ExpireErr{d: d})
+// 距离软过期不超过window，需要在后台重新加载，返回true的调用方负责开始刷新
+func (e *elem[K, V]) needRefresh(now time.Time, window time.Duration) bool {
+	soft := e.getSoft()
+	if soft == 0 || now.UnixNano() < soft-int64(window) {
+		return false
 	}
+	// 上一次刷新开始后refreshRetry内不再刷新，加载成功时写入新的有效期会清零，失败时等待后重试
+	retry := atomic.LoadInt64(&e.retry)
+	return now.UnixNano() >= retry && atomic.CompareAndSwapInt64(&e.retry, retry, now.Add(refreshRetry).UnixNano())
 }
-func (e *elem) setVal(key string, val interface{}) {
+func (e *elem[K, V]) setVal(key K, val V, size int) {
 	e.key = key
 	e.val = val
-	e.size = sizeof(val) + sizeof(key)
+	e.size = size
+}
+func (e *elem[K, V]) alive(now time.Time) bool {
+	expire := e.getExpire()
+	return expire == 0 || expire > now.UnixNano()
 }
-func (e *elem) alive() bool {
-	return e.expire.Unix() > time.Now().Unix()
+
+// 永不过期
+func (e *elem[K, V]) persistent() bool {
+	return e.getExpire() == 0
 }
 
 // 清空前后关系
-func (e *elem) free() {
+func (e *elem[K, V]) free() {
 	if e != nil {
 		e.next = nil
 		e.prev = nil
@@ -383,14 +982,32 @@ func (e *elem) free() {
 }
 
 // 全部清空
-func (e *elem) reset() {
+func (e *elem[K, V]) reset() {
 	if e != nil {
 		e.next = nil
 		e.prev = nil
-		// e.expire = time.Now()
-		e.key = ""
+		atomic.StoreInt64(&e.expire, 0)
+		atomic.StoreInt64(&e.soft, 0)
+		atomic.StoreInt64(&e.retry, 0)
+		e.ttl = 0
+		e.sliding = false
+		var (
+			key K
+			val V
+		)
+		e.key = key
 		e.size = 0
-		e.val = nil
+		e.val = val
+		e.freq = 0
+		e.hash = 0
+		e.ref = false
+		e.index = 0
+		e.seg = 0
+		e.wnext = nil
+		e.wprev = nil
+		e.wslot = nil
+		e.tindex = 0
+		e.version = 0
 
 	}
 }
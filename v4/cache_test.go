@@ -1,21 +1,61 @@
 package v4
 
 import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+var _ LRUCache = NewLRUCache()
+
+// New返回的cache实现了所有可选接口
+var (
+	_ Cache[string, int]          = (*lruCache[string, int])(nil)
+	_ TTLCache[string, int]       = (*lruCache[string, int])(nil)
+	_ VersionedCache[string, int] = (*lruCache[string, int])(nil)
+	_ LoadingCache[string, int]   = (*lruCache[string, int])(nil)
+	_ EvictNotifier[string, int]  = (*lruCache[string, int])(nil)
+	_ StatsProvider               = (*lruCache[string, int])(nil)
+	_ Snapshotter                 = (*lruCache[string, int])(nil)
+	_ AOFRewriter                 = (*lruCache[string, int])(nil)
+)
+
+// 升级前的调用方式仍然可以使用
+func TestLRUCache(t *testing.T) {
+	assert := assert.New(t)
+	var cache LRUCache = NewLRUCache()
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Set("b", "b", 0)
+	val, ok := cache.Get("a")
+	assert.True(ok)
+	assert.Equal(1, val.(int))
+
+	cache, err := NewLRU(WithMaxMemory("1MB"))
+	assert.Nil(err)
+	defer cache.Close()
+	cache.Set("a", []byte("a"), 0)
+	assert.True(cache.Exists("a"))
+	_, err = NewLRU(WithMaxMemory("1B"))
+	assert.True(errors.Is(err, ErrMemory))
+}
+
 func TestNew(t *testing.T) {
 	assert := assert.New(t)
 	cache := NewLRUCache()
 	assert.Equal(cache.maxMemory, LRUDefaultMemory)
 	assert.Equal(0, cache.elemCount)
 	assert.Equal(0, cache.elemSize)
-	assert.Nil(cache.head)
-	assert.Nil(cache.tail)
+	assert.Equal(0, cache.policy.Len())
 	assert.Equal(int64(DefaultAutoGCPeriod), cache.gcPeriod)
 }
 
@@ -166,14 +206,39 @@ func TestSet(t *testing.T) {
 	}
 }
 
+// 测试使用的cache，配置错误时终止测试，测试结束时关闭
+func newTestCache[K comparable, V any](t testing.TB, opts ...Option) *lruCache[K, V] {
+	t.Helper()
+	c, err := New[K, V](opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := c.(*lruCache[K, V])
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+// 每个元素固定算32byte，便于计算内存占用
+func fixedCost(string, interface{}) int { return 32 }
+
+// 等待后台goroutine开始gc，gc结束前持有写锁，之后的读操作会等待gc结束
+func waitGC(cache *lruCache[string, interface{}], gcTime int64) bool {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&cache.gcTime) != gcTime {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
 // 测试超过最大内存时
 func TestSetOutofMaxMemory(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
+	cache := newTestCache[string, interface{}](t, WithCost(fixedCost))
 	cache.SetMaxMemory("32KB")
 	count := 1 << 10
-	// key算16byte
-	// 目前val算16byte
+	// 每个元素固定算32byte
 	for i := 0; i < count; i++ {
 		key := strconv.Itoa(i + 1)
 		cache.Set(key, i+1, 0)
@@ -191,10 +256,106 @@ func TestSetOutofMaxMemory(t *testing.T) {
 	}
 }
 
+type sized struct {
+	data []byte
+}
+
+func (s sized) Size() int {
+	return 1000
+}
+
+// 测试元素大小的估算
+func TestSizeof(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	assert := assert.New(t)
+	table := []struct {
+		val  interface{}
+		size int
+	}{
+		{nil, 0},
+		{1, 8},
+		{int32(1), 4},
+		{3.14, 8},
+		{true, 1},
+		{'a', 4},
+		{"", 16},
+		{"啊啊啊", 16 + 9},
+		{make([]byte, 1000), 24 + 1000},
+		{[]int{1, 2, 3}, 24 + 3*8},
+		{[]string{"1", "22"}, 24 + 17 + 18},
+		{[3]int64{}, 24},
+		{map[string]int{"ab": 1}, 48 + 18 + 8},
+		{user{"wc", 88}, 18 + 8},
+		{&user{"wc", 88}, 8 + 18 + 8},
+		{(*user)(nil), 8},
+		{sized{}, 1000},
+		{&sized{}, 1000},
+		{(*sized)(nil), 8},
+		{[]*sized{nil}, 24 + 8},
+		{[]sized{{}, {}}, 24 + 2000},
+	}
+	for _, v := range table {
+		assert.Equal(v.size, sizeof(v.val), "%#v", v.val)
+	}
+}
+
+// 测试按真实大小淘汰元素
+func TestSetSize(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, []byte]()
+	cache.SetMaxMemory("10KB")
+	// 每个元素17+24+1000byte
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), make([]byte, 1000), 0)
+	}
+	assert.Equal(int64(9), cache.Keys())
+	assert.Equal(9*1041, cache.elemSize)
+	assert.False(cache.Exists("0"))
+
+	// 更新为更大的值，淘汰链表尾的元素
+	cache.Set("9", make([]byte, 3000), 0)
+	assert.Equal(int64(7), cache.Keys())
+	assert.Equal(6*1041+3041, cache.elemSize)
+	assert.False(cache.Exists("1"))
+	assert.False(cache.Exists("2"))
+
+	// 缩小最大内存，立即淘汰
+	cache.SetMaxMemory("5KB")
+	assert.Equal(int64(2), cache.Keys())
+	assert.True(cache.Exists("9"))
+	assert.True(cache.Exists("8"))
+
+	assert.Equal(ErrTooLarge, cache.TrySet("big", make([]byte, 10*UnitKB), 0))
+	assert.NotPanics(func() { cache.Set("big", make([]byte, 10*UnitKB), 0) })
+	assert.False(cache.Exists("big"))
+	assert.Equal(int64(2), cache.Keys())
+}
+
+// 测试自定义元素大小
+func TestWithCost(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestCache[string, string](t,
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val string) int { return len(val) }),
+	)
+	c.Set("a", string(make([]byte, 600)), 0)
+	c.Set("b", string(make([]byte, 600)), 0)
+	assert.False(c.Exists("a"))
+	assert.True(c.Exists("b"))
+	assert.Equal(600, c.elemSize)
+
+	_, err := New[string, int](WithCost(func(key string, val string) int { return 1 }))
+	assert.True(errors.Is(err, ErrOption))
+}
+
 // 测试Expire和Exists
 func TestExpireExists(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
 	table := []struct {
 		key    string
 		val    interface{}
@@ -208,7 +369,7 @@ func TestExpireExists(t *testing.T) {
 	for _, v := range table {
 		cache.Set(v.key, v.val, v.expire)
 	}
-	time.Sleep(time.Second * 3)
+	clock.Advance(time.Second * 3)
 	for _, v := range table {
 		ok := cache.Exists(v.key)
 		assert.Equal(v.exists, ok, v.key)
@@ -218,7 +379,8 @@ func TestExpireExists(t *testing.T) {
 // 测试Expire和Get
 func TestExpireGet(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
 	table := []struct {
 		key    string
 		val    interface{}
@@ -233,7 +395,7 @@ func TestExpireGet(t *testing.T) {
 	for _, v := range table {
 		cache.Set(v.key, v.val, v.expire)
 	}
-	time.Sleep(time.Second * 3)
+	clock.Advance(time.Second * 3)
 	for _, v := range table {
 		val, ok := cache.Get(v.key)
 		assert.Equal(v.exists, ok, v.key)
@@ -246,7 +408,8 @@ func TestExpireGet(t *testing.T) {
 // 测试Expire和Keys
 func TestExpireKeys(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
 	table := []struct {
 		key    string
 		val    interface{}
@@ -262,10 +425,10 @@ func TestExpireKeys(t *testing.T) {
 	}
 	keys := cache.Keys()
 	assert.Equal(int64(3), keys)
-	time.Sleep(time.Second * 2)
+	clock.Advance(time.Second * 2)
 	keys = cache.Keys()
 	assert.Equal(int64(3), keys)
-	time.Sleep(time.Second * 2)
+	clock.Advance(time.Second * 2)
 	keys = cache.Keys()
 	assert.Equal(int64(3), keys)
 }
@@ -444,26 +607,25 @@ func TestFlush(t *testing.T) {
 	assert.Equal(0, cache.elemSize)
 	assert.Equal(0, cache.elemCount)
 	assert.Equal(0, len(cache.m))
-	assert.Nil(cache.head)
-	assert.Nil(cache.tail)
+	assert.Equal(0, cache.policy.Len())
 }
 
 func TestSetGCPeriod(t *testing.T) {
 	assert := assert.New(t)
 	cache := NewLRUCache()
 	cache.SetGCPeriod(time.Second * 120)
-	assert.Equal(int64(time.Second*120), cache.gcPeriod)
+	assert.Equal(int64(time.Second*120), atomic.LoadInt64(&cache.gcPeriod))
 }
 
 // 测试gc，且gc后元素都有效
 func TestGC(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
-	t1 := cache.gcTime
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock), WithCost(fixedCost))
+	t1 := atomic.LoadInt64(&cache.gcTime)
 	cache.SetMaxMemory("32KB")
 	count := 1 << 10
-	// key算16byte
-	// 目前val算16byte
+	// 每个元素固定算32byte
 	for i := 0; i < count; i++ {
 		key := strconv.Itoa(i + 1)
 		cache.Set(key, i+1, 0)
@@ -471,23 +633,24 @@ func TestGC(t *testing.T) {
 	assert.Equal(32*1<<10, cache.elemSize)
 	// 此时内存使用率为1，且gcState=0，但是时间<自动gc时间。未达到gc条件
 	// gctime不变
-	assert.Equal(t1, cache.gcTime)
+	assert.Equal(t1, atomic.LoadInt64(&cache.gcTime))
 	cache.SetGCPeriod(time.Second * 2)
-	time.Sleep(time.Second * 3)
-	// 休眠时间，触发了gc，gctime变化
-	assert.Greater(cache.gcTime, t1)
+	clock.Advance(time.Second * 3)
+	// 时钟前进，定时器触发了gc，gctime变化
+	assert.True(waitGC(cache, t1))
+	assert.Greater(atomic.LoadInt64(&cache.gcTime), t1)
 	assert.Equal(int64(1<<10), cache.Keys())
 }
 
 // 测试gc，触发gc时，元素都已失效
 func TestGC1(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
-	t1 := cache.gcTime
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock), WithCost(fixedCost))
+	t1 := atomic.LoadInt64(&cache.gcTime)
 	cache.SetMaxMemory("32KB")
 	count := 1 << 10
-	// key算16byte
-	// 目前val算16byte
+	// 每个元素固定算32byte
 	for i := 0; i < count; i++ {
 		key := strconv.Itoa(i + 1)
 		cache.Set(key, i+1, time.Second)
@@ -495,29 +658,29 @@ func TestGC1(t *testing.T) {
 	assert.Equal(32*1<<10, cache.elemSize)
 	// 此时内存使用率为1，且gcState=0，但是时间<自动gc时间。未达到gc条件
 	// gctime不变
-	assert.Equal(t1, cache.gcTime)
+	assert.Equal(t1, atomic.LoadInt64(&cache.gcTime))
 	cache.SetGCPeriod(time.Second * 2)
-	time.Sleep(time.Second * 3)
-	// 休眠时间，触发了gc，gctime变化
-	assert.Greater(cache.gcTime, t1)
+	clock.Advance(time.Second * 3)
+	// 时钟前进，定时器触发了gc，gctime变化
+	assert.True(waitGC(cache, t1))
+	assert.Greater(atomic.LoadInt64(&cache.gcTime), t1)
 	// 所有元素都失效，被删除
 	assert.Equal(int64(0), cache.Keys())
 	assert.Equal(0, cache.elemSize)
 	assert.Equal(0, cache.elemCount)
 	assert.Equal(0, len(cache.m))
-	assert.Nil(cache.head)
-	assert.Nil(cache.tail)
+	assert.Equal(0, cache.policy.Len())
 }
 
 // 测试gc，触发gc时，一半元素都已失效
 func TestGC2(t *testing.T) {
 	assert := assert.New(t)
-	cache := NewLRUCache()
-	t1 := cache.gcTime
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock), WithCost(fixedCost))
+	t1 := atomic.LoadInt64(&cache.gcTime)
 	cache.SetMaxMemory("32KB")
 	count := 1 << 10
-	// key算16byte
-	// 目前val算16byte
+	// 每个元素固定算32byte
 	for i := 0; i < count/2; i++ {
 		key := strconv.Itoa(i + 1)
 		cache.Set(key, i+1, time.Second)
@@ -529,19 +692,227 @@ func TestGC2(t *testing.T) {
 	assert.Equal(32*1<<10, cache.elemSize)
 	// 此时内存使用率为1，且gcState=0，但是时间<自动gc时间。未达到gc条件
 	// gctime不变
-	assert.Equal(t1, cache.gcTime)
+	assert.Equal(t1, atomic.LoadInt64(&cache.gcTime))
 	cache.SetGCPeriod(time.Second * 2)
-	time.Sleep(time.Second * 3)
-	// 休眠时间，触发了gc，gctime变化
-	assert.Greater(cache.gcTime, t1)
+	clock.Advance(time.Second * 3)
+	// 时钟前进，定时器触发了gc，gctime变化
+	assert.True(waitGC(cache, t1))
+	assert.Greater(atomic.LoadInt64(&cache.gcTime), t1)
 	// 一半元素都失效，被删除
 	assert.Equal(int64(count/2), cache.Keys())
 	assert.Equal(count/2*32, cache.elemSize)
 	assert.Equal(count/2, cache.elemCount)
 	assert.Equal(count/2, len(cache.m))
-	assert.NotNil(cache.head)
-	assert.NotNil(cache.tail)
+	assert.Equal(count/2, cache.policy.Len())
+}
+
+// 测试使用配置项创建cache
+func TestNewOptions(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t,
+		WithMaxMemory("1MB"),
+		WithGCPeriod(time.Second*10),
+		WithClock(clock),
+		WithEvictionPolicy(PolicyLRU),
+	)
+	assert.Equal(UnitMB, cache.maxMemory)
+	assert.Equal(int64(time.Second*10), cache.gcPeriod)
+	assert.IsType(&lruPolicy[string, int]{}, cache.policy)
+
+	cache.Set("a", 1, time.Second)
+	assert.True(cache.Exists("a"))
+	clock.Advance(time.Second * 2)
+	assert.False(cache.Exists("a"))
+
+	table := []struct {
+		opt Option
+		err error
+	}{
+		{WithMaxMemory("5GB"), ErrMemory},
+		{WithMaxMemory("abc"), ErrMemory},
+		{WithGCPeriod(time.Millisecond), ErrOption},
+		{WithClock(nil), ErrOption},
+		{WithEvictionPolicy(Policy(-1)), ErrOption},
+	}
+	for _, v := range table {
+		c, err := New[string, int](v.opt)
+		assert.Nil(c)
+		assert.True(errors.Is(err, v.err), err)
+	}
+}
+
+// 测试返回error的Set与SetMaxMemory
+func TestTrySet(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewLRUCache()
+	err := cache.TrySetMaxMemory("1.1GB")
+	assert.True(errors.Is(err, ErrMemory))
+	assert.False(errors.Is(err, ErrExpire))
+	var memErr *MemoryErr
+	assert.True(errors.As(err, &memErr))
+	assert.Nil(cache.TrySetMaxMemory("1MB"))
+	assert.Equal(UnitMB, cache.maxMemory)
+
+	err = cache.TrySet("a", 1, -time.Second)
+	assert.True(errors.Is(err, ErrExpire))
+	assert.False(cache.Exists("a"))
+	assert.Nil(cache.TrySet("a", 1, 0))
+	assert.True(cache.Exists("a"))
+
+	cache.Close()
+	assert.Equal(ErrClosed, cache.TrySet("a", 1, 0))
+	assert.Equal(ErrClosed, cache.TrySetMaxMemory("1MB"))
+}
+
+// 有效期精确到纳秒，不再按秒取整
+func TestExpireSubSecond(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Unix(1600000000, int64(time.Millisecond*900)))
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
+	cache.Set("a", 1, time.Millisecond*500)
+	cache.Set("b", 2, time.Nanosecond)
+	clock.Advance(time.Millisecond * 499)
+	assert.True(cache.Exists("a"))
+	assert.False(cache.Exists("b"))
+	clock.Advance(time.Millisecond)
+	assert.False(cache.Exists("a"))
+	_, ok := cache.Get("a")
+	assert.False(ok)
 }
+
+// 永不过期的元素不受时间影响
+func TestNoExpire(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
+	cache.Set("a", 1, 0)
+	assert.True(cache.m["a"].persistent())
+	clock.Advance(time.Hour * 24 * 365 * 100)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.True(cache.Exists("a"))
+}
+
+func TestSetWithDeadline(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
+	deadline := clock.Now().Add(time.Millisecond * 1500)
+	cache.SetWithDeadline("a", 1, deadline)
+	cache.SetWithDeadline("b", 2, time.Time{})
+	assert.Equal(deadline.UnixNano(), cache.m["a"].getExpire())
+	clock.Advance(time.Millisecond * 1499)
+	assert.True(cache.Exists("a"))
+	clock.Advance(time.Millisecond)
+	assert.False(cache.Exists("a"))
+	assert.True(cache.Exists("b"))
+
+	// deadline已经过去，删除已有的key
+	cache.SetWithDeadline("b", 3, clock.Now())
+	assert.False(cache.Exists("b"))
+	assert.Equal(int64(1), cache.Keys())
+	assert.Nil(cache.TrySetWithDeadline("c", 3, clock.Now().Add(-time.Second)))
+	assert.False(cache.Exists("c"))
+
+	cache.SetMaxMemory("1KB")
+	assert.Equal(ErrTooLarge, cache.TrySetWithDeadline("d", string(make([]byte, UnitKB)), time.Time{}))
+	cache.Close()
+	assert.Equal(ErrClosed, cache.TrySetWithDeadline("a", 1, time.Time{}))
+}
+
+// 过期时间超出UnixNano的范围时按最大值处理，不能变成已经过期
+func TestExpireOverflow(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, interface{}](t, WithClock(clock))
+	const forever = time.Duration(math.MaxInt64)
+	assert.Nil(cache.TrySet("a", 1, forever))
+	assert.Nil(cache.TrySetSliding("b", 2, forever))
+	_, err := cache.CompareAndSet("c", 3, forever, 0)
+	assert.Nil(err)
+	cache.Set("d", 4, time.Second)
+	assert.True(cache.Expire("d", forever))
+	cache.Set("e", 5, forever)
+	assert.True(cache.Touch("e"))
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_, ok := cache.Get(key)
+		assert.True(ok, key)
+		d, ok := cache.TTL(key)
+		assert.True(ok, key)
+		assert.Greater(d, time.Hour*24*365*100, key)
+		assert.Equal(maxDeadline.UnixNano(), cache.m[key].getExpire(), key)
+	}
+}
+
+// 统计当前仍在运行的gc goroutine数量
+func gcGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "v4.(*lruCache[...]).run") {
+			count++
+		}
+	}
+	return count
+}
+
+// 等待goroutine退出，超时后返回最终的数量
+func waitGoroutines(want int) int {
+	n := gcGoroutines()
+	for i := 0; i < 100 && n != want; i++ {
+		time.Sleep(time.Millisecond * 10)
+		n = gcGoroutines()
+	}
+	return n
+}
+
+// 测试Close，且Close后没有goroutine泄漏
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	before := gcGoroutines()
+	caches := make([]*lruCache[string, interface{}], 10)
+	for i := range caches {
+		caches[i] = NewLRUCache()
+		caches[i].Set("a", 1, 0)
+	}
+	assert.Equal(before+len(caches), waitGoroutines(before+len(caches)))
+	for _, cache := range caches {
+		assert.Nil(cache.Close())
+	}
+	assert.Equal(before, waitGoroutines(before))
+
+	cache := caches[0]
+	assert.Equal(ErrClosed, cache.Close())
+	cache.Set("b", 2, 0)
+	_, ok := cache.Get("a")
+	assert.False(ok)
+	assert.False(cache.Exists("b"))
+	assert.False(cache.Del("a"))
+	assert.False(cache.Flush())
+	assert.Equal(int64(0), cache.Keys())
+	assert.Equal(0, len(cache.m))
+}
+
+// 测试ctx结束后，cache自动关闭
+func TestCloseContext(t *testing.T) {
+	assert := assert.New(t)
+	before := gcGoroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := NewLRUCacheContext(ctx)
+	cache.Set("a", 1, 0)
+	cancel()
+	<-cache.done
+	assert.Equal(before, waitGoroutines(before))
+	assert.True(cache.isClosed())
+	assert.Equal(int64(0), cache.Keys())
+	// 第一次Close返回关闭时的错误
+	assert.Nil(cache.Close())
+	assert.Equal(ErrClosed, cache.Close())
+}
+
 func BenchmarkSetKB(b *testing.B) {
 	cache := NewLRUCache()
 	cache.SetMaxMemory("1KB")
@@ -628,3 +999,162 @@ func BenchmarkKeys(b *testing.B) {
 	}
 	cache.Flush()
 }
+
+// 测试泛型cache，Get直接返回V
+func TestGeneric(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	assert := assert.New(t)
+	cache := NewCache[int, user]()
+	cache.Set(1, user{"wc", 88}, 0)
+	cache.Set(2, user{"cw", 18}, time.Second*100)
+	val, ok := cache.Get(1)
+	assert.True(ok)
+	assert.Equal("wc", val.Name)
+	val, ok = cache.Get(2)
+	assert.True(ok)
+	assert.Equal(18, val.Age)
+	val, ok = cache.Get(3)
+	assert.False(ok)
+	assert.Equal(user{}, val)
+	assert.True(cache.Del(1))
+	assert.False(cache.Exists(1))
+	assert.Equal(int64(1), cache.Keys())
+
+	var c Cache[string, interface{}] = NewLRUCache()
+	c.Set("a", 1, 0)
+	v, ok := c.Get("a")
+	assert.True(ok)
+	assert.Equal(1, v)
+}
+
+// 每次写入分配新的版本号，版本号匹配时才写入、删除
+func TestCompareAndSet(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock))
+	_, _, ok := cache.GetVersion("a")
+	assert.False(ok)
+	// version为0时只在key不存在时写入
+	v1, err := cache.CompareAndSet("a", 1, 0, 0)
+	assert.Nil(err)
+	assert.NotZero(v1)
+	_, err = cache.CompareAndSet("a", 2, 0, 0)
+	assert.Equal(ErrVersion, err)
+	val, version, ok := cache.GetVersion("a")
+	assert.True(ok)
+	assert.Equal(1, val)
+	assert.Equal(v1, version)
+
+	// 其他写入和有效期的修改都改变版本号
+	cache.Set("a", 3, 0)
+	_, v2, _ := cache.GetVersion("a")
+	assert.Greater(v2, v1)
+	_, err = cache.CompareAndSet("a", 4, 0, v1)
+	assert.Equal(ErrVersion, err)
+	for _, touch := range []func() bool{
+		func() bool { return cache.Expire("a", time.Minute) },
+		func() bool { return cache.ExpireAt("a", clock.Now().Add(time.Hour)) },
+		func() bool { return cache.Touch("a") },
+		func() bool { return cache.Persist("a") },
+	} {
+		assert.True(touch())
+		_, err = cache.CompareAndSet("a", 4, 0, v2)
+		assert.Equal(ErrVersion, err)
+		_, v2, _ = cache.GetVersion("a")
+	}
+	v3, err := cache.CompareAndSet("a", 4, time.Second, v2)
+	assert.Nil(err)
+	assert.Greater(v3, v2)
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second, d)
+
+	// 已经过期的元素版本号为0
+	clock.Advance(time.Second * 2)
+	_, err = cache.CompareAndSet("a", 5, 0, v3)
+	assert.Equal(ErrVersion, err)
+	v4, err := cache.CompareAndSet("a", 5, 0, 0)
+	assert.Nil(err)
+	_, err = cache.CompareAndSet("a", 5, -1, v4)
+	assert.True(errors.Is(err, ErrExpire))
+
+	ok, err = cache.CompareAndDelete("a", v3)
+	assert.False(ok)
+	assert.Equal(ErrVersion, err)
+	ok, err = cache.CompareAndDelete("a", v4)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.False(cache.Exists("a"))
+	ok, err = cache.CompareAndDelete("a", v4)
+	assert.False(ok)
+	assert.Nil(err)
+
+	// 重建的cache不会复用之前的版本号
+	clock.Advance(time.Second)
+	c2 := NewCache[string, int]()
+	defer c2.Close()
+	c2.Set("a", 1, 0)
+	_, v5, _ := c2.GetVersion("a")
+	assert.Greater(v5, v4)
+
+	cache.Close()
+	_, err = cache.CompareAndSet("a", 1, 0, 0)
+	assert.Equal(ErrClosed, err)
+	_, err = cache.CompareAndDelete("a", 0)
+	assert.Equal(ErrClosed, err)
+}
+
+// 命中率基准测试，每个元素算1byte，最多存放1024个元素
+// 通过b.ReportMetric输出命中率，对比LRU与W-TinyLFU
+func benchmarkHitRatio(b *testing.B, p Policy, next func() string) {
+	c := newTestCache[string, int](b, WithMaxMemory("1KB"), WithEvictionPolicy(p),
+		WithCost(func(string, int) int { return 1 }))
+	hits := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := next()
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, i, 0)
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+}
+
+// zipf分布的key，少量热点元素占大部分访问
+func zipfTrace() func() string {
+	z := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, 1<<16)
+	return func() string {
+		return strconv.FormatUint(z.Uint64(), 10)
+	}
+}
+
+// zipf分布中，每访问10000次，插入一次5000个新key的扫描
+func scanTrace() func() string {
+	zipf := zipfTrace()
+	i, scan := 0, 0
+	return func() string {
+		i++
+		if i%10000 < 5000 && i > 10000 {
+			scan++
+			return "scan" + strconv.Itoa(scan)
+		}
+		return zipf()
+	}
+}
+
+func BenchmarkHitRatioZipfLRU(b *testing.B) {
+	benchmarkHitRatio(b, PolicyLRU, zipfTrace())
+}
+func BenchmarkHitRatioZipfTinyLFU(b *testing.B) {
+	benchmarkHitRatio(b, PolicyTinyLFU, zipfTrace())
+}
+func BenchmarkHitRatioScanLRU(b *testing.B) {
+	benchmarkHitRatio(b, PolicyLRU, scanTrace())
+}
+func BenchmarkHitRatioScanTinyLFU(b *testing.B) {
+	benchmarkHitRatio(b, PolicyTinyLFU, scanTrace())
+}
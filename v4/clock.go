@@ -0,0 +1,119 @@
+package v4
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 时间来源，默认使用系统时间
+// 元素的有效期、gc的触发条件都通过Clock判断
+type Clock interface {
+	Now() time.Time
+}
+
+// Ticker 定时器，同time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// TickerClock 可以创建定时器的Clock，后台goroutine使用它的定时器触发gc
+// 没有实现TickerClock的Clock，后台goroutine使用系统时间的定时器
+type TickerClock interface {
+	Clock
+	NewTicker(d time.Duration) Ticker
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+func newTicker(clock Clock, d time.Duration) Ticker {
+	if c, ok := clock.(TickerClock); ok {
+		return c.NewTicker(d)
+	}
+	return realClock{}.NewTicker(d)
+}
+
+// FakeClock 手动推进的时钟，用于测试
+// 时间只在调用Advance时前进，到期的定时器同时触发
+type FakeClock struct {
+	l       sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+// Advance 时间前进d，触发到期的定时器
+// 同time.Ticker，接收方来不及处理时丢弃多余的触发，跨过多个周期也只触发一次
+func (c *FakeClock) Advance(d time.Duration) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		t.next = t.next.Add((c.now.Sub(t.next)/t.period + 1) * t.period)
+	}
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.l.Lock()
+	defer c.l.Unlock()
+	t := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	c := t.clock
+	c.l.Lock()
+	defer c.l.Unlock()
+	for i, v := range c.tickers {
+		if v == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
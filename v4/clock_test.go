@@ -0,0 +1,60 @@
+package v4
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ TickerClock = realClock{}
+var _ TickerClock = (*FakeClock)(nil)
+
+func TestFakeClock(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	clock := NewFakeClock(start)
+	assert.Equal(start, clock.Now())
+	clock.Advance(time.Minute)
+	assert.Equal(start.Add(time.Minute), clock.Now())
+}
+
+func TestFakeTicker(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	clock := NewFakeClock(start)
+	ticker := clock.NewTicker(time.Second)
+	// 没有到期，不触发
+	clock.Advance(time.Millisecond * 999)
+	assert.Equal(0, len(ticker.C()))
+	clock.Advance(time.Millisecond)
+	assert.Equal(start.Add(time.Second), <-ticker.C())
+
+	// 跨过多个周期只触发一次，下一次触发时间按周期对齐
+	clock.Advance(time.Second*10 + time.Millisecond*500)
+	assert.Equal(start.Add(time.Second*11+time.Millisecond*500), <-ticker.C())
+	assert.Equal(0, len(ticker.C()))
+	clock.Advance(time.Millisecond * 500)
+	assert.Equal(1, len(ticker.C()))
+	// 接收方没有处理，丢弃多余的触发
+	clock.Advance(time.Second)
+	assert.Equal(1, len(ticker.C()))
+	<-ticker.C()
+
+	ticker.Stop()
+	clock.Advance(time.Second * 10)
+	assert.Equal(0, len(ticker.C()))
+	assert.Equal(0, len(clock.tickers))
+}
+
+// 自定义的Clock没有实现TickerClock时，使用系统时间的定时器
+func TestNewTicker(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	ticker := newTicker(clock, time.Second)
+	assert.IsType(&fakeTicker{}, ticker)
+	ticker.Stop()
+	ticker = newTicker(&stepClock{now: time.Now()}, time.Second)
+	assert.IsType(realTicker{}, ticker)
+	ticker.Stop()
+}
@@ -0,0 +1,98 @@
+// cache-server 以Redis协议对外提供cache，可以使用redis-cli等Redis客户端访问
+// -protocol memcache时使用memcached的文本协议和meta命令，默认监听:11211
+//
+//	cache-server -addr :6379 -maxmemory 1GB -shards 16 -aof cache.aof -fsync everysec
+//	cache-server -protocol memcache -maxmemory 1GB
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	v4 "cache/v4"
+	"cache/v4/server"
+)
+
+// Server和MemcacheServer
+type listener interface {
+	ListenAndServe(addr string) error
+	Close() error
+}
+
+func main() {
+	protocol := flag.String("protocol", "resp", "协议: resp、memcache")
+	addr := flag.String("addr", "", "监听地址，默认resp为:6379，memcache为:11211")
+	maxMemory := flag.String("maxmemory", "100MB", "最大内存，如100MB、1GB")
+	shards := flag.Int("shards", 1, "分片数，大于1时使用ShardedCache")
+	aof := flag.String("aof", "", "aof文件路径，为空时不持久化")
+	fsync := flag.String("fsync", "everysec", "aof的fsync策略: always、everysec、no")
+	flag.Parse()
+
+	var srv listener
+	var cache io.Closer
+	switch *protocol {
+	case "resp":
+		c, err := newCache[[]byte](*maxMemory, *shards, *aof, *fsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv, cache = server.New(c), c
+		if *addr == "" {
+			*addr = ":6379"
+		}
+	case "memcache":
+		c, err := newCache[server.Item](*maxMemory, *shards, *aof, *fsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv, cache = server.NewMemcache(c), c
+		if *addr == "" {
+			*addr = ":11211"
+		}
+	default:
+		log.Fatalf("错误的协议%s", *protocol)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("listening on %s", *addr)
+	if err := srv.ListenAndServe(*addr); !errors.Is(err, server.ErrServerClosed) {
+		log.Print(err)
+	}
+	if err := cache.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newCache[V any](maxMemory string, shards int, aof, fsync string) (server.Backend[V], error) {
+	opts := []v4.Option{v4.WithMaxMemory(maxMemory)}
+	if aof != "" {
+		policy, ok := map[string]v4.FsyncPolicy{
+			"always":   v4.FsyncAlways,
+			"everysec": v4.FsyncEverySec,
+			"no":       v4.FsyncNo,
+		}[fsync]
+		if !ok {
+			return nil, fmt.Errorf("错误的fsync策略%s", fsync)
+		}
+		opts = append(opts, v4.WithAOF(aof, policy))
+	}
+	if shards > 1 {
+		return v4.NewShardedCache[string, V](shards, opts...)
+	}
+	c, err := v4.New[string, V](opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.(server.Backend[V]), nil
+}
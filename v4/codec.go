@@ -0,0 +1,267 @@
+package v4
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Codec 把key、value编码为[]byte，快照、aof等需要序列化的功能通过WithCodec配置，默认为GobCodec
+// Encode、Decode的参数都是指向值的指针，codec由此知道值的静态类型
+// 静态类型为interface时，codec需要记录具体类型，解码时通过RegisterType注册的名字还原
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	// GobCodec 使用encoding/gob，具体类型的值不需要注册，interface中的值需要RegisterType
+	GobCodec Codec = gobCodec{}
+	// JSONCodec 使用encoding/json，只编码导出的字段，interface中的值需要RegisterType
+	JSONCodec Codec = jsonCodec{}
+	// BytesCodec 不编码，只支持[]byte和string，interface中的string解码后为[]byte
+	BytesCodec Codec = bytesCodec{}
+	// ErrCodec 类型不支持或者没有注册，可以用errors.Is判断
+	ErrCodec = errors.New("编解码错误")
+)
+
+// interface中的值的具体类型，名字与类型一一对应
+var typeRegistry = struct {
+	l      sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+func init() {
+	// 与encoding/gob默认注册的类型相同，名字为类型的字符串
+	for _, v := range []interface{}{
+		false, 0, int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), uintptr(0),
+		float32(0), float64(0), complex64(0), complex128(0), "",
+		[]bool(nil), []int(nil), []int8(nil), []int16(nil), []int32(nil), []int64(nil),
+		[]uint(nil), []uint8(nil), []uint16(nil), []uint32(nil), []uint64(nil), []uintptr(nil),
+		[]float32(nil), []float64(nil), []complex64(nil), []complex128(nil), []string(nil),
+	} {
+		t := reflect.TypeOf(v)
+		typeRegistry.byName[t.String()] = t
+		typeRegistry.byType[t] = t.String()
+	}
+}
+
+// RegisterType 注册interface中可能出现的具体类型，codec用name记录类型，解码时还原为value的类型
+// 同时注册到encoding/gob，基本类型和基本类型的slice已经注册
+// name或者类型已经注册为其他类型、名字时返回ErrCodec，重复注册相同的名字和类型不做任何操作
+func RegisterType(name string, value interface{}) (err error) {
+	t := reflect.TypeOf(value)
+	if name == "" || t == nil {
+		return fmt.Errorf("%w: 名字和类型不能为空", ErrCodec)
+	}
+	r := &typeRegistry
+	r.l.Lock()
+	defer r.l.Unlock()
+	if old, ok := r.byName[name]; ok {
+		if old != t {
+			return fmt.Errorf("%w: %s已经注册为%v", ErrCodec, name, old)
+		}
+		return nil
+	}
+	if old, ok := r.byType[t]; ok {
+		return fmt.Errorf("%w: %v已经注册为%s", ErrCodec, t, old)
+	}
+	// gob中已经用其他名字注册时panic
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%w: %v", ErrCodec, p)
+		}
+	}()
+	gob.RegisterName(name, value)
+	r.byName[name] = t
+	r.byType[t] = name
+	return nil
+}
+
+func typeName(t reflect.Type) (string, bool) {
+	typeRegistry.l.RLock()
+	defer typeRegistry.l.RUnlock()
+	name, ok := typeRegistry.byType[t]
+	return name, ok
+}
+
+func typeByName(name string) (reflect.Type, bool) {
+	typeRegistry.l.RLock()
+	defer typeRegistry.l.RUnlock()
+	t, ok := typeRegistry.byName[name]
+	return t, ok
+}
+
+// v指向的值，v不是非nil的指针时返回ErrCodec
+func pointee(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return reflect.Value{}, fmt.Errorf("%w: 参数%T必须是非nil的指针", ErrCodec, v)
+	}
+	return rv.Elem(), nil
+}
+
+// 把解码得到的具体值赋给interface，val无效时赋零值
+func assign(dst, val reflect.Value) error {
+	if !val.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if !val.Type().AssignableTo(dst.Type()) {
+		return fmt.Errorf("%w: %v不能赋值给%v", ErrCodec, val.Type(), dst.Type())
+	}
+	dst.Set(val)
+	return nil
+}
+
+type gobCodec struct{}
+
+// gob编码interface时需要位于struct的字段中
+type gobIface struct {
+	V interface{}
+}
+
+func (gobCodec) Encode(v interface{}) ([]byte, error) {
+	ev, err := pointee(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if ev.Kind() == reflect.Interface {
+		err = enc.Encode(&gobIface{ev.Interface()})
+	} else {
+		err = enc.Encode(v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCodec, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, v interface{}) error {
+	ev, err := pointee(v)
+	if err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if ev.Kind() != reflect.Interface {
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("%w: %v", ErrCodec, err)
+		}
+		return nil
+	}
+	var box gobIface
+	if err := dec.Decode(&box); err != nil {
+		return fmt.Errorf("%w: %v", ErrCodec, err)
+	}
+	return assign(ev, reflect.ValueOf(box.V))
+}
+
+type jsonCodec struct{}
+
+// interface中的值编码为{"type":注册的名字,"value":值}，nil的type为空
+type jsonIface struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	ev, err := pointee(v)
+	if err != nil {
+		return nil, err
+	}
+	if ev.Kind() != reflect.Interface {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCodec, err)
+		}
+		return b, nil
+	}
+	box := jsonIface{Value: json.RawMessage("null")}
+	if !ev.IsNil() {
+		val := ev.Elem()
+		name, ok := typeName(val.Type())
+		if !ok {
+			return nil, fmt.Errorf("%w: 类型%v没有注册", ErrCodec, val.Type())
+		}
+		box.Type = name
+		if box.Value, err = json.Marshal(val.Interface()); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCodec, err)
+		}
+	}
+	return json.Marshal(box)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	ev, err := pointee(v)
+	if err != nil {
+		return err
+	}
+	if ev.Kind() != reflect.Interface {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("%w: %v", ErrCodec, err)
+		}
+		return nil
+	}
+	var box jsonIface
+	if err := json.Unmarshal(data, &box); err != nil {
+		return fmt.Errorf("%w: %v", ErrCodec, err)
+	}
+	if box.Type == "" {
+		return assign(ev, reflect.Value{})
+	}
+	t, ok := typeByName(box.Type)
+	if !ok {
+		return fmt.Errorf("%w: 类型%s没有注册", ErrCodec, box.Type)
+	}
+	val := reflect.New(t)
+	if err := json.Unmarshal(box.Value, val.Interface()); err != nil {
+		return fmt.Errorf("%w: %v", ErrCodec, err)
+	}
+	return assign(ev, val.Elem())
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Encode(v interface{}) ([]byte, error) {
+	switch p := v.(type) {
+	case *[]byte:
+		return append([]byte(nil), *p...), nil
+	case *string:
+		return []byte(*p), nil
+	case *interface{}:
+		switch val := (*p).(type) {
+		case []byte:
+			return append([]byte(nil), val...), nil
+		case string:
+			return []byte(val), nil
+		}
+		return nil, fmt.Errorf("%w: BytesCodec不支持%T", ErrCodec, *p)
+	}
+	return nil, fmt.Errorf("%w: BytesCodec不支持%T", ErrCodec, v)
+}
+
+// 复制data，调用方可以复用data
+func (bytesCodec) Decode(data []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *[]byte:
+		*p = append([]byte(nil), data...)
+	case *string:
+		*p = string(data)
+	case *interface{}:
+		*p = append([]byte(nil), data...)
+	default:
+		return fmt.Errorf("%w: BytesCodec不支持%T", ErrCodec, v)
+	}
+	return nil
+}
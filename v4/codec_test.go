@@ -0,0 +1,160 @@
+package v4
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecUser struct {
+	Name string
+	Age  int
+}
+
+type codecPoint struct {
+	X, Y int
+}
+
+func init() {
+	for name, v := range map[string]interface{}{
+		"codecUser":         codecUser{},
+		"*codecPoint":       &codecPoint{},
+		"map[string]int":    map[string]int(nil),
+		"map[string]string": map[string]string(nil),
+		"[3]int64":          [3]int64{},
+	} {
+		if err := RegisterType(name, v); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// 编码v再解码为T，返回解码后的值
+func roundTrip[T any](t *testing.T, codec Codec, v T) T {
+	data, err := codec.Encode(&v)
+	if err != nil {
+		t.Fatalf("%T %v: %v", codec, v, err)
+	}
+	var out T
+	if err := codec.Decode(data, &out); err != nil {
+		t.Fatalf("%T %v: %v", codec, v, err)
+	}
+	return out
+}
+
+// 已有测试中用到的各种类型，V为具体类型和interface{}时都能还原
+func TestCodecRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	values := []interface{}{
+		1, -8, int32(7), int64(-1 << 40), uint8(255),
+		3.14, -3.14, 1.5,
+		true, false,
+		'a', '\r',
+		"16", "啊啊啊", "",
+		[]byte("abc"),
+		[]int{1, 2, 3},
+		[]string{"1", "2", "3"},
+		[3]int64{1, 2, 3},
+		map[string]int{"ab": 1, "bed": 2},
+		map[string]string{"ab": "aaaa", "bed": "asdff"},
+		codecUser{"wc", 88},
+		&codecPoint{1, 2},
+		nil,
+	}
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		for _, v := range values {
+			assert.Equal(v, roundTrip(t, codec, v), "%T %#v", codec, v)
+		}
+		assert.Equal(1, roundTrip(t, codec, 1))
+		assert.Equal(3.14, roundTrip(t, codec, 3.14))
+		assert.Equal('a', roundTrip(t, codec, 'a'))
+		assert.Equal("啊啊啊", roundTrip(t, codec, "啊啊啊"))
+		assert.Equal([]byte("abc"), roundTrip(t, codec, []byte("abc")))
+		assert.Equal([]int{1, 2, 3}, roundTrip(t, codec, []int{1, 2, 3}))
+		assert.Equal(map[string]int{"ab": 1}, roundTrip(t, codec, map[string]int{"ab": 1}))
+		assert.Equal(codecUser{"wc", 88}, roundTrip(t, codec, codecUser{"wc", 88}))
+		assert.Equal(&codecUser{"wc", 88}, roundTrip(t, codec, &codecUser{"wc", 88}))
+	}
+
+	assert.Equal([]byte("abc"), roundTrip(t, BytesCodec, []byte("abc")))
+	assert.Equal("啊啊啊", roundTrip(t, BytesCodec, "啊啊啊"))
+	// interface中的string解码后为[]byte
+	assert.Equal([]byte("abc"), roundTrip[interface{}](t, BytesCodec, "abc"))
+	assert.Equal([]byte("abc"), roundTrip[interface{}](t, BytesCodec, []byte("abc")))
+}
+
+func TestCodecError(t *testing.T) {
+	assert := assert.New(t)
+	type unregistered struct{ A int }
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		var v interface{} = unregistered{1}
+		_, err := codec.Encode(&v)
+		assert.True(errors.Is(err, ErrCodec), "%T", codec)
+		// 参数必须是指针
+		_, err = codec.Encode(1)
+		assert.True(errors.Is(err, ErrCodec))
+		assert.True(errors.Is(codec.Decode([]byte("x"), new(int)), ErrCodec))
+	}
+	_, err := BytesCodec.Encode(new(int))
+	assert.True(errors.Is(err, ErrCodec))
+	var v interface{} = 1
+	_, err = BytesCodec.Encode(&v)
+	assert.True(errors.Is(err, ErrCodec))
+	assert.True(errors.Is(BytesCodec.Decode(nil, new(int)), ErrCodec))
+
+	// 解码时没有注册的类型
+	_, err = JSONCodec.Encode(&v)
+	assert.Nil(err)
+	err = JSONCodec.Decode([]byte(`{"type":"none","value":1}`), &v)
+	assert.True(errors.Is(err, ErrCodec))
+}
+
+func TestRegisterType(t *testing.T) {
+	assert := assert.New(t)
+	// 重复注册相同的名字和类型
+	assert.Nil(RegisterType("codecUser", codecUser{}))
+	assert.True(errors.Is(RegisterType("codecUser", codecPoint{}), ErrCodec))
+	assert.True(errors.Is(RegisterType("user2", codecUser{}), ErrCodec))
+	assert.True(errors.Is(RegisterType("int", int64(0)), ErrCodec))
+	assert.True(errors.Is(RegisterType("", 1), ErrCodec))
+	assert.True(errors.Is(RegisterType("nil", nil), ErrCodec))
+}
+
+func TestWithCodec(t *testing.T) {
+	assert := assert.New(t)
+	_, err := New[string, int](WithCodec(nil))
+	assert.True(errors.Is(err, ErrOption))
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		src := newTestCache[string, interface{}](t, WithCodec(codec))
+		src.Set("a", codecUser{"wc", 88}, 0)
+		src.Set("b", []string{"1", "2"}, time.Minute)
+		var buf bytes.Buffer
+		assert.Nil(src.SaveSnapshot(&buf))
+		src.Close()
+		dst := newTestCache[string, interface{}](t, WithCodec(codec))
+		assert.Nil(dst.LoadSnapshot(&buf))
+		val, _ := dst.Get("a")
+		assert.Equal(codecUser{"wc", 88}, val)
+		val, _ = dst.Get("b")
+		assert.Equal([]string{"1", "2"}, val)
+		dst.Close()
+	}
+
+	// 快照中的值不是BytesCodec支持的类型
+	src := newTestCache[string, int](t, WithCodec(BytesCodec))
+	src.Set("a", 1, 0)
+	assert.True(errors.Is(src.SaveSnapshot(&bytes.Buffer{}), ErrCodec))
+
+	path := filepath.Join(t.TempDir(), "cache.aof")
+	aof := newTestCache[string, []byte](t, WithCodec(BytesCodec), WithAOF(path, FsyncNo))
+	aof.Set("a", []byte("abc"), 0)
+	assert.Nil(aof.Close())
+	aof = newTestCache[string, []byte](t, WithCodec(BytesCodec), WithAOF(path, FsyncNo))
+	val, _ := aof.Get("a")
+	assert.Equal([]byte("abc"), val)
+}
@@ -0,0 +1,102 @@
+package v4
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultExpireSampleSize = 20                    // 主动过期每轮默认采样的元素个数
+	DefaultExpireEffort     = 1                     // 主动过期默认的力度
+	MaxExpireEffort         = 10                    // 主动过期最大的力度
+	DefaultExpireBudget     = time.Millisecond * 25 // 主动过期一次gc默认的时间预算
+)
+
+// 管理带有效期的元素，gc时找出过期的元素
+type expirer[K comparable, V any] interface {
+	// 元素写入或者修改了有效期
+	add(e *elem[K, V])
+	// 元素被删除
+	del(e *elem[K, V])
+	// 对过期的元素调用expire，expire负责把元素从cache中删除
+	advance(now time.Time, expire func(e *elem[K, V]))
+	reset()
+}
+
+func newExpirer[K comparable, V any](o *options) expirer[K, V] {
+	if o.activeExpire {
+		return newSampleExpirer[K, V](o.clock, o.expireSampleSize, o.expireEffort, o.expireBudget)
+	}
+	return newTimingWheel[K, V](o.clock.Now())
+}
+
+// 参考Redis的主动过期，随机采样带有效期的元素
+//
+//	每轮随机抽取若干个元素，删除其中过期的
+//	过期的比例超过阈值，说明还有很多过期元素，继续下一轮，否则结束
+//	每次gc的耗时不超过budget，cache再大，一次gc的耗时也是有上限的
+//	effort越大，每轮采样越多，可以接受的过期比例越低，时间预算不变
+type sampleExpirer[K comparable, V any] struct {
+	elems     []*elem[K, V] // 带有效期的元素，e.tindex为下标+1
+	clock     Clock
+	rnd       *rand.Rand
+	samples   int           // 每轮采样的个数
+	threshold int           // 过期比例超过threshold%时继续下一轮
+	budget    time.Duration // 一次gc的时间预算
+}
+
+func newSampleExpirer[K comparable, V any](clock Clock, sampleSize, effort int, budget time.Duration) *sampleExpirer[K, V] {
+	return &sampleExpirer[K, V]{
+		clock:     clock,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		samples:   sampleSize + sampleSize/4*(effort-1),
+		threshold: MaxExpireEffort + 1 - effort,
+		budget:    budget,
+	}
+}
+
+func (s *sampleExpirer[K, V]) add(e *elem[K, V]) {
+	if e.persistent() {
+		s.del(e)
+		return
+	}
+	if e.tindex == 0 {
+		s.elems = append(s.elems, e)
+		e.tindex = len(s.elems)
+	}
+}
+
+func (s *sampleExpirer[K, V]) del(e *elem[K, V]) {
+	if e.tindex == 0 {
+		return
+	}
+	last := len(s.elems) - 1
+	s.elems[e.tindex-1] = s.elems[last]
+	s.elems[e.tindex-1].tindex = e.tindex
+	s.elems[last] = nil
+	s.elems = s.elems[:last]
+	e.tindex = 0
+}
+
+func (s *sampleExpirer[K, V]) advance(now time.Time, expire func(e *elem[K, V])) {
+	start := s.clock.Now()
+	for len(s.elems) > 0 {
+		n := minInt(s.samples, len(s.elems))
+		expired := 0
+		for i := 0; i < n && len(s.elems) > 0; i++ {
+			e := s.elems[s.rnd.Intn(len(s.elems))]
+			if !e.alive(now) {
+				s.del(e)
+				expire(e)
+				expired++
+			}
+		}
+		if expired*100 <= n*s.threshold || s.clock.Now().Sub(start) >= s.budget {
+			return
+		}
+	}
+}
+
+func (s *sampleExpirer[K, V]) reset() {
+	s.elems = nil
+}
@@ -0,0 +1,143 @@
+package v4
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 每次调用Now都前进step的时钟，用于模拟gc的耗时
+type stepClock struct {
+	l    sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+// 时钟前进d，之后每次调用Now前进step
+// 两者同时修改，后台goroutine不会在中间看到没有耗时的时钟
+func (c *stepClock) addStep(d, step time.Duration) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.now = c.now.Add(d)
+	c.step = step
+}
+
+// 固定随机数种子，结果可以复现
+func seedSampler[K comparable, V any](cache *lruCache[K, V]) {
+	cache.l.Lock()
+	cache.expirer.(*sampleExpirer[K, V]).rnd = rand.New(rand.NewSource(1))
+	cache.l.Unlock()
+}
+
+func TestWithActiveExpire(t *testing.T) {
+	assert := assert.New(t)
+	for _, opt := range []Option{
+		WithActiveExpire(0, 1, time.Millisecond),
+		WithActiveExpire(20, 0, time.Millisecond),
+		WithActiveExpire(20, MaxExpireEffort+1, time.Millisecond),
+		WithActiveExpire(20, 1, 0),
+	} {
+		_, err := New[string, int](opt)
+		assert.True(errors.Is(err, ErrOption))
+	}
+
+	cache := newTestCache[string, int](t, WithClock(NewFakeClock(time.Now())), WithGCPeriod(MinGCPeriod), WithActiveExpire(20, 1, time.Millisecond))
+	seedSampler(cache)
+	s := cache.expirer.(*sampleExpirer[string, int])
+	assert.Equal(20, s.samples)
+	assert.Equal(10, s.threshold)
+	// effort越大，采样越多，可以接受的过期比例越低
+	s = newSampleExpirer[string, int](realClock{}, 20, MaxExpireEffort, time.Millisecond)
+	assert.Equal(65, s.samples)
+	assert.Equal(1, s.threshold)
+}
+
+// 采样到的元素都已过期时一直继续，直到删除所有过期元素
+func TestActiveExpire(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithActiveExpire(20, 1, time.Second))
+	seedSampler(cache)
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	for i := 0; i < 100; i++ {
+		cache.Set("forever"+strconv.Itoa(i), i, 0)
+	}
+	s := cache.expirer.(*sampleExpirer[string, int])
+	// 永不过期的元素不参与采样
+	assert.Equal(1000, len(s.elems))
+
+	clock.Advance(time.Minute * 2)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.Equal(int64(100), cache.Keys())
+	assert.Equal(0, len(s.elems))
+}
+
+// 过期比例低于阈值时停止，不会删除有效的元素
+func TestActiveExpireThreshold(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithActiveExpire(20, 1, time.Second))
+	seedSampler(cache)
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Hour)
+	}
+	for i := 0; i < 10; i++ {
+		cache.Set("short"+strconv.Itoa(i), i, time.Minute)
+	}
+	// 修改有效期后不再参与采样
+	cache.Set("0", 0, 0)
+	cache.Del("1")
+	s := cache.expirer.(*sampleExpirer[string, int])
+	assert.Equal(1008, len(s.elems))
+
+	clock.Advance(time.Minute * 2)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	// 过期元素只占1%，第一轮采样后就停止
+	assert.GreaterOrEqual(cache.Keys(), int64(999))
+	for i := 0; i < 1000; i++ {
+		if i != 1 {
+			assert.True(cache.Exists(strconv.Itoa(i)))
+		}
+	}
+}
+
+// 超过时间预算后停止，剩下的过期元素留给下一次gc
+func TestActiveExpireBudget(t *testing.T) {
+	assert := assert.New(t)
+	clock := &stepClock{now: time.Now()}
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithActiveExpire(20, 1, time.Millisecond*5))
+	seedSampler(cache)
+	for i := 0; i < 10000; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Minute)
+	}
+	// 每一轮耗时1ms，5轮后超过预算
+	clock.addStep(time.Minute*2, time.Millisecond)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.Equal(int64(10000-5*20), cache.Keys())
+
+	clock.addStep(MinGCPeriod*2, time.Millisecond)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.Equal(int64(10000-10*20), cache.Keys())
+}
@@ -0,0 +1,67 @@
+package v4
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// WithHasher配置的hash，没有配置时按key的底层类型选择，不支持的类型返回nil
+func newHasher[K comparable](o *options) func(K) uint64 {
+	if hash, ok := o.hasher.(func(K) uint64); ok {
+		return hash
+	}
+	return defaultHasher[K]()
+}
+
+// string、整数类型以及以它们为底层类型的自定义类型，在创建时按底层类型选择hash函数
+// 直接读取key的内存，不经过interface和反射，有符号整数按符号扩展，与转换为uint64的结果相同
+func defaultHasher[K comparable]() func(K) uint64 {
+	t := reflect.TypeOf((*K)(nil)).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		return func(key K) uint64 { return hashString(*(*string)(unsafe.Pointer(&key))) }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch t.Size() {
+		case 1:
+			return func(key K) uint64 { return mix64(uint64(*(*int8)(unsafe.Pointer(&key)))) }
+		case 2:
+			return func(key K) uint64 { return mix64(uint64(*(*int16)(unsafe.Pointer(&key)))) }
+		case 4:
+			return func(key K) uint64 { return mix64(uint64(*(*int32)(unsafe.Pointer(&key)))) }
+		case 8:
+			return func(key K) uint64 { return mix64(uint64(*(*int64)(unsafe.Pointer(&key)))) }
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch t.Size() {
+		case 1:
+			return func(key K) uint64 { return mix64(uint64(*(*uint8)(unsafe.Pointer(&key)))) }
+		case 2:
+			return func(key K) uint64 { return mix64(uint64(*(*uint16)(unsafe.Pointer(&key)))) }
+		case 4:
+			return func(key K) uint64 { return mix64(uint64(*(*uint32)(unsafe.Pointer(&key)))) }
+		case 8:
+			return func(key K) uint64 { return mix64(*(*uint64)(unsafe.Pointer(&key))) }
+		}
+	}
+	return nil
+}
+
+// FNV-1a，再经过mix64让低位分布均匀
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return mix64(h)
+}
+
+// splitmix64的混淆函数，让相邻的整数分布均匀
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,210 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 后台刷新开始后，refreshRetry内不再开始新的刷新，加载失败时不会在每次Get时都重试
+const refreshRetry = time.Second
+
+// ErrLoaderPanic loader发生panic时，GetOrLoad返回的错误可以用errors.Is判断
+var ErrLoaderPanic = errors.New("loader panic")
+
+// 正在执行的loader，同一个key的并发未命中共享一次调用
+type loadCall[V any] struct {
+	done    chan struct{} // loader返回后关闭
+	val     V
+	err     error
+	waiters int                // 仍在等待结果的调用方
+	cancel  context.CancelFunc // 所有调用方都放弃等待时取消loader
+	refresh bool               // 后台刷新，没有调用方等待时也不取消
+	version uint64             // 开始加载时元素的版本号，key不存在时为0，之后被修改过时不写入加载的值
+	stale   bool               // 加载期间key被删除，不写入加载的值，由cache的写锁保护
+}
+
+// 同一个cache中正在执行的loader
+type loadGroup[K comparable, V any] struct {
+	l      sync.Mutex
+	calls  map[K]*loadCall[V]
+	ctx    context.Context // cache的ctx，Close时取消，loader的ctx由它派生
+	wg     sync.WaitGroup  // 正在执行的loader goroutine
+	closed bool            // 关闭后不再启动loader
+}
+
+// 启动执行loader的goroutine，cache关闭后返回false，必须持有g.l
+func (g *loadGroup[K, V]) start(f func()) bool {
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// 不再启动新的loader，等待正在执行的loader返回
+func (g *loadGroup[K, V]) wait() {
+	g.l.Lock()
+	g.closed = true
+	g.l.Unlock()
+	g.wg.Wait()
+}
+
+// GetOrLoad 命中时直接返回，未命中时调用loader加载，并按loader返回的有效期写入cache
+// 同一个key的并发未命中只调用一次loader，所有调用方得到相同的结果和错误
+// ctx结束时返回ctx.Err()，所有调用方都放弃等待或者cache关闭时取消loader的ctx
+// loader返回error时不写入cache，下一次调用重新加载
+// 加载期间key被Set、Del等修改过时不写入加载的值，调用方仍然得到加载的值
+// loader为nil时从store加载，store中不存在时返回ErrNotFound，没有配置store时返回ErrOption
+func (c *lruCache[K, V]) GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context) (V, time.Duration, error)) (V, error) {
+	if val, ok := c.Get(key); ok {
+		return val, nil
+	}
+	var zero V
+	if c.isClosed() {
+		return zero, ErrClosed
+	}
+	if loader == nil {
+		if c.store == nil {
+			return zero, fmt.Errorf("%w: 没有配置store时loader不能为nil", ErrOption)
+		}
+		loader = c.storeLoader(key)
+	}
+	g := &c.loads
+	g.l.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*loadCall[V])
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		// loader的ctx保留ctx中的值，但不随某一个调用方取消，只随cache关闭取消
+		lctx, cancel := context.WithCancel(detach(g.ctx, ctx))
+		call = &loadCall[V]{done: make(chan struct{}), cancel: cancel}
+		if !g.start(func() { c.load(lctx, key, call, loader) }) {
+			g.l.Unlock()
+			cancel()
+			return zero, ErrClosed
+		}
+		g.calls[key] = call
+	}
+	call.waiters++
+	g.l.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		g.l.Lock()
+		call.waiters--
+		if call.waiters == 0 && !call.refresh {
+			call.cancel()
+			// 新的调用方重新加载，不再等待已经取消的loader
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+		}
+		g.l.Unlock()
+		return zero, ctx.Err()
+	}
+}
+
+// 执行loader，成功时写入cache，按正常的写入流程淘汰元素，加载的值不写回store
+// 按call.version比较后写入，加载期间的修改比从后端加载的值更新，不会被覆盖
+func (c *lruCache[K, V]) load(ctx context.Context, key K, call *loadCall[V], loader func(ctx context.Context) (V, time.Duration, error)) {
+	defer call.cancel()
+	defer close(call.done)
+	func() {
+		// 在recover之后记录，panic也计为失败
+		start := c.clock.Now()
+		defer func() {
+			c.countLoad(c.clock.Now().Sub(start), call.err)
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("%w: %v", ErrLoaderPanic, r)
+			}
+		}()
+		var ttl time.Duration
+		call.val, ttl, call.err = loader(ctx)
+		if call.err == nil {
+			// 元素太大、cache已关闭或者加载期间被修改过时不缓存，仍然返回加载的值
+			if ttl < 0 {
+				call.err = &ExpireErr{ttl}
+			} else {
+				c.setLoaded(key, call, ttl)
+			}
+		}
+	}()
+	// 写入cache之后再删除，之后的调用方一定能命中
+	g := &c.loads
+	g.l.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.l.Unlock()
+}
+
+// 写入加载的值，加载期间key被修改或者删除过时不写入
+func (c *lruCache[K, V]) setLoaded(key K, call *loadCall[V], ttl time.Duration) {
+	size := c.sizeof(key, call.val)
+	c.l.Lock()
+	defer c.unlock()
+	if !call.stale {
+		c.setLocked(key, call.val, size, expireAt(ttl, c.clock.Now()), ttl, false, false, true, call.version, nil)
+	}
+}
+
+// key被删除时，正在执行的loader加载的值可能是删除之前的，不再写入，必须持有写锁
+// 删除后版本号回到0，与开始加载时key不存在的版本号相同，只比较版本号无法发现
+func (c *lruCache[K, V]) invalidateLoad(key K) {
+	g := &c.loads
+	g.l.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.stale = true
+	}
+	g.l.Unlock()
+}
+
+// 通过WithLoader注册的loader在后台重新加载key，正在加载时不重复加载
+// 加载失败时不修改cache，宽限期内继续返回旧值，refreshRetry后才会再次加载
+// version为开始刷新时元素的版本号
+func (c *lruCache[K, V]) refresh(key K, version uint64) {
+	g := &c.loads
+	g.l.Lock()
+	defer g.l.Unlock()
+	if _, ok := g.calls[key]; ok {
+		return
+	}
+	if g.calls == nil {
+		g.calls = make(map[K]*loadCall[V])
+	}
+	ctx, cancel := context.WithCancel(g.ctx)
+	call := &loadCall[V]{done: make(chan struct{}), cancel: cancel, refresh: true, version: version}
+	if !g.start(func() {
+		c.load(ctx, key, call, func(ctx context.Context) (V, time.Duration, error) {
+			return c.loader(ctx, key)
+		})
+	}) {
+		cancel()
+		return
+	}
+	g.calls[key] = call
+}
+
+// 保留values的值，但不会被values取消，只随parent取消
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+func detach(parent, values context.Context) context.Context {
+	return detachedContext{parent, values}
+}
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.values.Value(key) }
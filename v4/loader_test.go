@@ -0,0 +1,279 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 等待key上的调用方达到n个
+func waitLoadWaiters[K comparable, V any](cache *lruCache[K, V], key K, n int) bool {
+	for i := 0; i < 100; i++ {
+		cache.loads.l.Lock()
+		call, ok := cache.loads.calls[key]
+		waiters := 0
+		if ok {
+			waiters = call.waiters
+		}
+		cache.loads.l.Unlock()
+		if waiters == n {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestGetOrLoad(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	ctx := context.Background()
+	var calls int32
+	loader := func(ctx context.Context) (int, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return 1, time.Minute, nil
+	}
+	val, err := cache.GetOrLoad(ctx, "a", loader)
+	assert.Nil(err)
+	assert.Equal(1, val)
+	// 按loader返回的有效期写入
+	d, ok := cache.TTL("a")
+	assert.True(ok)
+	assert.Equal(time.Minute, d)
+	// 命中时不调用loader
+	val, err = cache.GetOrLoad(ctx, "a", loader)
+	assert.Nil(err)
+	assert.Equal(1, val)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	// 过期后重新加载
+	clock.Advance(time.Minute)
+	cache.GetOrLoad(ctx, "a", loader)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(0, len(cache.loads.calls))
+
+	_, err = cache.GetOrLoad(ctx, "b", func(ctx context.Context) (int, time.Duration, error) {
+		return 1, -time.Second, nil
+	})
+	assert.True(errors.Is(err, ErrExpire))
+
+	cache.Close()
+	_, err = cache.GetOrLoad(ctx, "c", loader)
+	assert.Equal(ErrClosed, err)
+}
+
+// 同一个key的并发未命中只调用一次loader
+func TestGetOrLoadSingleflight(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	defer cache.Close()
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (int, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, 0, nil
+	}
+	n := 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := cache.GetOrLoad(context.Background(), "a", loader)
+			assert.Nil(err)
+			assert.Equal(42, val)
+		}()
+	}
+	assert.True(waitLoadWaiters(cache, "a", n))
+	close(release)
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	assert.True(cache.Exists("a"))
+}
+
+// loader的错误返回给所有调用方，并且不写入cache
+func TestGetOrLoadError(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	defer cache.Close()
+	errLoad := errors.New("db error")
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+				<-release
+				return 0, 0, errLoad
+			})
+			assert.Equal(errLoad, err)
+		}()
+	}
+	assert.True(waitLoadWaiters(cache, "a", 10))
+	close(release)
+	wg.Wait()
+	assert.False(cache.Exists("a"))
+
+	// loader panic时返回错误，不会让调用方一直等待
+	_, err := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+		panic("boom")
+	})
+	assert.True(errors.Is(err, ErrLoaderPanic))
+	val, err := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+		return 1, 0, nil
+	})
+	assert.Nil(err)
+	assert.Equal(1, val)
+}
+
+type ctxKey struct{}
+
+// 调用方的ctx结束时返回ctx.Err()，所有调用方都放弃时取消loader
+func TestGetOrLoadCancel(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	defer cache.Close()
+	release := make(chan struct{})
+	canceled := make(chan struct{})
+	loader := func(ctx context.Context) (int, time.Duration, error) {
+		// 保留调用方ctx中的值
+		assert.Equal("v", ctx.Value(ctxKey{}))
+		select {
+		case <-release:
+			return 1, 0, nil
+		case <-ctx.Done():
+			close(canceled)
+			return 0, 0, ctx.Err()
+		}
+	}
+	ctx1, cancel1 := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "v"))
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := cache.GetOrLoad(ctx1, "a", loader)
+		errs <- err
+	}()
+	assert.True(waitLoadWaiters(cache, "a", 1))
+	go func() {
+		_, err := cache.GetOrLoad(ctx2, "a", loader)
+		errs <- err
+	}()
+	assert.True(waitLoadWaiters(cache, "a", 2))
+	// 第一个调用方放弃，loader继续执行
+	cancel1()
+	assert.Equal(context.Canceled, <-errs)
+	assert.True(waitLoadWaiters(cache, "a", 1))
+	select {
+	case <-canceled:
+		assert.Fail("loader不应该被取消")
+	default:
+	}
+	// 所有调用方都放弃，取消loader
+	cancel2()
+	assert.Equal(context.Canceled, <-errs)
+	<-canceled
+	close(release)
+
+	// 新的调用方重新加载
+	val, err := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+		return 2, 0, nil
+	})
+	assert.Nil(err)
+	assert.Equal(2, val)
+}
+
+// 加载期间key被Set、CompareAndSet、Del修改过时，不用加载的旧值覆盖
+func TestGetOrLoadConcurrentWrite(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	defer cache.Close()
+	for _, write := range []func(key string){
+		func(key string) { cache.Set(key, 2, 0) },
+		func(key string) { cache.CompareAndSet(key, 2, 0, 0) },
+		func(key string) {
+			cache.Set(key, 2, 0)
+			cache.Del(key)
+		},
+		func(key string) { cache.Del(key) },
+	} {
+		release := make(chan struct{})
+		done := make(chan int)
+		go func() {
+			val, _ := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+				<-release
+				return 1, 0, nil
+			})
+			done <- val
+		}()
+		assert.True(waitLoadWaiters(cache, "a", 1))
+		write("a")
+		want, ok := cache.Get("a")
+		close(release)
+		// 调用方仍然得到加载的值
+		assert.Equal(1, <-done)
+		val, exists := cache.Get("a")
+		assert.Equal(ok, exists)
+		assert.Equal(want, val)
+		cache.Del("a")
+	}
+}
+
+// Close取消正在执行的loader和后台刷新，等待它们返回
+func TestGetOrLoadClose(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	var returned int32
+	started := make(chan struct{}, 2)
+	loader := func(ctx context.Context, key string) (int, time.Duration, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		// Close应该等待loader返回
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&returned, 1)
+		return 0, 0, ctx.Err()
+	}
+	cache := newTestCache[string, int](t, WithClock(clock), WithLoader(loader), WithRefreshAhead(time.Second))
+	cache.Set("a", 1, time.Second*10)
+	clock.Advance(time.Second * 9)
+	cache.Get("a")
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrLoad(context.Background(), "b", func(ctx context.Context) (int, time.Duration, error) {
+			return loader(ctx, "b")
+		})
+		errs <- err
+	}()
+	<-started
+	<-started
+	assert.Nil(cache.Close())
+	assert.Equal(int32(2), atomic.LoadInt32(&returned))
+	assert.Equal(context.Canceled, <-errs)
+	_, err := cache.GetOrLoad(context.Background(), "c", func(ctx context.Context) (int, time.Duration, error) {
+		return 1, 0, nil
+	})
+	assert.Equal(ErrClosed, err)
+}
+
+// 加载的值按Set的流程写入，超过最大内存时淘汰
+func TestGetOrLoadEvict(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestCache[string, int](t, WithMaxMemory("1KB"), WithCost(func(string, int) int { return 256 }))
+	for i := 0; i < 10; i++ {
+		val, err := c.GetOrLoad(context.Background(), strconv.Itoa(i), func(ctx context.Context) (int, time.Duration, error) {
+			return i, 0, nil
+		})
+		assert.Nil(err)
+		assert.Equal(i, val)
+	}
+	assert.Equal(int64(4), c.Keys())
+	assert.True(c.Exists("9"))
+	assert.False(c.Exists("0"))
+}
@@ -0,0 +1,208 @@
+// Package metrics 以OpenMetrics文本格式输出cache的统计数据，供Prometheus抓取
+// 只使用标准库
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	v4 "cache/v4"
+)
+
+// ContentType OpenMetrics文本格式的Content-Type
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var (
+	// ErrDuplicate 同一个名字重复注册
+	ErrDuplicate = errors.New("cache名字重复")
+	// ErrName cache的名字不能为空
+	ErrName = errors.New("cache名字不能为空")
+)
+
+// Source 提供统计数据的cache，v4.New返回的cache和v4.ShardedCache都实现了Source
+type Source interface {
+	Stats() v4.Stats
+}
+
+// Handler 输出所有已注册cache的指标，每个cache的指标通过cache标签区分
+type Handler struct {
+	l      sync.RWMutex
+	caches map[string]Source
+}
+
+func NewHandler() *Handler {
+	return &Handler{caches: make(map[string]Source)}
+}
+
+// Register 注册名为name的cache，name重复时返回ErrDuplicate
+func (h *Handler) Register(name string, c Source) error {
+	if name == "" {
+		return ErrName
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	if _, ok := h.caches[name]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicate, name)
+	}
+	h.caches[name] = c
+	return nil
+}
+
+// Unregister 不再输出name的指标，name不存在时返回false
+func (h *Handler) Unregister(name string) bool {
+	h.l.Lock()
+	defer h.l.Unlock()
+	if _, ok := h.caches[name]; !ok {
+		return false
+	}
+	delete(h.caches, name)
+	return true
+}
+
+// 按名字排序的统计数据
+type namedStats struct {
+	name  string
+	stats v4.Stats
+}
+
+func (h *Handler) collect() []namedStats {
+	h.l.RLock()
+	all := make([]namedStats, 0, len(h.caches))
+	for name, c := range h.caches {
+		all = append(all, namedStats{name: name, stats: c.Stats()})
+	}
+	h.l.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].name < all[j].name
+	})
+	return all
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	h.WriteTo(w)
+}
+
+// WriteTo 把所有cache的指标写入w，以# EOF结尾
+func (h *Handler) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	all := h.collect()
+	for _, m := range metricFamilies {
+		m.write(cw, all)
+	}
+	cw.WriteString("# EOF\n")
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// 一个指标，所有cache的样本写在一起
+type family struct {
+	name  string
+	typ   string // counter、gauge、histogram
+	unit  string
+	help  string
+	value func(s v4.Stats) float64 // counter、gauge的值
+}
+
+var metricFamilies = []family{
+	{name: "cache_hits", typ: "counter", help: "Number of Get calls that found the key.", value: func(s v4.Stats) float64 { return float64(s.Hits) }},
+	{name: "cache_misses", typ: "counter", help: "Number of Get calls that did not find the key.", value: func(s v4.Stats) float64 { return float64(s.Misses) }},
+	{name: "cache_sets", typ: "counter", help: "Number of entries written.", value: func(s v4.Stats) float64 { return float64(s.Sets) }},
+	{name: "cache_deletes", typ: "counter", help: "Number of entries removed by Del.", value: func(s v4.Stats) float64 { return float64(s.Deletes) }},
+	{name: "cache_evictions", typ: "counter", help: "Number of entries evicted to free memory.", value: func(s v4.Stats) float64 { return float64(s.Evictions) }},
+	{name: "cache_expirations", typ: "counter", help: "Number of expired entries removed.", value: func(s v4.Stats) float64 { return float64(s.Expirations) }},
+	{name: "cache_load_successes", typ: "counter", help: "Number of successful loader calls.", value: func(s v4.Stats) float64 { return float64(s.LoadSuccess) }},
+	{name: "cache_load_failures", typ: "counter", help: "Number of loader calls that returned an error or panicked.", value: func(s v4.Stats) float64 { return float64(s.LoadFailure) }},
+	{name: "cache_load_duration_seconds", typ: "counter", unit: "seconds", help: "Total time spent in loader calls.", value: func(s v4.Stats) float64 { return s.LoadTime.Seconds() }},
+	{name: "cache_removals_dropped", typ: "counter", help: "Number of OnEvict notifications dropped because the callback queue was full.", value: func(s v4.Stats) float64 { return float64(s.Dropped) }},
+	{name: "cache_keys", typ: "gauge", help: "Number of entries in the cache.", value: func(s v4.Stats) float64 { return float64(s.Keys) }},
+	{name: "cache_memory_used_bytes", typ: "gauge", unit: "bytes", help: "Estimated memory used by entries.", value: func(s v4.Stats) float64 { return float64(s.MemoryUsed) }},
+	{name: "cache_memory_max_bytes", typ: "gauge", unit: "bytes", help: "Maximum memory of the cache.", value: func(s v4.Stats) float64 { return float64(s.MaxMemory) }},
+	{name: "cache_gc_duration_seconds", typ: "histogram", unit: "seconds", help: "Duration of expiration sweeps."},
+}
+
+func (f family) write(w *countWriter, all []namedStats) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	if f.unit != "" {
+		fmt.Fprintf(w, "# UNIT %s %s\n", f.name, f.unit)
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	for _, c := range all {
+		label := `cache="` + escapeLabel(c.name) + `"`
+		switch f.typ {
+		case "counter":
+			fmt.Fprintf(w, "%s_total{%s} %s\n", f.name, label, formatFloat(f.value(c.stats)))
+		case "gauge":
+			fmt.Fprintf(w, "%s{%s} %s\n", f.name, label, formatFloat(f.value(c.stats)))
+		case "histogram":
+			writeGCHistogram(w, f.name, label, c.stats)
+		}
+	}
+}
+
+// 直方图的桶是累计值，最后一个桶为+Inf，_count与+Inf桶相同
+func writeGCHistogram(w io.Writer, name, label string, s v4.Stats) {
+	bounds := v4.GCDurationBuckets()
+	var count int64
+	for i, b := range bounds {
+		if i < len(s.GCHistogram) {
+			count += s.GCHistogram[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, label, formatFloat(b.Seconds()), count)
+	}
+	// GCHistogram为空时也输出+Inf，没有+Inf的histogram不符合OpenMetrics
+	for i := len(bounds); i < len(s.GCHistogram); i++ {
+		count += s.GCHistogram[i]
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, label, formatFloat(s.GCTime.Seconds()))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, label, count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// 记录写入的字节数和第一个错误，出错后不再写入
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *countWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v4 "cache/v4"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 固定的统计数据
+type fixedStats v4.Stats
+
+func (s fixedStats) Stats() v4.Stats {
+	return v4.Stats(s)
+}
+
+func TestHandler(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := v4.New[string, int](v4.WithMaxMemory("1MB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Get("a")
+	cache.Get("b")
+	h := NewHandler()
+	assert.Nil(h.Register("users", cache.(v4.StatsProvider)))
+	assert.Nil(h.Register(`a"b`, fixedStats{
+		Hits:        3,
+		GCRuns:      3,
+		GCTime:      v4.GCDurationBuckets()[1] * 2,
+		GCHistogram: []int64{1, 2, 0, 0, 0, 0},
+	}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(ContentType, resp.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE cache_hits counter",
+		`cache_hits_total{cache="users"} 1`,
+		`cache_misses_total{cache="users"} 1`,
+		`cache_sets_total{cache="users"} 1`,
+		`cache_hits_total{cache="a\"b"} 3`,
+		"# TYPE cache_memory_max_bytes gauge",
+		"# UNIT cache_memory_max_bytes bytes",
+		`cache_memory_max_bytes{cache="users"} 1048576`,
+		`cache_keys{cache="users"} 1`,
+		"# TYPE cache_gc_duration_seconds histogram",
+		`cache_gc_duration_seconds_bucket{cache="a\"b",le="0.0001"} 1`,
+		`cache_gc_duration_seconds_bucket{cache="a\"b",le="0.001"} 3`,
+		`cache_gc_duration_seconds_bucket{cache="a\"b",le="+Inf"} 3`,
+		`cache_gc_duration_seconds_sum{cache="a\"b"} 0.002`,
+		`cache_gc_duration_seconds_count{cache="a\"b"} 3`,
+	} {
+		assert.Contains(text, line+"\n")
+	}
+	assert.True(strings.HasSuffix(text, "# EOF\n"))
+	// 按名字排序
+	assert.Less(strings.Index(text, `cache_hits_total{cache="a\"b"}`), strings.Index(text, `cache_hits_total{cache="users"}`))
+
+	resp, err = http.Post(srv.URL, "text/plain", nil)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestRegister(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler()
+	assert.Nil(h.Register("a", fixedStats{}))
+	assert.True(errors.Is(h.Register("a", fixedStats{}), ErrDuplicate))
+	assert.Equal(ErrName, h.Register("", fixedStats{}))
+	assert.True(h.Unregister("a"))
+	assert.False(h.Unregister("a"))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(rec.Body.String(), `cache="a"`)
+	assert.True(strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+}
+
+// GCHistogram为空时每个桶都为0，仍然输出+Inf
+func TestEmptyGCHistogram(t *testing.T) {
+	assert := assert.New(t)
+	h := NewHandler()
+	assert.Nil(h.Register("a", fixedStats{}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	text := rec.Body.String()
+	assert.Equal(len(v4.GCDurationBuckets())+1, strings.Count(text, `cache_gc_duration_seconds_bucket{cache="a"`))
+	assert.Contains(text, `cache_gc_duration_seconds_bucket{cache="a",le="0.0001"} 0`+"\n")
+	assert.Contains(text, `cache_gc_duration_seconds_bucket{cache="a",le="+Inf"} 0`+"\n")
+	assert.Contains(text, `cache_gc_duration_seconds_count{cache="a"} 0`+"\n")
+}
@@ -0,0 +1,290 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrOption 错误的配置项，New返回的错误可以用errors.Is判断
+	ErrOption = errors.New("错误的配置")
+)
+
+// Policy 淘汰策略
+type Policy int
+
+const (
+	PolicyLRU     Policy = iota // 最近最少使用
+	PolicyLFU                   // 最不经常使用
+	PolicyFIFO                  // 先进先出
+	PolicyRandom                // 随机淘汰
+	PolicyClock                 // CLOCK，近似LRU
+	PolicyTinyLFU               // W-TinyLFU，抗扫描
+	PolicyARC                   // 自适应替换，在最近访问与访问频率之间自动调整
+	Policy2Q                    // 2Q，只访问过一次的元素不会挤掉多次访问的元素
+)
+
+func (p Policy) valid() bool {
+	return p >= PolicyLRU && p <= Policy2Q
+}
+
+type options struct {
+	maxMemory int
+	gcPeriod  time.Duration
+	clock     Clock
+	policy    Policy
+	cost      interface{} // func(K, V) int，由New检查类型
+	hasher    interface{} // func(K) uint64，由New检查类型
+	// ARC、2Q中幽灵元素的元数据预算，不计入maxMemory
+	ghostBudget int
+	// 使用随机采样的主动过期，替代时间轮
+	activeExpire     bool
+	expireSampleSize int
+	expireEffort     int
+	expireBudget     time.Duration
+	// func(context.Context, K) (V, time.Duration, error)，由New检查类型
+	loader       interface{}
+	refreshAhead time.Duration
+	grace        time.Duration
+	// Store[K, V]，由New检查类型
+	store         interface{}
+	writeBehind   bool
+	flushInterval time.Duration
+	flushBatch    int
+	aofPath       string
+	aofFsync      FsyncPolicy
+	codec         Codec
+}
+
+func defaultOptions() *options {
+	return &options{
+		maxMemory:        LRUDefaultMemory,
+		gcPeriod:         DefaultAutoGCPeriod,
+		clock:            realClock{},
+		policy:           PolicyLRU,
+		ghostBudget:      DefaultGhostBudget,
+		expireSampleSize: DefaultExpireSampleSize,
+		expireEffort:     DefaultExpireEffort,
+		expireBudget:     DefaultExpireBudget,
+		flushInterval:    DefaultFlushInterval,
+		flushBatch:       DefaultFlushBatch,
+		codec:            GobCodec,
+	}
+}
+
+// Option New的配置项，配置错误时New返回error
+type Option func(*options) error
+
+// WithMaxMemory 最大内存，格式同SetMaxMemory，如"100MB"
+func WithMaxMemory(size string) Option {
+	return func(o *options) error {
+		siz, err := getMemorySize(size)
+		if err != nil {
+			return err
+		}
+		o.maxMemory = siz
+		return nil
+	}
+}
+
+// WithGCPeriod 自动gc周期，不能小于MinGCPeriod
+func WithGCPeriod(d time.Duration) Option {
+	return func(o *options) error {
+		if d < MinGCPeriod {
+			return fmt.Errorf("%w: gc周期%v小于%v", ErrOption, d, MinGCPeriod)
+		}
+		o.gcPeriod = d
+		return nil
+	}
+}
+
+// WithClock 替换时间来源，所有有效期与gc的判断都使用clock
+func WithClock(clock Clock) Option {
+	return func(o *options) error {
+		if clock == nil {
+			return fmt.Errorf("%w: clock不能为nil", ErrOption)
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
+// WithEvictionPolicy 内存不足时的淘汰策略
+func WithEvictionPolicy(p Policy) Option {
+	return func(o *options) error {
+		if !p.valid() {
+			return fmt.Errorf("%w: 未知的淘汰策略%d", ErrOption, p)
+		}
+		o.policy = p
+		return nil
+	}
+}
+
+// WithGhostBudget ARC、2Q中记录已淘汰key的幽灵链表的内存预算，格式同SetMaxMemory
+// 幽灵元素只保存key，占用不计入最大内存
+func WithGhostBudget(size string) Option {
+	return func(o *options) error {
+		siz, err := getMemorySize(size)
+		if err != nil {
+			return err
+		}
+		o.ghostBudget = siz
+		return nil
+	}
+}
+
+// WithActiveExpire 参考Redis，gc时随机采样带有效期的元素，替代默认的时间轮
+// 每轮采样sampleSize+sampleSize/4*(effort-1)个元素，过期比例超过(11-effort)%时继续下一轮
+// effort取值1-10，越大过期元素删除得越及时，一次gc的耗时不超过budget
+func WithActiveExpire(sampleSize, effort int, budget time.Duration) Option {
+	return func(o *options) error {
+		if sampleSize <= 0 {
+			return fmt.Errorf("%w: 采样个数%d必须大于0", ErrOption, sampleSize)
+		}
+		if effort < 1 || effort > MaxExpireEffort {
+			return fmt.Errorf("%w: 主动过期力度%d必须在1-%d之间", ErrOption, effort, MaxExpireEffort)
+		}
+		if budget <= 0 {
+			return fmt.Errorf("%w: 时间预算%v必须大于0", ErrOption, budget)
+		}
+		o.activeExpire = true
+		o.expireSampleSize = sampleSize
+		o.expireEffort = effort
+		o.expireBudget = budget
+		return nil
+	}
+}
+
+// WithLoader 注册loader，配合WithRefreshAhead、WithStaleGrace在后台重新加载快要过期的元素
+// K、V必须与New的类型参数一致
+func WithLoader[K comparable, V any](loader func(ctx context.Context, key K) (V, time.Duration, error)) Option {
+	return func(o *options) error {
+		if loader == nil {
+			return fmt.Errorf("%w: loader不能为nil", ErrOption)
+		}
+		o.loader = loader
+		return nil
+	}
+}
+
+// WithRefreshAhead 有效期结束前window内的Get仍然返回当前的值，同时在后台通过loader重新加载
+func WithRefreshAhead(window time.Duration) Option {
+	return func(o *options) error {
+		if window <= 0 {
+			return fmt.Errorf("%w: 提前刷新的时间%v必须大于0", ErrOption, window)
+		}
+		o.refreshAhead = window
+		return nil
+	}
+}
+
+// WithStaleGrace 有效期结束后grace内的Get仍然返回旧值，同时在后台通过loader重新加载
+// 重新加载失败时继续返回旧值，直到宽限期结束
+func WithStaleGrace(grace time.Duration) Option {
+	return func(o *options) error {
+		if grace <= 0 {
+			return fmt.Errorf("%w: 宽限期%v必须大于0", ErrOption, grace)
+		}
+		o.grace = grace
+		return nil
+	}
+}
+
+// WithWriteThrough Set、Del同步写入store，写入失败时不修改cache并返回错误
+// GetOrLoad的loader为nil时从store加载，K、V必须与New的类型参数一致
+func WithWriteThrough[K comparable, V any](store Store[K, V]) Option {
+	return func(o *options) error {
+		if store == nil {
+			return fmt.Errorf("%w: store不能为nil", ErrOption)
+		}
+		o.store = store
+		o.writeBehind = false
+		return nil
+	}
+}
+
+// WithWriteBehind Set、Del只修改cache，修改加入写入队列，每隔interval或者队列达到batch个key时批量写入store
+// 淘汰还没有写入的元素之前先写入store，Close时写入队列中剩余的修改
+// GetOrLoad的loader为nil时从store加载，K、V必须与New的类型参数一致
+func WithWriteBehind[K comparable, V any](store Store[K, V], interval time.Duration, batch int) Option {
+	return func(o *options) error {
+		if store == nil {
+			return fmt.Errorf("%w: store不能为nil", ErrOption)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("%w: 写入间隔%v必须大于0", ErrOption, interval)
+		}
+		if batch <= 0 {
+			return fmt.Errorf("%w: 批量写入个数%d必须大于0", ErrOption, batch)
+		}
+		o.store = store
+		o.writeBehind = true
+		o.flushInterval = interval
+		o.flushBatch = batch
+		return nil
+	}
+}
+
+// WithAOF 所有修改追加写入path，New时重放path中的操作恢复元素
+// fsync为调用fsync的时机，文件超过上次重写后的两倍时在后台重写
+// ShardedCache的每个分片使用path.0、path.1...
+func WithAOF(path string, fsync FsyncPolicy) Option {
+	return func(o *options) error {
+		if path == "" {
+			return fmt.Errorf("%w: aof路径不能为空", ErrOption)
+		}
+		if !fsync.valid() {
+			return fmt.Errorf("%w: 未知的fsync策略%d", ErrOption, fsync)
+		}
+		o.aofPath = path
+		o.aofFsync = fsync
+		return nil
+	}
+}
+
+// WithCodec 快照、aof编码key、value的方式，默认为GobCodec
+func WithCodec(codec Codec) Option {
+	return func(o *options) error {
+		if codec == nil {
+			return fmt.Errorf("%w: codec不能为nil", ErrOption)
+		}
+		o.codec = codec
+		return nil
+	}
+}
+
+// WithCost 自定义元素占用的内存大小，K、V必须与New的类型参数一致
+func WithCost[K comparable, V any](cost func(key K, val V) int) Option {
+	return func(o *options) error {
+		if cost == nil {
+			return fmt.Errorf("%w: cost不能为nil", ErrOption)
+		}
+		o.cost = cost
+		return nil
+	}
+}
+
+// WithHasher 自定义key的hash，K必须与New的类型参数一致
+// key不是string、整数类型(包括以它们为底层类型的自定义类型)时，ShardedCache和PolicyTinyLFU需要配置
+// 结果不能依赖随机种子或者指针地址，否则重启后从aof、快照恢复的元素会分配到错误的分片
+func WithHasher[K comparable](hash func(key K) uint64) Option {
+	return func(o *options) error {
+		if hash == nil {
+			return fmt.Errorf("%w: hasher不能为nil", ErrOption)
+		}
+		o.hasher = hash
+		return nil
+	}
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
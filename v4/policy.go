@@ -0,0 +1,332 @@
+package v4
+
+import (
+	"math/rand"
+)
+
+// EvictionPolicy 淘汰策略
+// cache在元素插入、访问、更新、删除时通知策略，内存不足时通过Victim选出要淘汰的元素
+// 所有方法都在cache的写锁内调用，策略本身不需要加锁
+type EvictionPolicy[K comparable, V any] interface {
+	// 新元素写入cache
+	OnInsert(e *elem[K, V])
+	// Get命中
+	OnAccess(e *elem[K, V])
+	// 已存在的元素被Set覆盖，oldSize为覆盖前的大小
+	OnUpdate(e *elem[K, V], oldSize int)
+	// 元素从cache中删除，包括淘汰、过期、Del
+	OnRemove(e *elem[K, V])
+	// 下一个要淘汰的元素，没有元素时返回nil
+	// Victim可以调整策略内部的顺序，但不删除元素，cache随后会调用OnRemove删除它
+	Victim() *elem[K, V]
+	// 策略中元素个数
+	Len() int
+	// 清空所有元素，Flush时调用
+	Reset()
+}
+
+// 需要知道最大内存的策略实现capacityAware，创建cache和修改最大内存时调用
+type capacityAware interface {
+	setCapacity(maxMemory int)
+}
+
+func newPolicy[K comparable, V any](o *options) EvictionPolicy[K, V] {
+	switch o.policy {
+	case PolicyLFU:
+		return newLFUPolicy[K, V]()
+	case PolicyFIFO:
+		return &fifoPolicy[K, V]{}
+	case PolicyRandom:
+		return &randomPolicy[K, V]{}
+	case PolicyClock:
+		return &clockPolicy[K, V]{}
+	case PolicyTinyLFU:
+		return newTinyLFUPolicy[K, V]()
+	case PolicyARC:
+		return newARCPolicy[K, V](o.ghostBudget)
+	case Policy2Q:
+		return newTwoQueuePolicy[K, V](o.ghostBudget)
+	default:
+		return &lruPolicy[K, V]{}
+	}
+}
+
+// 双链表，head为最新的元素，tail为最旧的元素
+type list[K comparable, V any] struct {
+	head *elem[K, V]
+	tail *elem[K, V]
+	len  int
+}
+
+// 将e移到第一个
+func (l *list[K, V]) moveToHead(e *elem[K, V]) {
+	if l.head == e {
+		return
+	}
+	l.del(e)
+	l.lpush(e)
+}
+
+// 删除e,e必定是链表中的一个元素
+func (l *list[K, V]) del(e *elem[K, V]) {
+	if e.next == nil && e.prev == nil { // 只有e一个元素
+		l.head = nil
+		l.tail = nil
+	} else if e.next == nil { // e是最后一个元素
+		prev := e.prev
+		prev.next = nil
+		l.tail = prev
+	} else if e.prev == nil { // e是第一个元素
+		next := e.next
+		next.prev = nil
+		l.head = next
+	} else {
+		prev := e.prev
+		prev.next = e.next
+		e.next.prev = prev
+	}
+	l.len--
+	e.free()
+}
+
+// 把元素插入第一个
+func (l *list[K, V]) lpush(e *elem[K, V]) {
+	if l.head == nil { // 没有元素
+		l.tail = e
+	} else {
+		e.next = l.head
+		e.prev = nil
+		l.head.prev = e
+	}
+	l.head = e
+	l.len++
+}
+
+// 把元素插入到mark之前，mark必定是链表中的一个元素
+func (l *list[K, V]) insertBefore(e, mark *elem[K, V]) {
+	if mark.prev == nil {
+		l.lpush(e)
+		return
+	}
+	e.prev = mark.prev
+	e.next = mark
+	mark.prev.next = e
+	mark.prev = e
+	l.len++
+}
+
+// 弹出最后一个elem
+func (l *list[K, V]) rpop() *elem[K, V] {
+	tail := l.tail
+	if tail != nil {
+		l.del(tail)
+	}
+	return tail
+}
+
+func (l *list[K, V]) reset() {
+	l.head = nil
+	l.tail = nil
+	l.len = 0
+}
+
+// 最近最少使用，访问和更新时移到链表头，淘汰链表尾
+type lruPolicy[K comparable, V any] struct {
+	list[K, V]
+}
+
+func (p *lruPolicy[K, V]) OnInsert(e *elem[K, V])              { p.lpush(e) }
+func (p *lruPolicy[K, V]) OnAccess(e *elem[K, V])              { p.moveToHead(e) }
+func (p *lruPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) { p.moveToHead(e) }
+func (p *lruPolicy[K, V]) OnRemove(e *elem[K, V])              { p.del(e) }
+func (p *lruPolicy[K, V]) Victim() *elem[K, V]                 { return p.tail }
+func (p *lruPolicy[K, V]) Len() int                            { return p.len }
+func (p *lruPolicy[K, V]) Reset()                              { p.reset() }
+
+// 先进先出，访问和更新都不改变顺序
+type fifoPolicy[K comparable, V any] struct {
+	list[K, V]
+}
+
+func (p *fifoPolicy[K, V]) OnInsert(e *elem[K, V])              { p.lpush(e) }
+func (p *fifoPolicy[K, V]) OnAccess(e *elem[K, V])              {}
+func (p *fifoPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) {}
+func (p *fifoPolicy[K, V]) OnRemove(e *elem[K, V])              { p.del(e) }
+func (p *fifoPolicy[K, V]) Victim() *elem[K, V]                 { return p.tail }
+func (p *fifoPolicy[K, V]) Len() int                            { return p.len }
+func (p *fifoPolicy[K, V]) Reset()                              { p.reset() }
+
+// 随机淘汰，元素保存在slice中，e.index为下标
+type randomPolicy[K comparable, V any] struct {
+	elems []*elem[K, V]
+}
+
+func (p *randomPolicy[K, V]) OnInsert(e *elem[K, V]) {
+	e.index = len(p.elems)
+	p.elems = append(p.elems, e)
+}
+func (p *randomPolicy[K, V]) OnAccess(e *elem[K, V])              {}
+func (p *randomPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) {}
+
+// 与最后一个元素交换后删除，O(1)
+func (p *randomPolicy[K, V]) OnRemove(e *elem[K, V]) {
+	last := len(p.elems) - 1
+	p.elems[e.index] = p.elems[last]
+	p.elems[e.index].index = e.index
+	p.elems[last] = nil
+	p.elems = p.elems[:last]
+	e.index = 0
+}
+func (p *randomPolicy[K, V]) Victim() *elem[K, V] {
+	if len(p.elems) == 0 {
+		return nil
+	}
+	return p.elems[rand.Intn(len(p.elems))]
+}
+func (p *randomPolicy[K, V]) Len() int { return len(p.elems) }
+func (p *randomPolicy[K, V]) Reset()   { p.elems = nil }
+
+// CLOCK，近似LRU
+// 链表首尾相连看作一个环，hand从head向tail扫描，访问过的元素(ref)清除标记后跳过，第一个未访问的元素被淘汰
+// 新元素插入到hand之前，即最后才会被扫描到
+type clockPolicy[K comparable, V any] struct {
+	list[K, V]
+	hand *elem[K, V]
+}
+
+func (p *clockPolicy[K, V]) OnInsert(e *elem[K, V]) {
+	if p.hand == nil {
+		p.lpush(e)
+		p.hand = e
+		return
+	}
+	p.insertBefore(e, p.hand)
+}
+func (p *clockPolicy[K, V]) OnAccess(e *elem[K, V])              { e.ref = true }
+func (p *clockPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) { e.ref = true }
+func (p *clockPolicy[K, V]) OnRemove(e *elem[K, V]) {
+	if p.hand == e {
+		p.advance()
+		if p.hand == e { // 只有e一个元素
+			p.hand = nil
+		}
+	}
+	p.del(e)
+	e.ref = false
+}
+
+// 最多扫描两圈，第二圈时所有标记都已清除
+func (p *clockPolicy[K, V]) Victim() *elem[K, V] {
+	for i := 0; i < 2*p.len; i++ {
+		if !p.hand.ref {
+			return p.hand
+		}
+		p.hand.ref = false
+		p.advance()
+	}
+	return p.hand
+}
+func (p *clockPolicy[K, V]) Len() int { return p.len }
+func (p *clockPolicy[K, V]) Reset() {
+	p.reset()
+	p.hand = nil
+}
+
+func (p *clockPolicy[K, V]) advance() {
+	if p.hand.next != nil {
+		p.hand = p.hand.next
+	} else {
+		p.hand = p.head
+	}
+}
+
+// LFU，访问次数相同的元素放在同一个桶中，桶按访问次数从小到大组成链表，插入、访问、淘汰都是O(1)
+// 同一个桶内按LRU排序，淘汰访问次数最少的桶中最久未访问的元素
+type lfuPolicy[K comparable, V any] struct {
+	buckets map[int]*lfuBucket[K, V] // 访问次数->桶
+	head    *lfuBucket[K, V]         // 访问次数最少的桶
+	len     int
+}
+
+type lfuBucket[K comparable, V any] struct {
+	freq  int
+	items list[K, V]
+	prev  *lfuBucket[K, V]
+	next  *lfuBucket[K, V]
+}
+
+func newLFUPolicy[K comparable, V any]() *lfuPolicy[K, V] {
+	return &lfuPolicy[K, V]{
+		buckets: make(map[int]*lfuBucket[K, V]),
+	}
+}
+
+func (p *lfuPolicy[K, V]) OnInsert(e *elem[K, V]) {
+	e.freq = 1
+	b, ok := p.buckets[1]
+	if !ok {
+		b = &lfuBucket[K, V]{freq: 1, next: p.head}
+		if p.head != nil {
+			p.head.prev = b
+		}
+		p.head = b
+		p.buckets[1] = b
+	}
+	b.items.lpush(e)
+	p.len++
+}
+func (p *lfuPolicy[K, V]) OnAccess(e *elem[K, V])              { p.increment(e) }
+func (p *lfuPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) { p.increment(e) }
+func (p *lfuPolicy[K, V]) OnRemove(e *elem[K, V]) {
+	b := p.buckets[e.freq]
+	b.items.del(e)
+	if b.items.len == 0 {
+		p.removeBucket(b)
+	}
+	e.freq = 0
+	p.len--
+}
+func (p *lfuPolicy[K, V]) Victim() *elem[K, V] {
+	if p.head == nil {
+		return nil
+	}
+	return p.head.items.tail
+}
+func (p *lfuPolicy[K, V]) Len() int { return p.len }
+func (p *lfuPolicy[K, V]) Reset() {
+	p.buckets = make(map[int]*lfuBucket[K, V])
+	p.head = nil
+	p.len = 0
+}
+
+// 访问次数+1，移到下一个桶
+func (p *lfuPolicy[K, V]) increment(e *elem[K, V]) {
+	b := p.buckets[e.freq]
+	e.freq++
+	next := b.next
+	if next == nil || next.freq != e.freq {
+		next = &lfuBucket[K, V]{freq: e.freq, prev: b, next: b.next}
+		if b.next != nil {
+			b.next.prev = next
+		}
+		b.next = next
+		p.buckets[e.freq] = next
+	}
+	b.items.del(e)
+	next.items.lpush(e)
+	if b.items.len == 0 {
+		p.removeBucket(b)
+	}
+}
+
+func (p *lfuPolicy[K, V]) removeBucket(b *lfuBucket[K, V]) {
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else {
+		p.head = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	}
+	delete(p.buckets, b.freq)
+}
@@ -0,0 +1,279 @@
+package v4
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 每个元素256byte，1KB最多存放4个元素
+func policyCost(string, int) int { return 256 }
+
+// 测试各个策略淘汰的元素
+func TestPolicyEvict(t *testing.T) {
+	table := []struct {
+		policy  Policy
+		set     []string
+		get     []string
+		evicted []string
+	}{
+		// 访问a后，b最久未访问
+		{PolicyLRU, []string{"a", "b", "c", "d", "e"}, []string{"a"}, []string{"b"}},
+		// 访问不改变顺序，a最先写入
+		{PolicyFIFO, []string{"a", "b", "c", "d", "e"}, []string{"a"}, []string{"a"}},
+		// d只访问过一次，e写入后只有一次，f写入时淘汰e
+		{PolicyLFU, []string{"a", "b", "c", "d", "e", "f"}, []string{"a", "a", "b", "c"}, []string{"d", "e"}},
+		// a,b有访问标记，hand清除标记后停在c
+		{PolicyClock, []string{"a", "b", "c", "d", "e"}, []string{"a", "b"}, []string{"c"}},
+	}
+	for _, v := range table {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(v.policy), WithCost(policyCost))
+		for i, key := range v.set[:4] {
+			cache.Set(key, i, 0)
+		}
+		for _, key := range v.get {
+			_, ok := cache.Get(key)
+			assert.True(ok, key)
+		}
+		for i, key := range v.set[4:] {
+			cache.Set(key, i+4, 0)
+		}
+		assert.Equal(int64(4), cache.Keys(), v.policy)
+		for _, key := range v.set {
+			evicted := false
+			for _, k := range v.evicted {
+				evicted = evicted || k == key
+			}
+			assert.Equal(!evicted, cache.Exists(key), "policy %d key %s", v.policy, key)
+		}
+		cache.Close()
+	}
+}
+
+// 测试随机淘汰
+func TestPolicyRandom(t *testing.T) {
+	assert := assert.New(t)
+	cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(PolicyRandom), WithCost(policyCost))
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+		assert.True(cache.Exists(strconv.Itoa(i)))
+	}
+	assert.Equal(int64(4), cache.Keys())
+	assert.Equal(4, cache.policy.Len())
+}
+
+// 随机的Set,Get,Del,Flush后，策略中的元素与map保持一致
+func TestPolicyConsistent(t *testing.T) {
+	for _, p := range []Policy{PolicyLRU, PolicyLFU, PolicyFIFO, PolicyRandom, PolicyClock, PolicyTinyLFU, PolicyARC, Policy2Q} {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(p),
+			WithCost(func(key string, val int) int { return val%100 + 1 }))
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			key := strconv.Itoa(r.Intn(200))
+			switch r.Intn(10) {
+			case 0:
+				cache.Del(key)
+			case 1, 2, 3:
+				cache.Get(key)
+			default:
+				cache.Set(key, r.Intn(1000), 0)
+			}
+			if i%5000 == 4999 {
+				cache.Flush()
+			}
+			if !assert.Equal(len(cache.m), cache.policy.Len(), "policy %d", p) {
+				break
+			}
+			assert.LessOrEqual(cache.elemSize, cache.maxMemory)
+		}
+		size := 0
+		for _, e := range cache.m {
+			size += e.size
+		}
+		assert.Equal(size, cache.elemSize)
+		for cache.policy.Len() > 0 {
+			cache.remove(cache.policy.Victim(), ReasonCapacity)
+		}
+		assert.Equal(0, len(cache.m))
+		cache.Close()
+	}
+}
+
+// 测试W-TinyLFU，一次性扫描不会挤掉热点元素
+func TestPolicyTinyLFUScan(t *testing.T) {
+	for _, v := range []struct {
+		policy Policy
+		hits   int
+	}{
+		{PolicyLRU, 0},
+		{PolicyTinyLFU, 100},
+	} {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(v.policy),
+			WithCost(func(string, int) int { return 4 }))
+		// 256个元素，其中100个热点元素访问多次
+		for i := 0; i < 256; i++ {
+			cache.Set("hot"+strconv.Itoa(i), i, 0)
+		}
+		for n := 0; n < 5; n++ {
+			for i := 0; i < 100; i++ {
+				cache.Get("hot" + strconv.Itoa(i))
+			}
+		}
+		// 扫描1000个新key
+		for i := 0; i < 1000; i++ {
+			cache.Set("scan"+strconv.Itoa(i), i, 0)
+		}
+		hits := 0
+		for i := 0; i < 100; i++ {
+			if cache.Exists("hot" + strconv.Itoa(i)) {
+				hits++
+			}
+		}
+		assert.Equal(v.hits, hits, "policy %d", v.policy)
+		assert.Equal(int64(256), cache.Keys())
+		cache.Close()
+	}
+}
+
+// W-TinyLFU使用插入时计算的hash，访问和淘汰时不再计算，其他类型的key需要WithHasher
+func TestPolicyTinyLFUHash(t *testing.T) {
+	assert := assert.New(t)
+	_, err := New[point, int](WithEvictionPolicy(PolicyTinyLFU))
+	assert.True(errors.Is(err, ErrOption))
+	var calls int32
+	cache := newTestCache[point, int](t, WithEvictionPolicy(PolicyTinyLFU), WithMaxMemory("1KB"),
+		WithCost(func(point, int) int { return 4 }),
+		WithHasher(func(p point) uint64 {
+			atomic.AddInt32(&calls, 1)
+			return mix64(uint64(p.x))
+		}))
+	// 每次插入计算一次，更新、访问、淘汰都不计算
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 200; i++ {
+			cache.Set(point{i, 0}, n, 0)
+			cache.Get(point{i, 0})
+		}
+	}
+	lockedGC(cache)
+	assert.Equal(int32(200), atomic.LoadInt32(&calls))
+	for i := 200; i < 500; i++ {
+		cache.Set(point{i, 0}, i, 0)
+	}
+	lockedGC(cache)
+	assert.Equal(int32(500), atomic.LoadInt32(&calls))
+	assert.Equal(int64(256), cache.Keys())
+	for _, e := range cache.m {
+		assert.Equal(mix64(uint64(e.key.x)), e.hash)
+	}
+}
+
+// 测试count-min sketch的估算与减半
+func TestCountMinSketch(t *testing.T) {
+	assert := assert.New(t)
+	s := newCountMinSketch(sketchMinWidth)
+	a, b := hashString("a"), hashString("b")
+	for i := 0; i < 5; i++ {
+		s.increment(a)
+	}
+	s.increment(b)
+	assert.Equal(5, s.estimate(a))
+	assert.Equal(1, s.estimate(b))
+	assert.Equal(0, s.estimate(hashString("c")))
+	for i := 0; i < 20; i++ {
+		s.increment(a)
+	}
+	assert.Equal(sketchMaxCount, s.estimate(a))
+	s.reset()
+	assert.Equal(sketchMaxCount/2, s.estimate(a))
+	assert.Equal(0, s.estimate(b))
+}
+
+// 测试ARC、2Q，热点元素不会被扫描挤掉
+func TestPolicyAdaptiveScan(t *testing.T) {
+	for _, p := range []Policy{PolicyARC, Policy2Q} {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(p),
+			WithCost(func(string, int) int { return 4 }))
+		for i := 0; i < 100; i++ {
+			cache.Set("hot"+strconv.Itoa(i), i, 0)
+		}
+		if p == PolicyARC {
+			// 再次访问，进入T2
+			for i := 0; i < 100; i++ {
+				cache.Get("hot" + strconv.Itoa(i))
+			}
+		} else {
+			// 2Q中被淘汰后再次写入，才进入Am
+			for i := 0; i < 1000; i++ {
+				cache.Set("scan"+strconv.Itoa(i), i, 0)
+			}
+			assert.False(cache.Exists("hot0"))
+			for i := 0; i < 100; i++ {
+				cache.Set("hot"+strconv.Itoa(i), i, 0)
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			cache.Set("scan2-"+strconv.Itoa(i), i, 0)
+		}
+		for i := 0; i < 100; i++ {
+			assert.True(cache.Exists("hot"+strconv.Itoa(i)), "policy %d", p)
+		}
+		assert.Equal(int64(256), cache.Keys())
+		assert.Equal(1024, cache.elemSize)
+		cache.Close()
+	}
+}
+
+// 测试ARC命中幽灵链表后调整T1的目标大小
+func TestPolicyARCAdapt(t *testing.T) {
+	assert := assert.New(t)
+	cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(PolicyARC), WithCost(policyCost))
+	arc := cache.policy.(*arcPolicy[string, int])
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		cache.Set(key, i, 0)
+	}
+	// a从T1淘汰，进入B1
+	assert.False(cache.Exists("a"))
+	assert.Equal(1, arc.b1.len)
+	assert.Equal(0, arc.p)
+	// 再次写入a，命中B1，p增大，a进入T2，b从T1淘汰
+	cache.Set("a", 0, 0)
+	assert.Equal(256, arc.p)
+	assert.Equal(arcT2, cache.m["a"].seg)
+	assert.Equal(1, arc.b1.len)
+	_, ok := arc.ghosts.get("b")
+	assert.True(ok)
+	_, ok = arc.ghosts.get("a")
+	assert.False(ok)
+	assert.Equal(4, arc.t1.len+arc.t2.len)
+}
+
+// 测试幽灵元素不超过预算，且不计入最大内存
+func TestPolicyGhostBudget(t *testing.T) {
+	for _, p := range []Policy{PolicyARC, Policy2Q} {
+		assert := assert.New(t)
+		cache := newTestCache[string, int](t, WithMaxMemory("1KB"), WithEvictionPolicy(p), WithGhostBudget("1KB"),
+			WithCost(func(string, int) int { return 16 }))
+		for i := 0; i < 10000; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+		}
+		var ghosts ghostSet[string, int]
+		if p == PolicyARC {
+			ghosts = cache.policy.(*arcPolicy[string, int]).ghosts
+		} else {
+			ghosts = cache.policy.(*twoQueuePolicy[string, int]).ghosts
+		}
+		assert.LessOrEqual(ghosts.bytes, UnitKB)
+		assert.Greater(len(ghosts.m), 0)
+		assert.Equal(64, len(cache.m))
+		assert.Equal(UnitKB, cache.elemSize)
+		cache.Close()
+	}
+}
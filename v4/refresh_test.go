@@ -0,0 +1,210 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 计数的loader，每次加载返回递增的版本号
+type countLoader struct {
+	calls int32
+	fail  int32 // 不为0时加载失败
+	ttl   time.Duration
+}
+
+func (l *countLoader) load(ctx context.Context, key string) (int, time.Duration, error) {
+	n := atomic.AddInt32(&l.calls, 1)
+	if atomic.LoadInt32(&l.fail) != 0 {
+		return 0, 0, errors.New("db error")
+	}
+	return int(n), l.ttl, nil
+}
+
+func (l *countLoader) count() int32 {
+	return atomic.LoadInt32(&l.calls)
+}
+
+// 等待后台刷新结束
+func waitRefresh(cache *lruCache[string, int], key string) bool {
+	for i := 0; i < 100; i++ {
+		cache.loads.l.Lock()
+		_, ok := cache.loads.calls[key]
+		cache.loads.l.Unlock()
+		if !ok {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestRefreshOptions(t *testing.T) {
+	assert := assert.New(t)
+	l := &countLoader{}
+	for _, opts := range [][]Option{
+		{WithRefreshAhead(time.Second)},
+		{WithStaleGrace(time.Second)},
+		{WithRefreshAhead(0), WithLoader(l.load)},
+		{WithStaleGrace(-time.Second), WithLoader(l.load)},
+		{WithLoader[int, int](func(ctx context.Context, key int) (int, time.Duration, error) { return 0, 0, nil })},
+	} {
+		_, err := New[string, int](opts...)
+		assert.True(errors.Is(err, ErrOption))
+	}
+	_, err := NewShardedCache[string, int](4, WithRefreshAhead(time.Second))
+	assert.True(errors.Is(err, ErrOption))
+	c, err := New[string, int](WithLoader(l.load), WithRefreshAhead(time.Second), WithStaleGrace(time.Second))
+	assert.Nil(err)
+	c.Close()
+}
+
+// 有效期结束前的Get返回当前的值，并在后台重新加载
+func TestRefreshAhead(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	l := &countLoader{ttl: time.Second * 10}
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithLoader(l.load),
+		WithRefreshAhead(time.Second*3))
+	val, err := cache.GetOrLoad(context.Background(), "a", func(ctx context.Context) (int, time.Duration, error) {
+		return l.load(ctx, "a")
+	})
+	assert.Nil(err)
+	assert.Equal(1, val)
+
+	// 还没有到提前刷新的时间
+	clock.Advance(time.Second * 6)
+	val, _ = cache.Get("a")
+	assert.Equal(1, val)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(1), l.count())
+
+	clock.Advance(time.Second * 2)
+	val, ok := cache.Get("a")
+	assert.True(ok)
+	assert.Equal(1, val)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(2), l.count())
+	val, _ = cache.Get("a")
+	assert.Equal(2, val)
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*10, d)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(2), l.count())
+}
+
+// 同一个key同时只有一个后台刷新
+func TestRefreshDedup(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	release := make(chan struct{})
+	var calls int32
+	cache := newTestCache[string, int](t, WithClock(clock), WithRefreshAhead(time.Second),
+		WithLoader(func(ctx context.Context, key string) (int, time.Duration, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return 2, time.Second * 10, nil
+		}))
+	cache.Set("a", 1, time.Second*10)
+	clock.Advance(time.Second * 9)
+	for i := 0; i < 100; i++ {
+		val, _ := cache.Get("a")
+		assert.Equal(1, val)
+	}
+	// 其他key的加载不受正在进行的刷新影响
+	done := make(chan int)
+	go func() {
+		val, _ := cache.GetOrLoad(context.Background(), "b", func(ctx context.Context) (int, time.Duration, error) {
+			return 3, 0, nil
+		})
+		done <- val
+	}()
+	assert.Equal(3, <-done)
+	close(release)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	val, _ := cache.Get("a")
+	assert.Equal(2, val)
+}
+
+// 宽限期内返回旧值，重新加载失败时继续返回旧值，直到宽限期结束
+func TestStaleGrace(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	l := &countLoader{ttl: time.Second * 10, fail: 1}
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithLoader(l.load),
+		WithStaleGrace(time.Second*5))
+	cache.Set("a", 1, time.Second*10)
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*10, d)
+
+	clock.Advance(time.Second * 12)
+	lockedGC(cache)
+	// 软过期以后仍然可以返回旧值
+	assert.True(cache.Exists("a"))
+	val, ok := cache.Get("a")
+	assert.True(ok)
+	assert.Equal(1, val)
+	d, _ = cache.TTL("a")
+	assert.Equal(time.Duration(0), d)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(1), l.count())
+	// 加载失败，继续返回旧值，refreshRetry内的Get不再加载
+	for i := 0; i < 10; i++ {
+		val, ok = cache.Get("a")
+		assert.True(ok)
+		assert.Equal(1, val)
+	}
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(1), l.count())
+	clock.Advance(refreshRetry)
+	val, _ = cache.Get("a")
+	assert.Equal(1, val)
+	assert.True(waitRefresh(cache, "a"))
+	assert.Equal(int32(2), l.count())
+
+	// 宽限期结束后删除
+	clock.Advance(time.Second * 2)
+	_, ok = cache.Get("a")
+	assert.False(ok)
+	// 时间轮的精度为1秒
+	clock.Advance(wheelTick)
+	lockedGC(cache)
+	assert.Equal(int64(0), cache.Keys())
+
+	// 加载成功后返回新的值
+	atomic.StoreInt32(&l.fail, 0)
+	cache.Set("a", 1, time.Second*10)
+	clock.Advance(time.Second * 11)
+	val, _ = cache.Get("a")
+	assert.Equal(1, val)
+	assert.True(waitRefresh(cache, "a"))
+	val, _ = cache.Get("a")
+	assert.Equal(3, val)
+	d, _ = cache.TTL("a")
+	assert.Equal(time.Second*10, d)
+}
+
+// 后台刷新期间key被修改过时不写入刷新的值
+func TestRefreshConcurrentSet(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	release := make(chan struct{})
+	cache := newTestCache[string, int](t, WithClock(clock), WithRefreshAhead(time.Second),
+		WithLoader(func(ctx context.Context, key string) (int, time.Duration, error) {
+			<-release
+			return 2, time.Second * 10, nil
+		}))
+	cache.Set("a", 1, time.Second*10)
+	clock.Advance(time.Second * 9)
+	cache.Get("a")
+	cache.Set("a", 3, time.Second*10)
+	close(release)
+	assert.True(waitRefresh(cache, "a"))
+	val, _ := cache.Get("a")
+	assert.Equal(3, val)
+}
@@ -0,0 +1,161 @@
+package v4
+
+import "sync"
+
+// MaxRemovalQueue OnEvict等待通知的删除的最大个数，回调太慢、队列已满时丢弃新的通知，计入Stats.Dropped
+// 删除元素时持有cache的锁，不能等待回调，否则在回调中调用cache的方法会死锁
+const MaxRemovalQueue = 1 << 16
+
+// RemovalReason 元素被删除的原因
+type RemovalReason int
+
+const (
+	ReasonCapacity RemovalReason = iota // 内存不足被淘汰
+	ReasonExpired                       // 过期
+	ReasonExplicit                      // 调用Del删除
+	ReasonReplaced                      // 被Set写入的新值替换
+	ReasonFlushed                       // Flush或者Close清空
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonExpired:
+		return "expired"
+	case ReasonExplicit:
+		return "explicit"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonFlushed:
+		return "flushed"
+	}
+	return "unknown"
+}
+
+// 一次等待通知的删除
+type removal[K comparable, V any] struct {
+	key    K
+	val    V
+	reason RemovalReason
+}
+
+// 在单独的goroutine中按删除的顺序调用OnEvict注册的回调
+// 删除元素时持有cache的锁，只把记录加入队列，回调中可以调用cache的方法
+type dispatcher[K comparable, V any] struct {
+	l      sync.Mutex
+	fn     func(key K, val V, reason RemovalReason)
+	queue  []removal[K, V]
+	notify chan struct{}
+	stopCh chan struct{}
+	done   chan struct{} // goroutine退出后关闭
+	// 还没有调用回调的删除，包括已经取出、正在通知的
+	pending int
+}
+
+func newDispatcher[K comparable, V any](fn func(key K, val V, reason RemovalReason)) *dispatcher[K, V] {
+	d := &dispatcher[K, V]{
+		fn:     fn,
+		notify: make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher[K, V]) setFunc(fn func(key K, val V, reason RemovalReason)) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.fn = fn
+}
+
+// 加入队列，队列已满时丢弃并返回false
+func (d *dispatcher[K, V]) push(key K, val V, reason RemovalReason) bool {
+	d.l.Lock()
+	if d.fn == nil {
+		d.l.Unlock()
+		return true
+	}
+	if d.pending >= MaxRemovalQueue {
+		d.l.Unlock()
+		return false
+	}
+	d.queue = append(d.queue, removal[K, V]{key, val, reason})
+	d.pending++
+	d.l.Unlock()
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (d *dispatcher[K, V]) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.notify:
+			d.dispatch()
+		case <-d.stopCh:
+			// 通知剩余的删除
+			d.dispatch()
+			return
+		}
+	}
+}
+
+// 调用回调，直到队列为空
+func (d *dispatcher[K, V]) dispatch() {
+	for {
+		d.l.Lock()
+		queue, fn := d.queue, d.fn
+		d.queue = nil
+		d.l.Unlock()
+		if len(queue) == 0 {
+			return
+		}
+		for i, r := range queue {
+			if fn != nil {
+				fn(r.key, r.val, r.reason)
+			}
+			// 不再引用已经删除的元素
+			queue[i] = removal[K, V]{}
+			d.l.Lock()
+			d.pending--
+			d.l.Unlock()
+		}
+	}
+}
+
+// 通知完队列中剩余的删除后退出
+func (d *dispatcher[K, V]) stop() {
+	close(d.stopCh)
+	<-d.done
+}
+
+// OnEvict 注册元素被删除时的回调，只有一个回调，重复调用时替换之前的回调，fn为nil时不再通知
+// 回调在单独的goroutine中按删除的顺序调用，不持有cache的锁，可以调用cache的方法，但不能调用Close
+// Close清空的元素以ReasonFlushed通知，Close返回前所有回调都已经执行完
+// 等待通知的删除超过MaxRemovalQueue时丢弃新的通知，计入Stats.Dropped
+func (c *lruCache[K, V]) OnEvict(fn func(key K, val V, reason RemovalReason)) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.isClosed() {
+		return
+	}
+	if c.evicted == nil {
+		if fn != nil {
+			c.evicted = newDispatcher(fn)
+		}
+		return
+	}
+	c.evicted.setFunc(fn)
+}
+
+// 通知元素被删除，必须持有写锁
+func (c *lruCache[K, V]) notifyRemoval(e *elem[K, V], reason RemovalReason) {
+	if c.evicted != nil && !c.evicted.push(e.key, e.val, reason) {
+		c.stats.add(0, statDropped, 1)
+	}
+}
@@ -0,0 +1,149 @@
+package v4
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录OnEvict的回调
+type removals struct {
+	l sync.Mutex
+	m map[string]RemovalReason
+}
+
+func (r *removals) add(key string, val int, reason RemovalReason) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.m[key] = reason
+}
+
+// 等待key被删除，返回删除的原因
+func (r *removals) wait(key string) (RemovalReason, bool) {
+	for i := 0; i < 100; i++ {
+		r.l.Lock()
+		reason, ok := r.m[key]
+		r.l.Unlock()
+		if ok {
+			return reason, true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return 0, false
+}
+
+func TestOnEvict(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t,
+		WithClock(clock),
+		WithGCPeriod(MinGCPeriod),
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val int) int { return 100 }),
+	)
+	r := &removals{m: make(map[string]RemovalReason)}
+	cache.OnEvict(r.add)
+
+	cache.Set("capacity", 1, 0)
+	for i := 0; i < 10; i++ {
+		cache.Set(string(rune('a'+i)), i, 0)
+	}
+	reason, ok := r.wait("capacity")
+	assert.True(ok)
+	assert.Equal(ReasonCapacity, reason)
+
+	cache.Set("a", 100, 0)
+	reason, _ = r.wait("a")
+	assert.Equal(ReasonReplaced, reason)
+
+	cache.Del("b")
+	reason, _ = r.wait("b")
+	assert.Equal(ReasonExplicit, reason)
+
+	cache.Set("expired", 1, time.Second)
+	clock.Advance(MinGCPeriod * 2)
+	lockedGC(cache)
+	reason, _ = r.wait("expired")
+	assert.Equal(ReasonExpired, reason)
+	cache.Expire("c", -1)
+	reason, _ = r.wait("c")
+	assert.Equal(ReasonExpired, reason)
+	// 已经过期、还没有被回收的元素被替换时按过期通知
+	cache.Set("late", 1, time.Second)
+	expirations := cache.Stats().Expirations
+	clock.Advance(time.Second * 2)
+	cache.Set("late", 2, 0)
+	reason, _ = r.wait("late")
+	assert.Equal(ReasonExpired, reason)
+	assert.Equal(expirations+1, cache.Stats().Expirations)
+
+	cache.Flush()
+	reason, _ = r.wait("d")
+	assert.Equal(ReasonFlushed, reason)
+
+	// 取消回调后不再通知
+	cache.OnEvict(nil)
+	cache.Set("z", 1, 0)
+	cache.Del("z")
+	_, ok = r.wait("z")
+	assert.False(ok)
+}
+
+// 回调中可以调用cache的方法，Close返回前所有回调都已经执行完
+func TestOnEvictReentrant(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	var (
+		l    sync.Mutex
+		keys []string
+	)
+	cache.OnEvict(func(key string, val int, reason RemovalReason) {
+		if reason == ReasonExplicit {
+			cache.Set(key+"-copy", val, 0)
+		}
+		l.Lock()
+		keys = append(keys, key)
+		l.Unlock()
+	})
+	cache.Set("a", 1, 0)
+	cache.Del("a")
+	for i := 0; i < 100 && !cache.Exists("a-copy"); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(cache.Exists("a-copy"))
+	assert.Nil(cache.Close())
+	l.Lock()
+	assert.Equal([]string{"a", "a-copy"}, keys)
+	l.Unlock()
+}
+
+// 回调太慢时等待通知的删除不超过MaxRemovalQueue，多出的通知被丢弃并计数
+func TestOnEvictDropped(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[int, int]()
+	release := make(chan struct{})
+	var calls int32
+	cache.OnEvict(func(key int, val int, reason RemovalReason) {
+		<-release
+		atomic.AddInt32(&calls, 1)
+	})
+	n := MaxRemovalQueue + 10
+	for i := 0; i < n; i++ {
+		cache.Set(i, i, 0)
+		cache.Del(i)
+	}
+	assert.Equal(int64(10), cache.Stats().Dropped)
+	close(release)
+	assert.Nil(cache.Close())
+	assert.Equal(int32(MaxRemovalQueue), atomic.LoadInt32(&calls))
+}
+
+func TestRemovalReasonString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("capacity", ReasonCapacity.String())
+	assert.Equal("flushed", ReasonFlushed.String())
+	assert.Equal("unknown", RemovalReason(100).String())
+}
@@ -0,0 +1,1026 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v4 "cache/v4"
+)
+
+// Item memcached中的值，Flags由客户端设置，原样返回
+type Item struct {
+	Flags uint32
+	Value []byte
+}
+
+const (
+	MaxKeyLen = 250 // key的最大长度，与memcached相同
+	// exptime不超过30天时是相对的秒数，否则是unix时间戳
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	memcacheVersion    = "1.6.0"
+)
+
+// 写入方式，与meta命令ms的M flag相同
+const (
+	modeSet     = 'S'
+	modeAdd     = 'E'
+	modeReplace = 'R'
+	modeAppend  = 'A'
+	modePrepend = 'P'
+)
+
+// 写入、incr、decr的结果
+type result int
+
+const (
+	resStored result = iota
+	resNotStored
+	resExists   // cas的版本号不匹配
+	resNotFound // cas、incr、decr的key不存在
+	resNonNumeric
+)
+
+// stats中按命令统计的计数器
+const (
+	mcCmdGet = iota
+	mcCmdSet
+	mcCmdFlush
+	mcCmdTouch
+	mcGetHits
+	mcGetMisses
+	mcDeleteMisses
+	mcDeleteHits
+	mcIncrMisses
+	mcIncrHits
+	mcDecrMisses
+	mcDecrHits
+	mcCasMisses
+	mcCasHits
+	mcCasBadval
+	mcTouchHits
+	mcTouchMisses
+	mcStatCount
+)
+
+var mcStatNames = [mcStatCount]string{
+	"cmd_get", "cmd_set", "cmd_flush", "cmd_touch",
+	"get_hits", "get_misses",
+	"delete_misses", "delete_hits",
+	"incr_misses", "incr_hits",
+	"decr_misses", "decr_hits",
+	"cas_misses", "cas_hits", "cas_badval",
+	"touch_hits", "touch_misses",
+}
+
+// MemcacheServer 以memcached的文本协议和meta命令对外提供cache
+// CAS使用cache中元素的版本号，add、replace、append、incr等修改通过CompareAndSet完成，不需要额外的锁
+// Close只关闭监听和连接，不关闭cache
+type MemcacheServer struct {
+	cache Backend[Item]
+	start time.Time
+	conns tracker
+	stats [mcStatCount]int64 // 原子操作
+	// stats reset时cache的Stats，cache的计数器由所有使用者共享，不清零，输出时减去base
+	bl   sync.Mutex
+	base v4.Stats
+	// flush_all延迟清空的定时器
+	fl         sync.Mutex
+	flushTimer *time.Timer
+}
+
+func NewMemcache(cache Backend[Item]) *MemcacheServer {
+	return &MemcacheServer{
+		cache: cache,
+		start: time.Now(),
+		conns: newTracker(),
+	}
+}
+
+// ListenAndServe 监听addr并处理连接，直到Close
+func (m *MemcacheServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(l)
+}
+
+// Serve 处理l上的连接，每个连接一个goroutine，返回时关闭l
+// Close之后返回ErrServerClosed
+func (m *MemcacheServer) Serve(l net.Listener) error {
+	return m.conns.serve(l, m.serveConn)
+}
+
+// Close 关闭所有监听和连接，取消flush_all的延迟清空，重复调用返回ErrServerClosed
+func (m *MemcacheServer) Close() error {
+	m.fl.Lock()
+	if m.flushTimer != nil {
+		m.flushTimer.Stop()
+		m.flushTimer = nil
+	}
+	m.fl.Unlock()
+	return m.conns.close()
+}
+
+// 一个客户端连接
+type mcConn struct {
+	r    *bufio.Reader
+	w    *bufio.Writer
+	quit bool
+}
+
+// noreply为true时不回复
+func (c *mcConn) reply(noreply bool, s string) {
+	if !noreply {
+		c.w.WriteString(s)
+		c.w.WriteString("\r\n")
+	}
+}
+
+func (m *MemcacheServer) serveConn(conn net.Conn) {
+	c := &mcConn{
+		r: bufio.NewReaderSize(conn, maxInlineLn),
+		w: bufio.NewWriter(conn),
+	}
+	for !c.quit {
+		line, err := readLine(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.reply(false, "CLIENT_ERROR line too long")
+				c.w.Flush()
+			}
+			return
+		}
+		// 数据块过大或者读取失败时连接无法继续使用
+		if err := m.exec(c, strings.Fields(string(line))); err != nil {
+			c.w.Flush()
+			return
+		}
+		// 流水线中的命令都处理完后再发送回复
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *MemcacheServer) exec(c *mcConn, args []string) error {
+	if len(args) == 0 {
+		c.reply(false, "ERROR")
+		return nil
+	}
+	switch cmd := args[0]; cmd {
+	case "get", "gets":
+		m.get(c, args[1:], cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return m.storage(c, cmd, args[1:])
+	case "delete":
+		m.delete(c, args[1:])
+	case "incr", "decr":
+		m.incr(c, cmd == "decr", args[1:])
+	case "touch":
+		m.touch(c, args[1:])
+	case "flush_all":
+		m.flushAll(c, args[1:])
+	case "stats":
+		m.writeStats(c, args[1:])
+	case "version":
+		c.reply(false, "VERSION "+memcacheVersion)
+	case "verbosity":
+		c.reply(hasNoreply(args[1:]), "OK")
+	case "quit":
+		c.quit = true
+	case "mg":
+		m.metaGet(c, args[1:])
+	case "ms":
+		return m.metaSet(c, args[1:])
+	case "md":
+		m.metaDelete(c, args[1:])
+	case "ma":
+		m.metaArithmetic(c, args[1:])
+	case "mn":
+		c.reply(false, "MN")
+	default:
+		c.reply(false, "ERROR")
+	}
+	return nil
+}
+
+func (m *MemcacheServer) count(i int) {
+	atomic.AddInt64(&m.stats[i], 1)
+}
+
+func hasNoreply(args []string) bool {
+	return len(args) > 0 && args[len(args)-1] == "noreply"
+}
+
+// 与memcached相同，key不能包含空白和控制字符
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// memcached的exptime：0表示永不过期，负数表示立即过期，不超过30天时是相对的秒数，否则是unix时间戳
+// 返回Set的有效期，已经过期时返回-1
+func expireDuration(exptime int64, now time.Time) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= maxRelativeExptime:
+		return time.Duration(exptime) * time.Second
+	}
+	d := time.Unix(exptime, 0).Sub(now)
+	if d <= 0 {
+		return -1
+	}
+	return d
+}
+
+func parseExptime(s string) (time.Duration, bool) {
+	exptime, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return expireDuration(exptime, time.Now()), true
+}
+
+func serverError(err error) string {
+	if errors.Is(err, v4.ErrTooLarge) {
+		return "SERVER_ERROR object too large for cache"
+	}
+	return "SERVER_ERROR " + err.Error()
+}
+
+// 数据块超过cache的最大内存时不分配内存，丢弃数据块并回复错误，连接可以继续使用，与memcached的item大小限制相同
+// 超过MaxBulkLen时不再读取，返回error关闭连接
+func (m *MemcacheServer) skipLarge(c *mcConn, size int) (bool, error) {
+	if size > MaxBulkLen {
+		c.reply(false, "SERVER_ERROR object too large for cache")
+		return true, errors.New("数据块过大")
+	}
+	// 最大内存不会小于MinMemory，小的数据块不需要读取Stats
+	if size <= v4.MinMemory || size <= m.cache.Stats().MaxMemory {
+		return false, nil
+	}
+	if _, err := c.r.Discard(size + 2); err != nil {
+		return true, err
+	}
+	c.reply(false, "SERVER_ERROR object too large for cache")
+	return true, nil
+}
+
+// 读取长度为n的数据块和结尾的\r\n，数据块长度不对时丢弃这一行剩下的内容
+func readData(r *bufio.Reader, n int) ([]byte, bool, error) {
+	b, err := readFull(r, n+2)
+	if err != nil {
+		return nil, false, err
+	}
+	if b[n] == '\r' && b[n+1] == '\n' {
+		return b[:n], true, nil
+	}
+	if b[n+1] != '\n' {
+		if _, err := r.ReadSlice('\n'); err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, false, err
+		}
+	}
+	return nil, false, nil
+}
+
+// get <key>*、gets <key>*
+func (m *MemcacheServer) get(c *mcConn, keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		c.reply(false, "ERROR")
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			c.reply(false, "CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+	for _, key := range keys {
+		m.count(mcCmdGet)
+		it, version, ok := m.cache.GetVersion(key)
+		if !ok {
+			m.count(mcGetMisses)
+			continue
+		}
+		m.count(mcGetHits)
+		if withCAS {
+			fmt.Fprintf(c.w, "VALUE %s %d %d %d\r\n", key, it.Flags, len(it.Value), version)
+		} else {
+			fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", key, it.Flags, len(it.Value))
+		}
+		c.w.Write(it.Value)
+		c.w.WriteString("\r\n")
+	}
+	c.reply(false, "END")
+}
+
+// <command> <key> <flags> <exptime> <bytes> [noreply]
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (m *MemcacheServer) storage(c *mcConn, cmd string, args []string) error {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	noreply := hasNoreply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != n {
+		c.reply(false, "ERROR")
+		return nil
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if skip, err := m.skipLarge(c, size); skip {
+		return err
+	}
+	data, ok, err := readData(c.r, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.reply(false, "CLIENT_ERROR bad data chunk")
+		return nil
+	}
+	flags, ferr := strconv.ParseUint(args[1], 10, 32)
+	d, eok := parseExptime(args[2])
+	var cas uint64
+	var cerr error
+	if cmd == "cas" {
+		cas, cerr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validKey(args[0]) || ferr != nil || !eok || cerr != nil {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return nil
+	}
+	m.count(mcCmdSet)
+	mode := map[string]byte{
+		"set": modeSet, "add": modeAdd, "replace": modeReplace,
+		"append": modeAppend, "prepend": modePrepend, "cas": modeSet,
+	}[cmd]
+	res, _, err := m.store(mode, args[0], Item{Flags: uint32(flags), Value: data}, d, cas, cmd == "cas", false)
+	if cmd == "cas" {
+		switch res {
+		case resStored:
+			m.count(mcCasHits)
+		case resExists:
+			m.count(mcCasBadval)
+		case resNotFound:
+			m.count(mcCasMisses)
+		}
+	}
+	if err != nil {
+		c.reply(noreply, serverError(err))
+		return nil
+	}
+	c.reply(noreply, [...]string{"STORED", "NOT_STORED", "EXISTS", "NOT_FOUND"}[res])
+	return nil
+}
+
+// 按mode写入，d<0表示已经过期，等同于删除
+// hasCAS为true时只在版本号等于cas时写入，版本号不匹配时返回resExists，key不存在时返回resNotFound
+// 除了不需要版本号的set，都先读取当前的版本号，再通过CompareAndSet写入，其他连接同时修改时重试
+// needVersion为true时返回写入后的版本号
+func (m *MemcacheServer) store(mode byte, key string, it Item, d time.Duration, cas uint64, hasCAS, needVersion bool) (result, uint64, error) {
+	if mode == modeSet && !hasCAS && !needVersion {
+		if d < 0 {
+			m.cache.Del(key)
+			return resStored, 0, nil
+		}
+		return resStored, 0, m.cache.TrySet(key, it, d)
+	}
+	for {
+		old, version, ok := m.cache.GetVersion(key)
+		switch {
+		case hasCAS && !ok:
+			return resNotFound, 0, nil
+		case hasCAS && version != cas:
+			return resExists, 0, nil
+		case mode == modeAdd && ok:
+			return resNotStored, 0, nil
+		case mode != modeSet && mode != modeAdd && !ok:
+			return resNotStored, 0, nil
+		}
+		val, expire := it, d
+		if mode == modeAppend || mode == modePrepend {
+			// 保留原来的flags和有效期，读取之后有效期被修改时版本号改变，CompareAndSet失败后重试
+			remaining, ok := m.remaining(key)
+			if !ok {
+				return resNotStored, 0, nil
+			}
+			val.Flags, expire = old.Flags, remaining
+			val.Value = make([]byte, 0, len(old.Value)+len(it.Value))
+			if mode == modeAppend {
+				val.Value = append(append(val.Value, old.Value...), it.Value...)
+			} else {
+				val.Value = append(append(val.Value, it.Value...), old.Value...)
+			}
+		}
+		var newVersion uint64
+		var err error
+		if expire < 0 {
+			_, err = m.cache.CompareAndDelete(key, version)
+		} else {
+			newVersion, err = m.cache.CompareAndSet(key, val, expire, version)
+		}
+		if errors.Is(err, v4.ErrVersion) {
+			if hasCAS {
+				return resExists, 0, nil
+			}
+			continue
+		}
+		return resStored, newVersion, err
+	}
+}
+
+// 修改值时保留有效期，永不过期时返回0，key不存在或者已经过期时返回false
+func (m *MemcacheServer) remaining(key string) (time.Duration, bool) {
+	d, ok := m.cache.TTL(key)
+	switch {
+	case !ok || d == 0:
+		return 0, false
+	case d == v4.NoExpire:
+		return 0, true
+	}
+	return d, true
+}
+
+// delete <key> [0] [noreply]
+func (m *MemcacheServer) delete(c *mcConn, args []string) {
+	noreply := hasNoreply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 || !validKey(args[0]) {
+		c.reply(false, "CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+	if m.cache.Del(args[0]) {
+		m.count(mcDeleteHits)
+		c.reply(noreply, "DELETED")
+		return
+	}
+	m.count(mcDeleteMisses)
+	c.reply(noreply, "NOT_FOUND")
+}
+
+// incr、decr和ma的参数
+type arithReq struct {
+	key       string
+	delta     uint64
+	decr      bool
+	cas       uint64
+	hasCAS    bool
+	vivify    bool          // key不存在时写入initial
+	initial   uint64        // vivify时写入的值
+	vivifyTTL time.Duration // vivify时的有效期
+	ttl       time.Duration // hasTTL时修改有效期，否则保留原来的有效期
+	hasTTL    bool
+}
+
+// incr在64位溢出时回绕，decr最小为0，保留原来的flags和有效期
+// 返回修改后的值和版本号
+func (m *MemcacheServer) arith(a *arithReq) (uint64, uint64, result, error) {
+	for {
+		it, version, ok := m.cache.GetVersion(a.key)
+		if !ok {
+			if !a.vivify || a.hasCAS {
+				return 0, 0, resNotFound, nil
+			}
+			val := Item{Value: []byte(strconv.FormatUint(a.initial, 10))}
+			newVersion, err := m.cache.CompareAndSet(a.key, val, a.vivifyTTL, 0)
+			if errors.Is(err, v4.ErrVersion) {
+				continue
+			}
+			return a.initial, newVersion, resStored, err
+		}
+		if a.hasCAS && version != a.cas {
+			return 0, 0, resExists, nil
+		}
+		n, err := strconv.ParseUint(strings.TrimRight(string(it.Value), " "), 10, 64)
+		if err != nil {
+			return 0, 0, resNonNumeric, nil
+		}
+		switch {
+		case !a.decr:
+			n += a.delta
+		case n > a.delta:
+			n -= a.delta
+		default:
+			n = 0
+		}
+		expire := a.ttl
+		if !a.hasTTL {
+			if expire, ok = m.remaining(a.key); !ok {
+				return 0, 0, resNotFound, nil
+			}
+		}
+		it.Value = []byte(strconv.FormatUint(n, 10))
+		newVersion, err := m.cache.CompareAndSet(a.key, it, expire, version)
+		if errors.Is(err, v4.ErrVersion) {
+			if a.hasCAS {
+				return 0, 0, resExists, nil
+			}
+			continue
+		}
+		return n, newVersion, resStored, err
+	}
+}
+
+// incr|decr <key> <value> [noreply]
+func (m *MemcacheServer) incr(c *mcConn, decr bool, args []string) {
+	noreply := hasNoreply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 || !validKey(args[0]) {
+		c.reply(false, "ERROR")
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.reply(false, "CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	n, _, res, err := m.arith(&arithReq{key: args[0], delta: delta, decr: decr})
+	hit, miss := mcIncrHits, mcIncrMisses
+	if decr {
+		hit, miss = mcDecrHits, mcDecrMisses
+	}
+	switch {
+	case err != nil:
+		c.reply(noreply, serverError(err))
+	case res == resNotFound:
+		m.count(miss)
+		c.reply(noreply, "NOT_FOUND")
+	case res == resNonNumeric:
+		c.reply(false, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	default:
+		m.count(hit)
+		c.reply(noreply, strconv.FormatUint(n, 10))
+	}
+}
+
+// touch <key> <exptime> [noreply]
+func (m *MemcacheServer) touch(c *mcConn, args []string) {
+	noreply := hasNoreply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 || !validKey(args[0]) {
+		c.reply(false, "ERROR")
+		return
+	}
+	d, ok := parseExptime(args[1])
+	if !ok {
+		c.reply(false, "CLIENT_ERROR invalid exptime argument")
+		return
+	}
+	m.count(mcCmdTouch)
+	// d<0时删除key
+	if m.cache.Expire(args[0], d) {
+		m.count(mcTouchHits)
+		c.reply(noreply, "TOUCHED")
+		return
+	}
+	m.count(mcTouchMisses)
+	c.reply(noreply, "NOT_FOUND")
+}
+
+// flush_all [delay] [noreply]，delay的含义同exptime
+func (m *MemcacheServer) flushAll(c *mcConn, args []string) {
+	noreply := hasNoreply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	var d time.Duration
+	switch len(args) {
+	case 0:
+	case 1:
+		var ok bool
+		if d, ok = parseExptime(args[0]); !ok {
+			c.reply(false, "CLIENT_ERROR bad command line format")
+			return
+		}
+	default:
+		c.reply(false, "ERROR")
+		return
+	}
+	m.count(mcCmdFlush)
+	m.fl.Lock()
+	if m.flushTimer != nil {
+		m.flushTimer.Stop()
+		m.flushTimer = nil
+	}
+	if d <= 0 {
+		m.cache.Flush()
+	} else {
+		m.flushTimer = time.AfterFunc(d, func() { m.cache.Flush() })
+	}
+	m.fl.Unlock()
+	c.reply(noreply, "OK")
+}
+
+// stats、stats reset
+// 命令的次数由server统计，元素个数、内存、淘汰次数等来自cache的Stats
+// stats reset只清零server的计数器，cache的计数器记录为base，之后输出与base的差
+func (m *MemcacheServer) writeStats(c *mcConn, args []string) {
+	if len(args) == 1 && args[0] == "reset" {
+		for i := range m.stats {
+			atomic.StoreInt64(&m.stats[i], 0)
+		}
+		m.bl.Lock()
+		m.base = m.cache.Stats()
+		m.bl.Unlock()
+		c.reply(false, "RESET")
+		return
+	}
+	if len(args) != 0 {
+		c.reply(false, "ERROR")
+		return
+	}
+	st := m.cache.Stats()
+	m.bl.Lock()
+	base := m.base
+	m.bl.Unlock()
+	stat := func(name string, val interface{}) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, val)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(time.Since(m.start)/time.Second))
+	stat("time", time.Now().Unix())
+	stat("version", memcacheVersion)
+	stat("curr_connections", m.conns.count())
+	stat("total_connections", m.conns.total())
+	for i, name := range mcStatNames {
+		stat(name, atomic.LoadInt64(&m.stats[i]))
+	}
+	stat("curr_items", st.Keys)
+	stat("total_items", since(st.Sets, base.Sets))
+	stat("bytes", st.MemoryUsed)
+	stat("limit_maxbytes", st.MaxMemory)
+	stat("evictions", since(st.Evictions, base.Evictions))
+	stat("expired", since(st.Expirations, base.Expirations))
+	c.reply(false, "END")
+}
+
+// 计数器从base开始的增量，cache的计数器被其他使用者清零过时小于base，返回当前值
+func since(cur, base int64) int64 {
+	if cur < base {
+		return cur
+	}
+	return cur - base
+}
+
+// meta命令的一个flag，token是flag后面的内容
+type metaFlag struct {
+	flag  byte
+	token string
+}
+
+// meta命令的key和flag，rawKey是请求中的key，b flag时key是base64解码后的内容
+type metaReq struct {
+	key    string
+	rawKey string
+	flags  []metaFlag
+}
+
+// 解析key和flag，allowed是命令支持的flag
+func parseMeta(key string, args []string, allowed string) (*metaReq, string) {
+	r := &metaReq{key: key, rawKey: key}
+	for _, arg := range args {
+		if !strings.ContainsRune(allowed, rune(arg[0])) {
+			return nil, "CLIENT_ERROR invalid flag"
+		}
+		r.flags = append(r.flags, metaFlag{flag: arg[0], token: arg[1:]})
+	}
+	if r.has('b') {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(b) == 0 || len(b) > MaxKeyLen {
+			return nil, "CLIENT_ERROR error decoding key"
+		}
+		r.key = string(b)
+	} else if !validKey(key) {
+		return nil, "CLIENT_ERROR bad command line format"
+	}
+	return r, ""
+}
+
+func (r *metaReq) has(f byte) bool {
+	_, ok := r.token(f)
+	return ok
+}
+
+func (r *metaReq) token(f byte) (string, bool) {
+	for _, mf := range r.flags {
+		if mf.flag == f {
+			return mf.token, true
+		}
+	}
+	return "", false
+}
+
+// 按请求中的顺序返回flag，b、k、O原样返回，其他flag的值在values中
+func (r *metaReq) ret(values map[byte]string) string {
+	var b strings.Builder
+	for _, mf := range r.flags {
+		var s string
+		switch mf.flag {
+		case 'b':
+			s = "b"
+		case 'k':
+			s = "k" + r.rawKey
+		case 'O':
+			s = "O" + mf.token
+		default:
+			v, ok := values[mf.flag]
+			if !ok {
+				continue
+			}
+			s = string(mf.flag) + v
+		}
+		b.WriteByte(' ')
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// 剩余有效期的秒数，永不过期时为-1
+func (m *MemcacheServer) ttlToken(key string) string {
+	d, ok := m.cache.TTL(key)
+	if !ok || d == v4.NoExpire {
+		return "-1"
+	}
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// 解析flag中的数字
+func metaUint(r *metaReq, f byte, def uint64) (uint64, bool) {
+	tok, ok := r.token(f)
+	if !ok {
+		return def, true
+	}
+	n, err := strconv.ParseUint(tok, 10, 64)
+	return n, err == nil
+}
+
+func metaTTL(r *metaReq, f byte) (time.Duration, bool, bool) {
+	tok, ok := r.token(f)
+	if !ok {
+		return 0, false, true
+	}
+	d, valid := parseExptime(tok)
+	return d, true, valid
+}
+
+// mg <key> <flag>*
+// 支持b、c、f、k、O、q、s、t、v、T，q时不返回EN
+func (m *MemcacheServer) metaGet(c *mcConn, args []string) {
+	if len(args) == 0 {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	r, msg := parseMeta(args[0], args[1:], "bcfkOqstvT")
+	if msg != "" {
+		c.reply(false, msg)
+		return
+	}
+	d, touch, ok := metaTTL(r, 'T')
+	if !ok {
+		c.reply(false, "CLIENT_ERROR bad token in command line format")
+		return
+	}
+	// 先修改有效期，返回的版本号是修改之后的
+	if touch {
+		m.count(mcCmdTouch)
+		if m.cache.Expire(r.key, d) {
+			m.count(mcTouchHits)
+		} else {
+			m.count(mcTouchMisses)
+		}
+	}
+	m.count(mcCmdGet)
+	it, version, ok := m.cache.GetVersion(r.key)
+	if !ok {
+		m.count(mcGetMisses)
+		c.reply(r.has('q'), "EN")
+		return
+	}
+	m.count(mcGetHits)
+	values := map[byte]string{
+		'c': strconv.FormatUint(version, 10),
+		'f': strconv.FormatUint(uint64(it.Flags), 10),
+		's': strconv.Itoa(len(it.Value)),
+	}
+	if r.has('t') {
+		values['t'] = m.ttlToken(r.key)
+	}
+	if !r.has('v') {
+		c.reply(false, "HD"+r.ret(values))
+		return
+	}
+	c.reply(false, "VA "+strconv.Itoa(len(it.Value))+r.ret(values))
+	c.w.Write(it.Value)
+	c.w.WriteString("\r\n")
+}
+
+// ms <key> <datalen> <flag>*
+// 支持b、c、C、F、k、O、q、T、M，M为E(add)、A(append)、P(prepend)、R(replace)、S(set，默认)
+// 返回HD、NS、EX、NF，q时不返回HD
+func (m *MemcacheServer) metaSet(c *mcConn, args []string) error {
+	if len(args) < 2 {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return nil
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 {
+		c.reply(false, "CLIENT_ERROR bad data chunk")
+		return nil
+	}
+	if skip, err := m.skipLarge(c, size); skip {
+		return err
+	}
+	data, ok, err := readData(c.r, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		c.reply(false, "CLIENT_ERROR bad data chunk")
+		return nil
+	}
+	r, msg := parseMeta(args[0], args[2:], "bcCFkOqTM")
+	if msg != "" {
+		c.reply(false, msg)
+		return nil
+	}
+	flags, fok := metaUint(r, 'F', 0)
+	cas, cok := metaUint(r, 'C', 0)
+	d, _, tvalid := metaTTL(r, 'T')
+	mode := byte(modeSet)
+	if tok, ok := r.token('M'); ok {
+		if len(tok) != 1 || !strings.Contains("EAPRS", strings.ToUpper(tok)) {
+			c.reply(false, "CLIENT_ERROR invalid mode for ms")
+			return nil
+		}
+		mode = strings.ToUpper(tok)[0]
+	}
+	if !fok || flags > 1<<32-1 || !cok || !tvalid {
+		c.reply(false, "CLIENT_ERROR bad token in command line format")
+		return nil
+	}
+	m.count(mcCmdSet)
+	res, version, err := m.store(mode, r.key, Item{Flags: uint32(flags), Value: data}, d, cas, r.has('C'), r.has('c'))
+	if err != nil {
+		c.reply(false, serverError(err))
+		return nil
+	}
+	ret := r.ret(nil)
+	switch res {
+	case resStored:
+		c.reply(r.has('q'), "HD"+r.ret(map[byte]string{'c': strconv.FormatUint(version, 10)}))
+	case resNotStored:
+		c.reply(false, "NS"+ret)
+	case resExists:
+		c.reply(false, "EX"+ret)
+	case resNotFound:
+		c.reply(false, "NF"+ret)
+	}
+	return nil
+}
+
+// md <key> <flag>*
+// 支持b、C、k、O、q，q时不返回HD、NF
+func (m *MemcacheServer) metaDelete(c *mcConn, args []string) {
+	if len(args) == 0 {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	r, msg := parseMeta(args[0], args[1:], "bCkOq")
+	if msg != "" {
+		c.reply(false, msg)
+		return
+	}
+	cas, ok := metaUint(r, 'C', 0)
+	if !ok {
+		c.reply(false, "CLIENT_ERROR bad token in command line format")
+		return
+	}
+	var deleted bool
+	var err error
+	if r.has('C') {
+		deleted, err = m.cache.CompareAndDelete(r.key, cas)
+	} else {
+		deleted = m.cache.Del(r.key)
+	}
+	ret := r.ret(nil)
+	switch {
+	case errors.Is(err, v4.ErrVersion):
+		c.reply(false, "EX"+ret)
+	case err != nil:
+		c.reply(false, serverError(err))
+	case deleted:
+		m.count(mcDeleteHits)
+		c.reply(r.has('q'), "HD"+ret)
+	default:
+		m.count(mcDeleteMisses)
+		c.reply(r.has('q'), "NF"+ret)
+	}
+}
+
+// ma <key> <flag>*
+// 支持b、c、C、D、J、k、M、N、O、q、t、T、v
+// M为I、+(incr，默认)或者D、-(decr)，D为增量，默认为1，N为key不存在时创建的有效期，J为创建时的初始值
+// 返回HD或者VA、NF、EX，q时不返回HD
+func (m *MemcacheServer) metaArithmetic(c *mcConn, args []string) {
+	if len(args) == 0 {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return
+	}
+	r, msg := parseMeta(args[0], args[1:], "bcCDJkMNOqtTv")
+	if msg != "" {
+		c.reply(false, msg)
+		return
+	}
+	a := &arithReq{key: r.key, hasCAS: r.has('C')}
+	var ok [5]bool
+	a.cas, ok[0] = metaUint(r, 'C', 0)
+	a.delta, ok[1] = metaUint(r, 'D', 1)
+	a.initial, ok[2] = metaUint(r, 'J', 0)
+	a.vivifyTTL, a.vivify, ok[3] = metaTTL(r, 'N')
+	a.ttl, a.hasTTL, ok[4] = metaTTL(r, 'T')
+	if tok, has := r.token('M'); has {
+		switch strings.ToUpper(tok) {
+		case "I", "+":
+		case "D", "-":
+			a.decr = true
+		default:
+			c.reply(false, "CLIENT_ERROR invalid mode for ma")
+			return
+		}
+	}
+	// 不支持立即过期的有效期
+	if ok != [5]bool{true, true, true, true, true} || a.vivifyTTL < 0 || a.ttl < 0 {
+		c.reply(false, "CLIENT_ERROR bad token in command line format")
+		return
+	}
+	n, version, res, err := m.arith(a)
+	hit, miss := mcIncrHits, mcIncrMisses
+	if a.decr {
+		hit, miss = mcDecrHits, mcDecrMisses
+	}
+	ret := r.ret(nil)
+	switch {
+	case err != nil:
+		c.reply(false, serverError(err))
+	case res == resNotFound:
+		m.count(miss)
+		c.reply(false, "NF"+ret)
+	case res == resExists:
+		c.reply(false, "EX"+ret)
+	case res == resNonNumeric:
+		c.reply(false, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	default:
+		m.count(hit)
+		values := map[byte]string{'c': strconv.FormatUint(version, 10)}
+		if r.has('t') {
+			values['t'] = m.ttlToken(r.key)
+		}
+		ret = r.ret(values)
+		if !r.has('v') {
+			c.reply(r.has('q'), "HD"+ret)
+			return
+		}
+		val := strconv.FormatUint(n, 10)
+		c.reply(false, "VA "+strconv.Itoa(len(val))+ret)
+		c.reply(false, val)
+	}
+}
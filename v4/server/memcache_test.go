@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	v4 "cache/v4"
+)
+
+// 通过loopback连接发送memcached命令的客户端
+type mcClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *mcClient) write(s string) {
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *mcClient) line() string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// 发送一条命令，读取一行回复
+func (c *mcClient) do(cmd string) string {
+	c.write(cmd + "\r\n")
+	return c.line()
+}
+
+// 读取到END为止的所有行
+func (c *mcClient) lines(cmd string) []string {
+	c.write(cmd + "\r\n")
+	var lines []string
+	for {
+		line := c.line()
+		if line == "END" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func newMemcacheServer(t *testing.T, opts ...v4.Option) (*MemcacheServer, Backend[Item], func() *mcClient) {
+	c, err := v4.New[string, Item](opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := c.(Backend[Item])
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewMemcache(cache)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Error(err)
+		}
+		cache.Close()
+	})
+	dial := func() *mcClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &mcClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+	return srv, cache, dial
+}
+
+func TestMemcacheStorage(t *testing.T) {
+	assert := assert.New(t)
+	_, cache, dial := newMemcacheServer(t)
+	c := dial()
+	assert.Equal("STORED", c.do("set a 5 0 3\r\nabc"))
+	it, _ := cache.Get("a")
+	assert.Equal(Item{Flags: 5, Value: []byte("abc")}, it)
+	assert.Equal([]string{"VALUE a 5 3", "abc"}, c.lines("get a"))
+	assert.Equal([]string{"VALUE a 5 3", "abc"}, c.lines("get none a none"))
+	assert.Empty(c.lines("get none"))
+	// 二进制安全
+	assert.Equal("STORED", c.do("set b 0 0 4\r\nx\r\ny"))
+	assert.Equal([]string{"VALUE b 0 4", "x", "y"}, c.lines("get b"))
+
+	assert.Equal("NOT_STORED", c.do("add a 0 0 1\r\nx"))
+	assert.Equal("STORED", c.do("add c 1 0 1\r\nc"))
+	assert.Equal("NOT_STORED", c.do("replace none 0 0 1\r\nx"))
+	assert.Equal("STORED", c.do("replace c 2 0 2\r\ncc"))
+	assert.Equal("NOT_STORED", c.do("append none 0 0 1\r\nx"))
+	// append、prepend保留原来的flags
+	assert.Equal("STORED", c.do("append a 9 0 2\r\nde"))
+	assert.Equal("STORED", c.do("prepend a 9 0 2\r\nxy"))
+	assert.Equal([]string{"VALUE a 5 7", "xyabcde", "VALUE c 2 2", "cc"}, c.lines("get a c"))
+
+	assert.Equal("DELETED", c.do("delete a"))
+	assert.Equal("NOT_FOUND", c.do("delete a"))
+	assert.Equal("DELETED", c.do("delete c 0"))
+
+	// noreply时没有回复
+	c.write("set d 0 0 1 noreply\r\nd\r\ndelete b noreply\r\n")
+	assert.Equal([]string{"VALUE d 0 1", "d"}, c.lines("get b d"))
+
+	assert.Equal("CLIENT_ERROR bad data chunk", c.do("set e 0 0 1\r\nxyz"))
+	assert.Equal("CLIENT_ERROR bad command line format", c.do("set e x 0 1\r\nx"))
+	assert.Equal("CLIENT_ERROR bad command line format", c.do("set "+strings.Repeat("k", MaxKeyLen+1)+" 0 0 1\r\nx"))
+	assert.Equal("ERROR", c.do("set e 0 0"))
+	assert.Equal("ERROR", c.do("foo"))
+	assert.Equal("ERROR", c.do("get"))
+	assert.Equal("VERSION "+memcacheVersion, c.do("version"))
+	assert.Equal("OK", c.do("verbosity 1"))
+	c.write("quit\r\n")
+	_, err := c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+
+	// 数据块超过最大内存时丢弃
+	_, _, dial = newMemcacheServer(t, v4.WithMaxMemory("1KB"))
+	c = dial()
+	assert.Equal("SERVER_ERROR object too large for cache", c.do("set big 0 0 2000\r\n"+strings.Repeat("x", 2000)))
+	assert.Equal("SERVER_ERROR object too large for cache", c.do("ms big 2000\r\n"+strings.Repeat("x", 2000)))
+	assert.Equal("STORED", c.do("set a 0 0 1\r\na"))
+
+	// 超过MaxBulkLen时关闭连接
+	c = dial()
+	assert.Equal("SERVER_ERROR object too large for cache", c.do("set big 0 0 "+strconv.Itoa(MaxBulkLen+1)))
+	_, err = c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+}
+
+// CAS使用cache中元素的版本号
+func TestMemcacheCAS(t *testing.T) {
+	assert := assert.New(t)
+	_, cache, dial := newMemcacheServer(t)
+	c := dial()
+	assert.Equal("NOT_FOUND", c.do("cas a 0 0 1 1\r\nx"))
+	c.do("set a 0 0 1\r\na")
+	lines := c.lines("gets a")
+	_, version, _ := cache.GetVersion("a")
+	cas := strconv.FormatUint(version, 10)
+	assert.Equal([]string{"VALUE a 0 1 " + cas, "a"}, lines)
+
+	// 其他连接修改后版本号改变
+	other := dial()
+	assert.Equal("STORED", other.do("set a 0 0 1\r\nb"))
+	assert.Equal("EXISTS", c.do("cas a 0 0 1 "+cas+"\r\nx"))
+	fields := strings.Fields(c.lines("gets a")[0])
+	cas = fields[4]
+	assert.Equal("STORED", c.do("cas a 3 0 1 "+cas+"\r\nx"))
+	assert.Equal("EXISTS", other.do("cas a 0 0 1 "+cas+"\r\ny"))
+	assert.Equal([]string{"VALUE a 3 1", "x"}, c.lines("get a"))
+	// touch改变版本号，之前读取的值不能覆盖有效期的修改
+	fields = strings.Fields(c.lines("gets a")[0])
+	assert.Equal("TOUCHED", c.do("touch a 100"))
+	assert.Equal("EXISTS", c.do("cas a 0 0 1 "+fields[4]+"\r\nz"))
+	fields = strings.Fields(c.lines("gets a")[0])
+	assert.Equal("STORED", c.do("cas a 0 0 1 "+fields[4]+"\r\nz"))
+	assert.Equal("CLIENT_ERROR bad command line format", c.do("cas a 0 0 1 x\r\nz"))
+
+	assert.Equal(int64(1), mcStat(c, "cas_misses"))
+	assert.Equal(int64(2), mcStat(c, "cas_hits"))
+	assert.Equal(int64(3), mcStat(c, "cas_badval"))
+}
+
+func TestMemcacheIncr(t *testing.T) {
+	assert := assert.New(t)
+	clock := v4.NewFakeClock(time.Now())
+	_, cache, dial := newMemcacheServer(t, v4.WithClock(clock))
+	c := dial()
+	assert.Equal("NOT_FOUND", c.do("incr a 1"))
+	c.do("set a 7 100 2\r\n10")
+	assert.Equal("15", c.do("incr a 5"))
+	assert.Equal("12", c.do("decr a 3"))
+	assert.Equal("0", c.do("decr a 100"))
+	// 64位溢出时回绕
+	c.do("set b 0 0 20\r\n18446744073709551615")
+	assert.Equal("1", c.do("incr b 2"))
+	// 保留flags和有效期
+	assert.Equal([]string{"VALUE a 7 1", "0"}, c.lines("get a"))
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*100, d)
+
+	c.do("set s 0 0 3\r\nabc")
+	assert.Equal("CLIENT_ERROR cannot increment or decrement non-numeric value", c.do("incr s 1"))
+	assert.Equal("CLIENT_ERROR invalid numeric delta argument", c.do("incr a -1"))
+	c.write("incr a 1 noreply\r\n")
+	assert.Equal([]string{"VALUE a 7 1", "1"}, c.lines("get a"))
+	assert.Equal(int64(3), mcStat(c, "incr_hits"))
+	assert.Equal(int64(1), mcStat(c, "incr_misses"))
+	assert.Equal(int64(2), mcStat(c, "decr_hits"))
+}
+
+// 多个连接同时incr，CompareAndSet失败时重试，不会丢失修改
+func TestMemcacheIncrConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	_, _, dial := newMemcacheServer(t)
+	c := dial()
+	c.do("set n 0 0 1\r\n0")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		cc := dial()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 不能在其他goroutine中调用t.Fatal
+			for j := 0; j < 100; j++ {
+				if _, err := io.WriteString(cc.conn, "incr n 1\r\n"); err != nil {
+					return
+				}
+				if _, err := cc.r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal([]string{"VALUE n 0 3", "800"}, c.lines("get n"))
+}
+
+func TestMemcacheExptime(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	clock := v4.NewFakeClock(now)
+	srv, cache, dial := newMemcacheServer(t, v4.WithClock(clock))
+	c := dial()
+	c.do("set a 0 10 1\r\na")
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*10, d)
+	c.do("set b 0 0 1\r\nb")
+	d, _ = cache.TTL("b")
+	assert.Equal(v4.NoExpire, d)
+	// 超过30天时是unix时间戳
+	c.do("set c 0 " + strconv.FormatInt(now.Unix()+100, 10) + " 1\r\nc")
+	d, _ = cache.TTL("c")
+	assert.InDelta(float64(time.Second*100), float64(d), float64(time.Second*2))
+	// 负数或者已经过去的时间戳立即过期
+	assert.Equal("STORED", c.do("set b 0 -1 1\r\nb"))
+	assert.False(cache.Exists("b"))
+	assert.Equal("STORED", c.do("set c 0 "+strconv.FormatInt(now.Unix()-maxRelativeExptime, 10)+" 1\r\nc"))
+	assert.False(cache.Exists("c"))
+	assert.Equal("STORED", c.do("add b 0 -1 1\r\nb"))
+	assert.False(cache.Exists("b"))
+	_, version, _ := cache.GetVersion("a")
+	assert.Equal("STORED", c.do("cas a 0 -1 1 "+strconv.FormatUint(version, 10)+"\r\na"))
+	assert.False(cache.Exists("a"))
+
+	c.do("set a 0 10 1\r\na")
+	clock.Advance(time.Second * 10)
+	assert.Empty(c.lines("get a"))
+
+	c.do("set a 0 10 1\r\na")
+	assert.Equal("TOUCHED", c.do("touch a 0"))
+	d, _ = cache.TTL("a")
+	assert.Equal(v4.NoExpire, d)
+	assert.Equal("TOUCHED", c.do("touch a 5"))
+	d, _ = cache.TTL("a")
+	assert.Equal(time.Second*5, d)
+	assert.Equal("TOUCHED", c.do("touch a -1"))
+	assert.Equal("NOT_FOUND", c.do("touch a 5"))
+
+	c.do("set a 0 0 1\r\na")
+	// 延迟清空，Close时取消
+	assert.Equal("OK", c.do("flush_all 100"))
+	assert.True(cache.Exists("a"))
+	assert.Equal("OK", c.do("flush_all"))
+	assert.Equal(int64(0), cache.Keys())
+	assert.Equal("OK", c.do("flush_all 100"))
+	srv.Close()
+	srv.fl.Lock()
+	assert.Nil(srv.flushTimer)
+	srv.fl.Unlock()
+}
+
+// 读取stats中的一项
+func mcStat(c *mcClient, name string) int64 {
+	for _, line := range c.lines("stats") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == name {
+			n, _ := strconv.ParseInt(fields[2], 10, 64)
+			return n
+		}
+	}
+	c.t.Fatalf("stats中没有%s", name)
+	return 0
+}
+
+func TestMemcacheStats(t *testing.T) {
+	assert := assert.New(t)
+	_, cache, dial := newMemcacheServer(t, v4.WithMaxMemory("1MB"))
+	c := dial()
+	c.do("set a 0 0 1\r\na")
+	c.do("set b 0 0 1\r\nb")
+	c.lines("get a b none")
+	c.do("delete b")
+	c.do("touch none 1")
+	stats := make(map[string]string)
+	for _, line := range c.lines("stats") {
+		fields := strings.Fields(line)
+		assert.Equal("STAT", fields[0])
+		stats[fields[1]] = fields[2]
+	}
+	for name, val := range map[string]string{
+		"cmd_get":          "3",
+		"cmd_set":          "2",
+		"get_hits":         "2",
+		"get_misses":       "1",
+		"delete_hits":      "1",
+		"touch_misses":     "1",
+		"curr_items":       "1",
+		"total_items":      "2",
+		"limit_maxbytes":   strconv.Itoa(v4.UnitMB),
+		"curr_connections": "1",
+		"version":          memcacheVersion,
+	} {
+		assert.Equal(val, stats[name], name)
+	}
+	assert.Equal("RESET", c.do("stats reset"))
+	assert.Equal(int64(0), mcStat(c, "cmd_get"))
+	assert.Equal(int64(0), mcStat(c, "total_items"))
+	assert.Equal(int64(1), mcStat(c, "curr_items"))
+	// cache的计数器不受影响
+	assert.Equal(int64(2), cache.Stats().Sets)
+	c.do("set c 0 0 1\r\nc")
+	assert.Equal(int64(1), mcStat(c, "total_items"))
+	assert.Equal(int64(3), cache.Stats().Sets)
+	assert.Equal("ERROR", c.do("stats slabs"))
+}
+
+func TestMetaCommands(t *testing.T) {
+	assert := assert.New(t)
+	clock := v4.NewFakeClock(time.Now())
+	_, cache, dial := newMemcacheServer(t, v4.WithClock(clock))
+	c := dial()
+	assert.Equal("MN", c.do("mn"))
+	assert.Equal("EN", c.do("mg a v"))
+	// q时不返回EN，mn之前的命令都已经处理
+	assert.Equal("MN", c.do("mg a v q\r\nmn"))
+
+	assert.Equal("HD", c.do("ms a 3 F5 T100\r\nabc"))
+	_, version, _ := cache.GetVersion("a")
+	cas := strconv.FormatUint(version, 10)
+	assert.Equal("VA 3 f5 c"+cas+" s3 t100 ka Oxyz", c.do("mg a v f c s t k Oxyz"))
+	assert.Equal("abc", c.line())
+	assert.Equal("HD f5", c.do("mg a f"))
+	// T修改有效期，返回修改后的版本号
+	assert.Equal("HD t10", c.do("mg a T10 t"))
+	reply := c.do("mg a T0 t c")
+	_, version, _ = cache.GetVersion("a")
+	assert.Equal("HD t-1 c"+strconv.FormatUint(version, 10), reply)
+	assert.NotEqual(cas, strconv.FormatUint(version, 10))
+	cas = strconv.FormatUint(version, 10)
+
+	// C比较版本号，c返回新的版本号
+	assert.Equal("EX", c.do("ms a 1 C1\r\nx"))
+	reply = c.do("ms a 1 C" + cas + " c\r\nx")
+	_, version, _ = cache.GetVersion("a")
+	assert.Equal("HD c"+strconv.FormatUint(version, 10), reply)
+	assert.Equal("NF", c.do("ms none 1 C1\r\nx"))
+	assert.Equal("CLIENT_ERROR bad data chunk", c.do("ms a 1\r\nxyz"))
+
+	// 写入方式
+	assert.Equal("NS", c.do("ms a 1 ME\r\nx"))
+	assert.Equal("NS", c.do("ms none 1 MR\r\nx"))
+	assert.Equal("HD", c.do("ms a 2 MA\r\nzz"))
+	assert.Equal("HD", c.do("ms a 1 Mp\r\ny"))
+	assert.Equal("VA 4", c.do("mg a v"))
+	assert.Equal("yxzz", c.line())
+	assert.Equal("CLIENT_ERROR invalid mode for ms", c.do("ms a 1 MX\r\nx"))
+	assert.Equal("CLIENT_ERROR invalid flag", c.do("ms a 1 Z\r\nx"))
+	assert.Equal("MN", c.do("ms q 1 q\r\nx\r\nmn"))
+
+	// base64编码的key
+	key := base64.StdEncoding.EncodeToString([]byte("bin key"))
+	assert.Equal("HD b k"+key, c.do("ms "+key+" 1 b k\r\nx"))
+	assert.True(cache.Exists("bin key"))
+	assert.Equal("VA 1 b", c.do("mg "+key+" b v"))
+	assert.Equal("x", c.line())
+	assert.Equal("CLIENT_ERROR error decoding key", c.do("mg !!! b"))
+
+	// md
+	_, version, _ = cache.GetVersion("a")
+	assert.Equal("EX", c.do("md a C1"))
+	assert.Equal("HD Oop", c.do("md a C"+strconv.FormatUint(version, 10)+" Oop"))
+	assert.Equal("NF", c.do("md a"))
+	assert.Equal("MN", c.do("md a q\r\nmn"))
+
+	// ma
+	assert.Equal("NF", c.do("ma n"))
+	assert.Equal("VA 2 t100", c.do("ma n N100 J10 v t"))
+	assert.Equal("10", c.line())
+	assert.Equal("VA 2", c.do("ma n D5 v"))
+	assert.Equal("15", c.line())
+	assert.Equal("HD", c.do("ma n MD D20"))
+	assert.Equal("VA 1", c.do("mg n v"))
+	assert.Equal("0", c.line())
+	_, version, _ = cache.GetVersion("n")
+	assert.Equal("EX", c.do("ma n C1"))
+	reply = c.do("ma n C" + strconv.FormatUint(version, 10) + " c")
+	_, version, _ = cache.GetVersion("n")
+	assert.Equal("HD c"+strconv.FormatUint(version, 10), reply)
+	assert.Equal("HD t5", c.do("ma n T5 t"))
+	assert.Equal("CLIENT_ERROR cannot increment or decrement non-numeric value", c.do("ma "+key+" b"))
+	assert.Equal("CLIENT_ERROR invalid mode for ma", c.do("ma n MX"))
+	assert.Equal("CLIENT_ERROR bad token in command line format", c.do("ma n Dx"))
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// 协议限制，与Redis相同
+const (
+	MaxBulkLen  = 512 << 20 // 单个参数的最大长度
+	MaxArgs     = 1 << 20   // 一条命令的最大参数个数
+	maxInlineLn = 64 << 10  // inline命令的最大长度
+	readChunk   = 64 << 10  // 按声明的长度读取时，缓冲区最多预先分配的大小
+)
+
+// 客户端发送的数据不符合协议，回复错误后关闭连接
+type protocolError string
+
+func (err protocolError) Error() string {
+	return "Protocol error: " + string(err)
+}
+
+// 读取一条命令，支持RESP数组和telnet使用的inline命令
+// 返回的每个参数都是新分配的，可以直接保存
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			args := bytes.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			for i := range args {
+				args[i] = append([]byte(nil), args[i]...)
+			}
+			return args, nil
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > MaxArgs {
+			return nil, protocolError("invalid multibulk length")
+		}
+		if n <= 0 {
+			continue
+		}
+		// 参数个数由客户端声明，按实际读到的参数增长
+		args := make([][]byte, 0, minInt(n, 64))
+		for i := 0; i < n; i++ {
+			arg, err := readBulk(r)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+func readBulk(r *bufio.Reader) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, protocolError("expected '$', got '" + string(line) + "'")
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > MaxBulkLen {
+		return nil, protocolError("invalid bulk length")
+	}
+	b, err := readFull(r, n+2)
+	if err != nil {
+		return nil, err
+	}
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, protocolError("expected CRLF after bulk")
+	}
+	return b[:n], nil
+}
+
+// 读取n个字节，缓冲区随收到的数据增长，每次最多扩大一倍
+// 客户端声明了很大的长度却不发送数据时，不会按声明的长度分配内存
+func readFull(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, 0, minInt(n, readChunk))
+	for len(b) < n {
+		if len(b) == cap(b) {
+			nb := make([]byte, len(b), len(b)+minInt(n-len(b), cap(b)))
+			copy(nb, b)
+			b = nb
+		}
+		m, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+m]
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 读取一行，去掉结尾的\r\n，返回的内容在下次读取前有效
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, protocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// 按连接协商的协议版本写入回复，RESP2中RESP3独有的类型退化为相近的类型
+type writer struct {
+	w     *bufio.Writer
+	proto int
+	buf   []byte
+}
+
+func (w *writer) header(prefix byte, n int64) {
+	w.buf = append(w.buf[:0], prefix)
+	w.buf = strconv.AppendInt(w.buf, n, 10)
+	w.buf = append(w.buf, '\r', '\n')
+	w.w.Write(w.buf)
+}
+
+func (w *writer) simple(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// 错误以错误码开头，例如ERR、WRONGTYPE
+func (w *writer) error(s string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.header(':', n)
+}
+
+func (w *writer) bulk(b []byte) {
+	w.header('$', int64(len(b)))
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulkString(s string) {
+	w.header('$', int64(len(s)))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// RESP2中为$-1
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.header('*', int64(n))
+}
+
+// n个键值对，RESP2中为2n个元素的数组
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.header('%', int64(n))
+		return
+	}
+	w.header('*', int64(2*n))
+}
+
+// 纯文本，RESP2中为bulk string
+func (w *writer) verbatim(s string) {
+	if w.proto < 3 {
+		w.bulkString(s)
+		return
+	}
+	w.header('=', int64(len(s)+4))
+	w.w.WriteString("txt:")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
@@ -0,0 +1,510 @@
+// Package server 以Redis协议(RESP2/RESP3)通过TCP对外提供cache，可以直接使用Redis客户端访问
+// 支持SET(EX/PX/NX/XX)、GET、DEL、EXISTS、FLUSHALL、DBSIZE、TTL、EXPIRE、PING、INFO、CONFIG GET/SET maxmemory
+// 以及客户端连接时常用的HELLO、SELECT 0、COMMAND、QUIT
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v4 "cache/v4"
+)
+
+// 按key分段的锁数量
+const lockStripes = 256
+
+// Backend server使用的cache，v4.New返回的cache和v4.ShardedCache都实现了Backend
+type Backend[V any] interface {
+	v4.Cache[string, V]
+	v4.TTLCache[string, V]
+	v4.VersionedCache[string, V]
+	v4.StatsProvider
+}
+
+// Server 把Redis命令映射到Cache的方法，key为string，value为[]byte
+// Close只关闭监听和连接，不关闭cache
+type Server struct {
+	cache Backend[[]byte]
+	start time.Time
+	// 同一个key的写命令串行执行，SET NX/XX的判断和写入之间不会被其他连接修改
+	locks [lockStripes]sync.Mutex
+	conns tracker
+	// 统计，原子操作
+	clientID      int64
+	commandsTotal int64
+}
+
+func New(cache Backend[[]byte]) *Server {
+	return &Server{
+		cache: cache,
+		start: time.Now(),
+		conns: newTracker(),
+	}
+}
+
+// ListenAndServe 监听addr并处理连接，直到Close
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve 处理l上的连接，每个连接一个goroutine，返回时关闭l
+// Close之后返回ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	return s.conns.serve(l, s.serveConn)
+}
+
+// Close 关闭所有监听和连接，等待正在执行的命令完成，重复调用返回ErrServerClosed
+func (s *Server) Close() error {
+	return s.conns.close()
+}
+
+// 一个客户端连接
+type client struct {
+	id   int64
+	r    *bufio.Reader
+	w    writer
+	quit bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	c := &client{
+		id: atomic.AddInt64(&s.clientID, 1),
+		r:  bufio.NewReaderSize(conn, maxInlineLn),
+		w:  writer{w: bufio.NewWriter(conn), proto: 2},
+	}
+	for !c.quit {
+		args, err := readCommand(c.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.w.error("ERR " + perr.Error())
+				c.w.w.Flush()
+			}
+			return
+		}
+		s.exec(c, args)
+		// 流水线中的命令都处理完后再发送回复
+		if c.r.Buffered() == 0 || c.quit {
+			if err := c.w.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// 命令的参数个数，与Redis相同，正数表示必须相等，负数表示至少-arity个，都包括命令名
+type command struct {
+	arity int
+	fn    func(s *Server, c *client, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":      {2, (*Server).get},
+		"set":      {-3, (*Server).set},
+		"del":      {-2, (*Server).del},
+		"exists":   {-2, (*Server).exists},
+		"flushall": {-1, (*Server).flushAll},
+		"dbsize":   {1, (*Server).dbSize},
+		"ttl":      {2, (*Server).ttl},
+		"expire":   {3, (*Server).expire},
+		"ping":     {-1, (*Server).ping},
+		"info":     {-1, (*Server).info},
+		"config":   {-2, (*Server).config},
+		"hello":    {-1, (*Server).hello},
+		"select":   {2, (*Server).selectDB},
+		"command":  {-1, (*Server).command},
+		"quit":     {1, (*Server).quit},
+	}
+}
+
+func (s *Server) exec(c *client, args [][]byte) {
+	atomic.AddInt64(&s.commandsTotal, 1)
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || len(args) < -cmd.arity {
+		c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.fn(s, c, args)
+}
+
+func (s *Server) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return &s.locks[h.Sum32()%lockStripes]
+}
+
+func (s *Server) get(c *client, args [][]byte) {
+	if val, ok := s.cache.Get(string(args[1])); ok {
+		c.w.bulk(val)
+		return
+	}
+	c.w.null()
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX]
+// NX、XX不满足时回复null
+func (s *Server) set(c *client, args [][]byte) {
+	key := string(args[1])
+	var expire time.Duration
+	var nx, xx, hasExpire bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case (opt == "EX" || opt == "PX") && !hasExpire && i+1 < len(args):
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			i++
+			d, err := parseDuration(args[i], unit)
+			if err != nil {
+				c.w.error(err.Error())
+				return
+			}
+			if d <= 0 {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			expire, hasExpire = d, true
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if nx || xx {
+		if exists := s.cache.Exists(key); nx && exists || xx && !exists {
+			c.w.null()
+			return
+		}
+	}
+	if err := s.cache.TrySet(key, args[2], expire); err != nil {
+		c.w.error("ERR " + err.Error())
+		return
+	}
+	c.w.simple("OK")
+}
+
+func (s *Server) del(c *client, args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		mu := s.lock(string(key))
+		mu.Lock()
+		if s.cache.Del(string(key)) {
+			n++
+		}
+		mu.Unlock()
+	}
+	c.w.integer(n)
+}
+
+// 同一个key出现多次时计算多次
+func (s *Server) exists(c *client, args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		if s.cache.Exists(string(key)) {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+// FLUSHALL [ASYNC|SYNC]，都是同步清空
+func (s *Server) flushAll(c *client, args [][]byte) {
+	if len(args) > 2 {
+		c.w.error("ERR syntax error")
+		return
+	}
+	if len(args) == 2 {
+		if mode := strings.ToUpper(string(args[1])); mode != "ASYNC" && mode != "SYNC" {
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+	s.cache.Flush()
+	c.w.simple("OK")
+}
+
+func (s *Server) dbSize(c *client, args [][]byte) {
+	c.w.integer(s.cache.Keys())
+}
+
+// key不存在时回复-2，永不过期时回复-1，否则回复四舍五入的秒数
+func (s *Server) ttl(c *client, args [][]byte) {
+	d, ok := s.cache.TTL(string(args[1]))
+	switch {
+	case !ok:
+		c.w.integer(-2)
+	case d == v4.NoExpire:
+		c.w.integer(-1)
+	default:
+		c.w.integer(int64((d + time.Second/2) / time.Second))
+	}
+}
+
+// EXPIRE key seconds，seconds<=0时删除key
+func (s *Server) expire(c *client, args [][]byte) {
+	key := string(args[1])
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+	if seconds > int64(math.MaxInt64/time.Second) {
+		c.w.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+	mu := s.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	var ok bool
+	if seconds <= 0 {
+		ok = s.cache.Del(key)
+	} else {
+		ok = s.cache.Expire(key, time.Duration(seconds)*time.Second)
+	}
+	c.w.integer(boolInt(ok))
+}
+
+func (s *Server) ping(c *client, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// CONFIG GET maxmemory、CONFIG SET maxmemory size
+// size的格式同Redis，例如1gb、100mb、1048576，按KB向下取整
+// 与Redis相同，0表示不限制，设置为cache允许的最大内存v4.MaxMemory
+func (s *Server) config(c *client, args [][]byte) {
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "GET" && len(args) == 3:
+		if !strings.EqualFold(string(args[2]), "maxmemory") {
+			c.w.mapHeader(0)
+			return
+		}
+		c.w.mapHeader(1)
+		c.w.bulkString("maxmemory")
+		c.w.bulkString(strconv.Itoa(redisMaxMemory(s.cache.Stats().MaxMemory)))
+	case sub == "SET" && len(args) == 4:
+		if !strings.EqualFold(string(args[2]), "maxmemory") {
+			c.w.error(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[2]))
+			return
+		}
+		size, err := parseMemory(string(args[3]))
+		if err == nil && size == 0 {
+			size = v4.MaxMemory
+		}
+		if err == nil {
+			err = s.cache.TrySetMaxMemory(strconv.FormatInt(size/v4.UnitKB, 10) + "KB")
+		}
+		if err != nil {
+			c.w.error("ERR CONFIG SET failed: " + err.Error())
+			return
+		}
+		c.w.simple("OK")
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", args[1]))
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME name]]
+// 不支持认证，SETNAME被忽略
+func (s *Server) hello(c *client, args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "SETNAME" && i+1 < len(args):
+			i++
+		case opt == "AUTH" && i+2 < len(args):
+			c.w.error("ERR AUTH is not supported")
+			return
+		default:
+			c.w.error(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+			return
+		}
+	}
+	c.w.proto = proto
+	c.w.mapHeader(7)
+	c.w.bulkString("server")
+	c.w.bulkString("cache")
+	c.w.bulkString("version")
+	c.w.bulkString(redisVersion)
+	c.w.bulkString("proto")
+	c.w.integer(int64(proto))
+	c.w.bulkString("id")
+	c.w.integer(c.id)
+	c.w.bulkString("mode")
+	c.w.bulkString("standalone")
+	c.w.bulkString("role")
+	c.w.bulkString("master")
+	c.w.bulkString("modules")
+	c.w.array(0)
+}
+
+// 只有一个数据库
+func (s *Server) selectDB(c *client, args [][]byte) {
+	if string(args[1]) != "0" {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.w.simple("OK")
+}
+
+// 客户端连接时会调用COMMAND DOCS等获取命令信息，回复空数组
+func (s *Server) command(c *client, args [][]byte) {
+	c.w.array(0)
+}
+
+func (s *Server) quit(c *client, args [][]byte) {
+	c.w.simple("OK")
+	c.quit = true
+}
+
+// 解析SET的EX、PX，乘以unit，溢出时返回错误
+func parseDuration(b []byte, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if n > int64(math.MaxInt64/unit) || n < int64(math.MinInt64/unit) {
+		return 0, errors.New("ERR invalid expire time in 'set' command")
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Redis的内存单位，k、m、g是1000的倍数，kb、mb、gb是1024的倍数，没有单位时为字节
+func parseMemory(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	num, unit := lower, int64(1)
+	for _, u := range []struct {
+		suffix string
+		unit   int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	} {
+		if strings.HasSuffix(lower, u.suffix) {
+			num, unit = strings.TrimSuffix(lower, u.suffix), u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("错误的内存大小%s", s)
+	}
+	return n * unit, nil
+}
+
+// Redis中maxmemory为0表示不限制，达到v4.MaxMemory时按0输出
+func redisMaxMemory(maxMemory int) int {
+	if maxMemory >= v4.MaxMemory {
+		return 0
+	}
+	return maxMemory
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 部分客户端按版本号判断支持的命令，与RESP3一起出现的版本
+const redisVersion = "7.0.0"
+
+// INFO [section ...]，section为all、default、everything时输出所有部分
+func (s *Server) info(c *client, args [][]byte) {
+	want := make(map[string]bool)
+	for _, arg := range args[1:] {
+		want[strings.ToLower(string(arg))] = true
+	}
+	all := len(want) == 0 || want["all"] || want["default"] || want["everything"]
+	st := s.cache.Stats()
+	var b strings.Builder
+	section := func(name string, fields ...interface{}) {
+		if !all && !want[strings.ToLower(name)] {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", name)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, "%s:%v\r\n", fields[i], fields[i+1])
+		}
+	}
+	section("Server",
+		"redis_version", redisVersion,
+		"redis_mode", "standalone",
+		"process_id", os.Getpid(),
+		"uptime_in_seconds", int64(time.Since(s.start)/time.Second),
+	)
+	section("Clients",
+		"connected_clients", s.conns.count(),
+	)
+	section("Memory",
+		"used_memory", st.MemoryUsed,
+		"maxmemory", redisMaxMemory(st.MaxMemory),
+	)
+	section("Stats",
+		"total_connections_received", s.conns.total(),
+		"total_commands_processed", atomic.LoadInt64(&s.commandsTotal),
+		"expired_keys", st.Expirations,
+		"evicted_keys", st.Evictions,
+		"keyspace_hits", st.Hits,
+		"keyspace_misses", st.Misses,
+	)
+	if st.Keys > 0 {
+		section("Keyspace", "db0", fmt.Sprintf("keys=%d", st.Keys))
+	} else {
+		section("Keyspace")
+	}
+	c.w.verbatim(b.String())
+}
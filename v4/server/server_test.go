@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	v4 "cache/v4"
+)
+
+// 回复中的错误
+type replyError string
+
+func (err replyError) Error() string { return string(err) }
+
+// 通过loopback连接发送命令的客户端
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *testClient) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.write(b.String())
+}
+
+func (c *testClient) write(s string) {
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) do(args ...string) interface{} {
+	c.send(args...)
+	return c.read()
+}
+
+// 读取一个回复，null为nil，map为按顺序排列的键值对
+func (c *testClient) read() interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return body
+	case '-':
+		return replyError(body)
+	case ':':
+		n, _ := strconv.ParseInt(body, 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$', '=':
+		n, _ := strconv.Atoi(body)
+		if n < 0 {
+			return nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.t.Fatal(err)
+		}
+		if line[0] == '=' {
+			return "verbatim:" + string(b[:n])
+		}
+		return string(b[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(body)
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("未知的回复%q", line)
+	return nil
+}
+
+func newTestServer(t *testing.T, opts ...v4.Option) (*Server, Backend[[]byte], func() *testClient) {
+	c, err := v4.New[string, []byte](opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := c.(Backend[[]byte])
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(cache)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Error(err)
+		}
+		cache.Close()
+	})
+	dial := func() *testClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+	return srv, cache, dial
+}
+
+func TestCommands(t *testing.T) {
+	assert := assert.New(t)
+	_, cache, dial := newTestServer(t)
+	c := dial()
+	assert.Equal("PONG", c.do("PING"))
+	assert.Equal("hello", c.do("ping", "hello"))
+	assert.Equal("OK", c.do("SET", "a", "1"))
+	assert.Equal("1", c.do("GET", "a"))
+	val, _ := cache.Get("a")
+	assert.Equal([]byte("1"), val)
+	assert.Nil(c.do("GET", "none"))
+	// 二进制安全
+	assert.Equal("OK", c.do("SET", "b", "x\r\ny\x00"))
+	assert.Equal("x\r\ny\x00", c.do("GET", "b"))
+	assert.Equal("OK", c.do("SET", "c", ""))
+	assert.Equal("", c.do("GET", "c"))
+
+	assert.Equal(int64(3), c.do("DBSIZE"))
+	assert.Equal(int64(3), c.do("EXISTS", "a", "a", "b", "none"))
+	assert.Equal(int64(2), c.do("DEL", "a", "b", "none"))
+	assert.Equal(int64(0), c.do("EXISTS", "a"))
+	assert.Equal("OK", c.do("FLUSHALL"))
+	assert.Equal("OK", c.do("FLUSHALL", "ASYNC"))
+	assert.Equal(int64(0), c.do("DBSIZE"))
+
+	assert.Equal("OK", c.do("SELECT", "0"))
+	assert.Equal(replyError("ERR DB index is out of range"), c.do("SELECT", "1"))
+	assert.Equal([]interface{}{}, c.do("COMMAND", "DOCS"))
+	assert.Equal(replyError("ERR unknown command 'foo'"), c.do("foo", "bar"))
+	assert.Equal(replyError("ERR wrong number of arguments for 'get' command"), c.do("GET"))
+	assert.Equal(replyError("ERR wrong number of arguments for 'set' command"), c.do("SET", "a"))
+	assert.Equal(replyError("ERR syntax error"), c.do("FLUSHALL", "NOW"))
+
+	// telnet使用的inline命令
+	c.write("SET d 4\r\nGET d\n")
+	assert.Equal("OK", c.read())
+	assert.Equal("4", c.read())
+
+	assert.Equal("OK", c.do("QUIT"))
+	_, err := c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+}
+
+func TestSetOptions(t *testing.T) {
+	assert := assert.New(t)
+	clock := v4.NewFakeClock(time.Now())
+	_, _, dial := newTestServer(t, v4.WithClock(clock))
+	c := dial()
+	assert.Equal("OK", c.do("SET", "a", "1", "EX", "10"))
+	assert.Equal(int64(10), c.do("TTL", "a"))
+	assert.Equal("OK", c.do("SET", "b", "1", "px", "2500"))
+	assert.Equal(int64(3), c.do("TTL", "b"))
+	clock.Advance(time.Second * 3)
+	assert.Nil(c.do("GET", "b"))
+	// 没有EX、PX时永不过期
+	assert.Equal("OK", c.do("SET", "a", "2"))
+	assert.Equal(int64(-1), c.do("TTL", "a"))
+
+	assert.Nil(c.do("SET", "a", "3", "NX"))
+	assert.Equal("2", c.do("GET", "a"))
+	assert.Equal("OK", c.do("SET", "n", "1", "NX", "EX", "5"))
+	assert.Equal(int64(5), c.do("TTL", "n"))
+	assert.Equal("OK", c.do("SET", "a", "3", "XX"))
+	assert.Equal("3", c.do("GET", "a"))
+	assert.Nil(c.do("SET", "x", "1", "XX"))
+	assert.Equal(int64(0), c.do("EXISTS", "x"))
+
+	for _, args := range [][]string{
+		{"SET", "a", "1", "NX", "XX"},
+		{"SET", "a", "1", "EX", "1", "PX", "1"},
+		{"SET", "a", "1", "EX"},
+		{"SET", "a", "1", "KEEP"},
+	} {
+		assert.Equal(replyError("ERR syntax error"), c.do(args...), args)
+	}
+	assert.Equal(replyError("ERR invalid expire time in 'set' command"), c.do("SET", "a", "1", "EX", "0"))
+	assert.Equal(replyError("ERR invalid expire time in 'set' command"), c.do("SET", "a", "1", "EX", "-1"))
+	assert.Equal(replyError("ERR invalid expire time in 'set' command"), c.do("SET", "a", "1", "EX", "9223372036854775807"))
+	assert.Equal(replyError("ERR value is not an integer or out of range"), c.do("SET", "a", "1", "PX", "abc"))
+	assert.Equal("3", c.do("GET", "a"))
+}
+
+func TestExpire(t *testing.T) {
+	assert := assert.New(t)
+	clock := v4.NewFakeClock(time.Now())
+	_, _, dial := newTestServer(t, v4.WithClock(clock))
+	c := dial()
+	assert.Equal(int64(-2), c.do("TTL", "a"))
+	assert.Equal(int64(0), c.do("EXPIRE", "a", "10"))
+	c.do("SET", "a", "1")
+	assert.Equal(int64(1), c.do("EXPIRE", "a", "10"))
+	assert.Equal(int64(10), c.do("TTL", "a"))
+	clock.Advance(time.Millisecond * 1500)
+	// 四舍五入
+	assert.Equal(int64(9), c.do("TTL", "a"))
+	clock.Advance(time.Second * 9)
+	assert.Equal(int64(-2), c.do("TTL", "a"))
+
+	// seconds<=0时删除key
+	c.do("SET", "b", "1")
+	assert.Equal(int64(1), c.do("EXPIRE", "b", "0"))
+	assert.Equal(int64(0), c.do("EXISTS", "b"))
+	assert.Equal(int64(0), c.do("EXPIRE", "b", "-1"))
+	assert.Equal(replyError("ERR value is not an integer or out of range"), c.do("EXPIRE", "b", "1.5"))
+}
+
+func TestRESP3(t *testing.T) {
+	assert := assert.New(t)
+	_, _, dial := newTestServer(t)
+	c := dial()
+	reply := c.do("HELLO").([]interface{})
+	assert.Equal([]interface{}{"proto", int64(2)}, reply[4:6])
+	assert.Nil(c.do("GET", "a"))
+	c.write("GET a\r\n")
+	assert.Equal("$-1", readReplyLine(t, c))
+
+	reply = c.do("HELLO", "3", "SETNAME", "test").([]interface{})
+	assert.Equal([]interface{}{"server", "cache"}, reply[:2])
+	assert.Equal([]interface{}{"proto", int64(3)}, reply[4:6])
+	c.write("GET a\r\n")
+	assert.Equal("_", readReplyLine(t, c))
+	info := c.do("INFO", "keyspace")
+	assert.Equal("verbatim:txt:# Keyspace\r\n", info)
+	c.write("CONFIG GET maxmemory\r\n")
+	assert.Equal("%1", readReplyLine(t, c))
+	c.read()
+	c.read()
+
+	assert.Equal(replyError("NOPROTO unsupported protocol version"), c.do("HELLO", "4"))
+	assert.Equal(replyError("ERR AUTH is not supported"), c.do("HELLO", "3", "AUTH", "user", "pass"))
+	// 失败的HELLO不改变协议
+	c.write("GET a\r\n")
+	assert.Equal("_", readReplyLine(t, c))
+}
+
+func readReplyLine(t *testing.T, c *testClient) string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestInfoConfig(t *testing.T) {
+	assert := assert.New(t)
+	_, cache, dial := newTestServer(t)
+	c := dial()
+	c.do("SET", "a", "1")
+	c.do("GET", "a")
+	c.do("GET", "b")
+	info := c.do("INFO").(string)
+	for _, s := range []string{"# Server\r\n", "keyspace_hits:1\r\n", "keyspace_misses:1\r\n", "connected_clients:1\r\n", "db0:keys=1\r\n"} {
+		assert.Contains(info, s)
+	}
+	info = c.do("INFO", "memory").(string)
+	assert.True(strings.HasPrefix(info, "# Memory\r\n"))
+	assert.NotContains(info, "# Server")
+
+	assert.Equal("OK", c.do("CONFIG", "SET", "maxmemory", "2mb"))
+	assert.Equal(2*v4.UnitMB, cache.Stats().MaxMemory)
+	assert.Equal([]interface{}{"maxmemory", strconv.Itoa(2 * v4.UnitMB)}, c.do("config", "get", "MAXMEMORY"))
+	// 没有单位时为字节，按KB向下取整
+	assert.Equal("OK", c.do("CONFIG", "SET", "maxmemory", "1049000"))
+	assert.Equal(1024*v4.UnitKB, cache.Stats().MaxMemory)
+	assert.Equal("OK", c.do("CONFIG", "SET", "maxmemory", "1g"))
+	assert.Equal(976562*v4.UnitKB, cache.Stats().MaxMemory)
+	for _, size := range []string{"abc", "1tb", "100", "-1mb", "5gb"} {
+		_, ok := c.do("CONFIG", "SET", "maxmemory", size).(replyError)
+		assert.True(ok, size)
+	}
+	assert.Equal(976562*v4.UnitKB, cache.Stats().MaxMemory)
+	// 0表示不限制，使用cache允许的最大内存，CONFIG GET、INFO按Redis的习惯输出0
+	assert.Equal("OK", c.do("CONFIG", "SET", "maxmemory", "0"))
+	assert.Equal(v4.MaxMemory, cache.Stats().MaxMemory)
+	assert.Equal([]interface{}{"maxmemory", "0"}, c.do("CONFIG", "GET", "maxmemory"))
+	assert.Contains(c.do("INFO", "memory").(string), "maxmemory:0\r\n")
+	assert.Equal([]interface{}{}, c.do("CONFIG", "GET", "timeout"))
+	_, ok := c.do("CONFIG", "SET", "timeout", "1").(replyError)
+	assert.True(ok)
+	_, ok = c.do("CONFIG", "RESETSTAT").(replyError)
+	assert.True(ok)
+}
+
+// 流水线中的命令按顺序回复
+func TestPipeline(t *testing.T) {
+	assert := assert.New(t)
+	_, _, dial := newTestServer(t)
+	c := dial()
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "*3\r\n$3\r\nSET\r\n$%d\r\n%d\r\n$1\r\nv\r\n", len(strconv.Itoa(i)), i)
+		fmt.Fprintf(&b, "*2\r\n$6\r\nEXISTS\r\n$%d\r\n%d\r\n", len(strconv.Itoa(i)), i)
+	}
+	c.write(b.String())
+	for i := 0; i < 100; i++ {
+		assert.Equal("OK", c.read())
+		assert.Equal(int64(1), c.read())
+	}
+	assert.Equal(int64(100), c.do("DBSIZE"))
+}
+
+// 并发的SET NX只有一个成功
+func TestSetNXConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	_, _, dial := newTestServer(t)
+	clients := make([]*testClient, 8)
+	for i := range clients {
+		clients[i] = dial()
+	}
+	for round := 0; round < 20; round++ {
+		key := strconv.Itoa(round)
+		for _, c := range clients {
+			c.send("SET", key, "1", "NX")
+		}
+		var ok int
+		for _, c := range clients {
+			if c.read() == "OK" {
+				ok++
+			}
+		}
+		assert.Equal(1, ok)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	assert := assert.New(t)
+	_, _, dial := newTestServer(t)
+	for _, req := range []string{"*1\r\n+PING\r\n", "*x\r\n", "*1\r\n$-5\r\n", "*1\r\n$4\r\nPINGxx"} {
+		c := dial()
+		c.write(req)
+		err, ok := c.read().(replyError)
+		assert.True(ok, req)
+		assert.True(strings.HasPrefix(string(err), "ERR Protocol error"), req)
+		_, rerr := c.r.ReadByte()
+		assert.Equal(io.EOF, rerr, req)
+	}
+	// 空的数组和空行被忽略
+	c := dial()
+	c.write("*0\r\n\r\nPING\r\n")
+	assert.Equal("PONG", c.read())
+}
+
+// 声明的长度很大但没有发送数据时，不按声明的长度分配内存
+func TestReadCommandDeclaredLength(t *testing.T) {
+	assert := assert.New(t)
+	for _, req := range []string{
+		"*" + strconv.Itoa(MaxArgs) + "\r\n$3\r\nGET\r\n",
+		"*1\r\n$" + strconv.Itoa(MaxBulkLen) + "\r\nabc",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := readCommand(bufio.NewReader(strings.NewReader(req)))
+		runtime.ReadMemStats(&after)
+		assert.NotNil(err)
+		assert.Less(after.TotalAlloc-before.TotalAlloc, uint64(1<<20), req)
+	}
+	b, err := readFull(bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", readChunk*3+5)), 16), readChunk*3+5)
+	assert.Nil(err)
+	assert.Equal(strings.Repeat("x", readChunk*3+5), string(b))
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	srv, _, dial := newTestServer(t)
+	c := dial()
+	assert.Equal("PONG", c.do("PING"))
+	assert.Nil(srv.Close())
+	_, err := c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+	assert.Equal(ErrServerClosed, srv.Close())
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(ErrServerClosed, srv.Serve(l))
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrServerClosed Close之后Serve返回ErrServerClosed
+var ErrServerClosed = errors.New("server已关闭")
+
+// 记录监听和连接，Close时全部关闭，Server和MemcacheServer共用
+type tracker struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+	accepted  int64 // 累计的连接数，原子操作
+}
+
+func newTracker() tracker {
+	return tracker{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// 接受l上的连接，每个连接一个goroutine调用handle，handle返回后关闭连接
+// 返回时关闭l，close之后返回ErrServerClosed
+func (t *tracker) serve(l net.Listener, handle func(conn net.Conn)) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	t.listeners[l] = struct{}{}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.listeners, l)
+		t.mu.Unlock()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !t.add(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer t.done(conn)
+			handle(conn)
+		}()
+	}
+}
+
+func (t *tracker) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	atomic.AddInt64(&t.accepted, 1)
+	return true
+}
+
+func (t *tracker) done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	conn.Close()
+	t.wg.Done()
+}
+
+// 关闭所有监听和连接，等待连接的goroutine退出，重复调用返回ErrServerClosed
+func (t *tracker) close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrServerClosed
+	}
+	t.closed = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return nil
+}
+
+// 当前的连接数
+func (t *tracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// 累计的连接数
+func (t *tracker) total() int64 {
+	return atomic.LoadInt64(&t.accepted)
+}
@@ -0,0 +1,276 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ShardedCache 按key的hash分散到多个独立的lruCache
+// 每个分片有自己的锁、淘汰策略和gc goroutine，不同分片的操作互不阻塞
+// 最大内存平均分配给每个分片，单个元素不能超过一个分片的最大内存
+type ShardedCache[K comparable, V any] struct {
+	shards []*lruCache[K, V]
+	mask   uint64
+	hash   func(K) uint64 // 选择分片
+}
+
+// NewShardedCache shards会向上取整为2的幂，配置项与New相同，对每个分片生效
+// 每个分片分到的最大内存小于MinMemory时返回ErrOption
+// key不是string、整数类型时需要通过WithHasher配置hash，否则返回ErrOption
+func NewShardedCache[K comparable, V any](shards int, opts ...Option) (*ShardedCache[K, V], error) {
+	return NewShardedCacheContext[K, V](context.Background(), shards, opts...)
+}
+
+// NewShardedCacheContext 同NewShardedCache，ctx结束时所有分片自动关闭
+func NewShardedCacheContext[K comparable, V any](ctx context.Context, shards int, opts ...Option) (*ShardedCache[K, V], error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("%w: 分片数%d必须大于0", ErrOption, shards)
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOptions[K, V](o); err != nil {
+		return nil, err
+	}
+	hash := newHasher[K](o)
+	if hash == nil {
+		return nil, fmt.Errorf("%w: key的类型%T需要通过WithHasher配置hash", ErrOption, *new(K))
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	if o.maxMemory/n < MinMemory {
+		return nil, fmt.Errorf("%w: 最大内存%d平均分配给%d个分片后小于%d", ErrOption, o.maxMemory, n, MinMemory)
+	}
+	c := &ShardedCache[K, V]{
+		shards: make([]*lruCache[K, V], n),
+		mask:   uint64(n - 1),
+		hash:   hash,
+	}
+	so := *o
+	so.maxMemory = o.maxMemory / n
+	for i := range c.shards {
+		c.shards[i] = newCache[K, V](ctx, &so)
+	}
+	if o.aofPath != "" {
+		for i, s := range c.shards {
+			if err := s.openAOF(fmt.Sprintf("%s.%d", o.aofPath, i), o.aofFsync); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *ShardedCache[K, V]) shard(key K) *lruCache[K, V] {
+	return c.shards[c.hash(key)&c.mask]
+}
+
+// SetMaxMemory 总的最大内存，平均分配给每个分片，每个分片分到的内存小于MinMemory时panic
+func (c *ShardedCache[K, V]) SetMaxMemory(size string) {
+	if err := c.TrySetMaxMemory(size); errors.Is(err, ErrMemory) {
+		panic(err)
+	}
+}
+
+func (c *ShardedCache[K, V]) TrySetMaxMemory(size string) error {
+	siz, err := getMemorySize(size)
+	if err != nil {
+		return err
+	}
+	if siz/len(c.shards) < MinMemory {
+		return &MemoryErr{size: size}
+	}
+	for _, s := range c.shards {
+		if err := s.setMaxMemory(siz / len(c.shards)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ShardedCache[K, V]) SetGCPeriod(d time.Duration) {
+	for _, s := range c.shards {
+		s.SetGCPeriod(d)
+	}
+}
+
+func (c *ShardedCache[K, V]) Set(key K, val V, expire time.Duration) {
+	c.shard(key).Set(key, val, expire)
+}
+
+func (c *ShardedCache[K, V]) TrySet(key K, val V, expire time.Duration) error {
+	return c.shard(key).TrySet(key, val, expire)
+}
+
+func (c *ShardedCache[K, V]) SetWithDeadline(key K, val V, deadline time.Time) {
+	c.shard(key).SetWithDeadline(key, val, deadline)
+}
+
+func (c *ShardedCache[K, V]) TrySetWithDeadline(key K, val V, deadline time.Time) error {
+	return c.shard(key).TrySetWithDeadline(key, val, deadline)
+}
+
+func (c *ShardedCache[K, V]) Get(key K) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache[K, V]) GetVersion(key K) (V, uint64, bool) {
+	return c.shard(key).GetVersion(key)
+}
+
+// CompareAndSet 每个分片单独分配版本号，同一个key的版本号不会重复
+func (c *ShardedCache[K, V]) CompareAndSet(key K, val V, expire time.Duration, version uint64) (uint64, error) {
+	return c.shard(key).CompareAndSet(key, val, expire, version)
+}
+
+func (c *ShardedCache[K, V]) CompareAndDelete(key K, version uint64) (bool, error) {
+	return c.shard(key).CompareAndDelete(key, version)
+}
+
+func (c *ShardedCache[K, V]) GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context) (V, time.Duration, error)) (V, error) {
+	return c.shard(key).GetOrLoad(ctx, key, loader)
+}
+
+func (c *ShardedCache[K, V]) SetSliding(key K, val V, ttl time.Duration) {
+	c.shard(key).SetSliding(key, val, ttl)
+}
+
+func (c *ShardedCache[K, V]) TrySetSliding(key K, val V, ttl time.Duration) error {
+	return c.shard(key).TrySetSliding(key, val, ttl)
+}
+
+func (c *ShardedCache[K, V]) TTL(key K) (time.Duration, bool) {
+	return c.shard(key).TTL(key)
+}
+
+func (c *ShardedCache[K, V]) Expire(key K, d time.Duration) bool {
+	return c.shard(key).Expire(key, d)
+}
+
+func (c *ShardedCache[K, V]) ExpireAt(key K, deadline time.Time) bool {
+	return c.shard(key).ExpireAt(key, deadline)
+}
+
+func (c *ShardedCache[K, V]) Persist(key K) bool {
+	return c.shard(key).Persist(key)
+}
+
+func (c *ShardedCache[K, V]) Touch(key K) bool {
+	return c.shard(key).Touch(key)
+}
+
+func (c *ShardedCache[K, V]) Del(key K) bool {
+	return c.shard(key).Del(key)
+}
+
+func (c *ShardedCache[K, V]) Exists(key K) bool {
+	return c.shard(key).Exists(key)
+}
+
+// Flush 清空所有分片，所有分片都成功时返回true
+func (c *ShardedCache[K, V]) Flush() bool {
+	ok := true
+	for _, s := range c.shards {
+		ok = s.Flush() && ok
+	}
+	return ok
+}
+
+// Keys 所有分片元素个数之和
+func (c *ShardedCache[K, V]) Keys() int64 {
+	var keys int64
+	for _, s := range c.shards {
+		keys += s.Keys()
+	}
+	return keys
+}
+
+// OnEvict 每个分片都使用fn，不同分片的回调可能同时调用
+func (c *ShardedCache[K, V]) OnEvict(fn func(key K, val V, reason RemovalReason)) {
+	for _, s := range c.shards {
+		s.OnEvict(fn)
+	}
+}
+
+// Stats 所有分片统计数据之和
+func (c *ShardedCache[K, V]) Stats() Stats {
+	var s Stats
+	for _, shard := range c.shards {
+		s.add(shard.Stats())
+	}
+	return s
+}
+
+func (c *ShardedCache[K, V]) ResetStats() {
+	for _, s := range c.shards {
+		s.ResetStats()
+	}
+}
+
+// SaveSnapshot 依次复制每个分片的元素，写入同一个快照
+// 每个分片分别加锁，快照中不同分片的元素不是同一时刻的状态
+func (c *ShardedCache[K, V]) SaveSnapshot(w io.Writer) error {
+	var (
+		now     time.Time
+		entries []snapshotEntry[K, V]
+	)
+	for i, s := range c.shards {
+		t, e, err := s.snapshotEntries(uint64(len(entries)))
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			now = t
+		}
+		entries = append(entries, e...)
+	}
+	return writeSnapshot(w, now, entries, c.shards[0].codec)
+}
+
+// LoadSnapshot 快照可以来自分片数不同的cache，元素按key重新分配，来自同一个分片的元素保持原来的相对顺序
+func (c *ShardedCache[K, V]) LoadSnapshot(r io.Reader) error {
+	entries, err := readSnapshot[K, V](r, c.shards[0].codec)
+	if err != nil {
+		return err
+	}
+	parts := make([][]snapshotEntry[K, V], len(c.shards))
+	for _, e := range entries {
+		i := c.hash(e.key) & c.mask
+		parts[i] = append(parts[i], e)
+	}
+	for i, s := range c.shards {
+		if err := s.restore(parts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteAOF 在后台重写每个分片的aof，返回第一个错误
+func (c *ShardedCache[K, V]) RewriteAOF() error {
+	var err error
+	for _, s := range c.shards {
+		if e := s.RewriteAOF(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close 关闭所有分片，返回第一个错误
+func (c *ShardedCache[K, V]) Close() error {
+	var err error
+	for _, s := range c.shards {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package v4
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ Cache[string, int]          = (*ShardedCache[string, int])(nil)
+	_ TTLCache[string, int]       = (*ShardedCache[string, int])(nil)
+	_ VersionedCache[string, int] = (*ShardedCache[string, int])(nil)
+	_ LoadingCache[string, int]   = (*ShardedCache[string, int])(nil)
+	_ EvictNotifier[string, int]  = (*ShardedCache[string, int])(nil)
+	_ StatsProvider               = (*ShardedCache[string, int])(nil)
+	_ Snapshotter                 = (*ShardedCache[string, int])(nil)
+	_ AOFRewriter                 = (*ShardedCache[string, int])(nil)
+)
+
+func TestNewShardedCache(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewShardedCache[string, int](10, WithMaxMemory("16MB"))
+	assert.Nil(err)
+	defer cache.Close()
+	// 向上取整为2的幂
+	assert.Equal(16, len(cache.shards))
+	for _, s := range cache.shards {
+		assert.Equal(UnitMB, s.maxMemory)
+	}
+	cache.SetMaxMemory("32MB")
+	for _, s := range cache.shards {
+		assert.Equal(2*UnitMB, s.maxMemory)
+	}
+	assert.True(errors.Is(cache.TrySetMaxMemory("5GB"), ErrMemory))
+	// 每个分片分到的内存不足MinMemory
+	assert.True(errors.Is(cache.TrySetMaxMemory("8KB"), ErrMemory))
+	assert.Panics(func() { cache.SetMaxMemory("8KB") })
+	for _, s := range cache.shards {
+		assert.Equal(2*UnitMB, s.maxMemory)
+	}
+	_, err = NewShardedCache[string, int](16, WithMaxMemory("8KB"))
+	assert.True(errors.Is(err, ErrOption))
+	c, err := NewShardedCache[string, int](8, WithMaxMemory("8KB"))
+	assert.Nil(err)
+	c.Close()
+
+	_, err = NewShardedCache[string, int](0)
+	assert.True(errors.Is(err, ErrOption))
+	_, err = NewShardedCache[string, int](4, WithCost(func(int, int) int { return 1 }))
+	assert.True(errors.Is(err, ErrOption))
+}
+
+func TestShardedSetGetDel(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewShardedCache[string, int](8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	count := 1000
+	for i := 0; i < count; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+	assert.Equal(int64(count), cache.Keys())
+	// 每个分片都分到了元素
+	for _, s := range cache.shards {
+		assert.Greater(s.Keys(), int64(0))
+	}
+	for i := 0; i < count; i++ {
+		val, ok := cache.Get(strconv.Itoa(i))
+		assert.True(ok)
+		assert.Equal(i, val)
+	}
+	for i := 0; i < count/2; i++ {
+		assert.True(cache.Del(strconv.Itoa(i)))
+		assert.False(cache.Exists(strconv.Itoa(i)))
+	}
+	assert.Equal(int64(count/2), cache.Keys())
+	assert.True(cache.Flush())
+	assert.Equal(int64(0), cache.Keys())
+}
+
+// 每个分片单独淘汰，总内存不超过最大内存
+func TestShardedOutofMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewShardedCache[string, int](4, WithMaxMemory("4KB"),
+		WithCost(func(string, int) int { return 32 }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	for i := 0; i < 1000; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+	// 每个分片1KB，最多32个元素
+	assert.Equal(int64(128), cache.Keys())
+	for _, s := range cache.shards {
+		assert.Equal(UnitKB, s.elemSize)
+	}
+}
+
+func TestShardedClose(t *testing.T) {
+	assert := assert.New(t)
+	before := gcGoroutines()
+	cache, err := NewShardedCache[string, int](8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(before+8, waitGoroutines(before+8))
+	cache.Set("a", 1, 0)
+	assert.Nil(cache.Close())
+	assert.Equal(before, waitGoroutines(before))
+	assert.Equal(ErrClosed, cache.Close())
+	assert.Equal(ErrClosed, cache.TrySet("a", 1, 0))
+	assert.Equal(int64(0), cache.Keys())
+}
+
+// 并发读写
+func TestShardedConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewShardedCache[int, int](16, WithMaxMemory("1MB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := g*1000 + i
+				cache.Set(key, i, 0)
+				val, ok := cache.Get(key)
+				assert.True(ok)
+				assert.Equal(i, val)
+				if i%3 == 0 {
+					cache.Del(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(int64(8*666), cache.Keys())
+}
+
+func benchmarkParallelGet(b *testing.B, cache Cache[int, int]) {
+	defer cache.Close()
+	for i := 0; i < 1<<16; i++ {
+		cache.Set(i, i, 0)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(i & (1<<16 - 1))
+			i++
+		}
+	})
+}
+
+func benchmarkParallelSet(b *testing.B, cache Cache[int, int]) {
+	defer cache.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Set(i&(1<<16-1), i, 0)
+			i++
+		}
+	})
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	benchmarkParallelGet(b, NewCache[int, int]())
+}
+func BenchmarkParallelGetSharded(b *testing.B) {
+	cache, err := NewShardedCache[int, int](64)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkParallelGet(b, cache)
+}
+func BenchmarkParallelSet(b *testing.B) {
+	benchmarkParallelSet(b, NewCache[int, int]())
+}
+func BenchmarkParallelSetSharded(b *testing.B) {
+	cache, err := NewShardedCache[int, int](64)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkParallelSet(b, cache)
+}
+
+type userID string
+
+type point struct {
+	x, y int
+}
+
+// 以string、整数为底层类型的key不需要配置hash，其他类型需要WithHasher
+func TestShardedHasher(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(hashString("a"), defaultHasher[userID]()("a"))
+	n := int64(-1)
+	assert.Equal(mix64(uint64(n)), defaultHasher[int8]()(-1))
+	assert.Equal(mix64(42), defaultHasher[uint16]()(42))
+	assert.Nil(defaultHasher[point]())
+	assert.Nil(defaultHasher[[2]int]())
+
+	_, err := NewShardedCache[point, int](4)
+	assert.True(errors.Is(err, ErrOption))
+	_, err = NewShardedCache[point, int](4, WithHasher(func(k string) uint64 { return 0 }))
+	assert.True(errors.Is(err, ErrOption))
+	c, err := NewShardedCache[point, int](4, WithHasher(func(p point) uint64 {
+		return mix64(uint64(p.x)<<32 | uint64(uint32(p.y)))
+	}))
+	assert.Nil(err)
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		c.Set(point{i, -i}, i, 0)
+	}
+	for _, s := range c.shards {
+		assert.Greater(s.Keys(), int64(0))
+	}
+	val, _ := c.Get(point{42, -42})
+	assert.Equal(42, val)
+
+	// 选择分片不分配内存
+	u, err := NewShardedCache[userID, int](4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	u.Set("a", 1, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		u.Get("a")
+		u.Get("b")
+	})
+	assert.Equal(float64(0), allocs)
+}
@@ -0,0 +1,152 @@
+package v4
+
+import (
+	"reflect"
+)
+
+const (
+	// 指针、map、chan、func等引用类型本身的大小
+	ptrSize = 8
+	// string头部，指针+长度
+	stringHeaderSize = 16
+	// slice头部，指针+长度+容量
+	sliceHeaderSize = 24
+	// interface头部，类型指针+数据指针
+	ifaceHeaderSize = 16
+	// map头部hmap的近似大小
+	mapHeaderSize = 48
+	// 引用嵌套的最大深度，避免循环引用导致无限递归
+	maxSizeDepth = 8
+)
+
+// Sizer 值可以实现Sizer，自己给出占用的内存大小，优先于内置的估算
+type Sizer interface {
+	Size() int
+}
+
+// 估算c占用的内存大小
+//
+//	实现了Sizer的值，使用Size()
+//	string、[]byte，头部+实际长度
+//	数值类型，与真实内存大小一致
+//	slice、数组、map、struct，头部+每个元素的大小
+//	指针、interface，头部+指向的值的大小
+func sizeof(c interface{}) int {
+	switch v := c.(type) {
+	case nil:
+		return 0
+	case Sizer:
+		// nil指针按普通指针计算，不调用Size
+		if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || !rv.IsNil() {
+			return v.Size()
+		}
+	case string:
+		return stringHeaderSize + len(v)
+	case []byte:
+		return sliceHeaderSize + len(v)
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, uintptr, float64, complex64:
+		return 8
+	case complex128:
+		return 16
+	}
+	return valueSize(reflect.ValueOf(c), 0)
+}
+
+func valueSize(v reflect.Value, depth int) int {
+	if !v.IsValid() {
+		return 0
+	}
+	if depth > 0 && v.CanInterface() {
+		if s, ok := v.Interface().(Sizer); ok {
+			if v.Kind() != reflect.Ptr || !v.IsNil() {
+				return s.Size()
+			}
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return stringHeaderSize + v.Len()
+	case reflect.Slice:
+		if depth >= maxSizeDepth {
+			return sliceHeaderSize
+		}
+		return sliceHeaderSize + elemsSize(v, depth)
+	case reflect.Array:
+		if depth >= maxSizeDepth {
+			return int(v.Type().Size())
+		}
+		return elemsSize(v, depth)
+	case reflect.Map:
+		size := mapHeaderSize
+		if depth >= maxSizeDepth {
+			return size
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			size += valueSize(iter.Key(), depth+1) + valueSize(iter.Value(), depth+1)
+		}
+		return size
+	case reflect.Struct:
+		if depth >= maxSizeDepth {
+			return int(v.Type().Size())
+		}
+		size := 0
+		for i := 0; i < v.NumField(); i++ {
+			size += valueSize(v.Field(i), depth+1)
+		}
+		return size
+	case reflect.Ptr:
+		if v.IsNil() || depth >= maxSizeDepth {
+			return ptrSize
+		}
+		return ptrSize + valueSize(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.IsNil() || depth >= maxSizeDepth {
+			return ifaceHeaderSize
+		}
+		return ifaceHeaderSize + valueSize(v.Elem(), depth+1)
+	default:
+		// 数值类型、chan、func、unsafe.Pointer
+		return int(v.Type().Size())
+	}
+}
+
+// slice、数组中所有元素的大小，元素是定长类型时直接相乘
+func elemsSize(v reflect.Value, depth int) int {
+	if isFixedSize(v.Type().Elem()) {
+		return v.Len() * int(v.Type().Elem().Size())
+	}
+	size := 0
+	for i := 0; i < v.Len(); i++ {
+		size += valueSize(v.Index(i), depth+1)
+	}
+	return size
+}
+
+// t不包含任何引用，大小固定
+func isFixedSize(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return !t.Implements(sizerType)
+	case reflect.Array:
+		return isFixedSize(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !isFixedSize(t.Field(i).Type) {
+				return false
+			}
+		}
+		return !t.Implements(sizerType)
+	}
+	return false
+}
+
+var sizerType = reflect.TypeOf((*Sizer)(nil)).Elem()
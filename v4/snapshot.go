@@ -0,0 +1,352 @@
+package v4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// 快照格式
+//
+//	头部: magic(4) 版本(2) 保留(2) 快照时间UnixNano(8) 元素个数(8) 头部的crc32(4)，整数都是大端
+//	元素: payload长度(uvarint) payload payload的crc32(4)
+//	payload: 位置(uvarint) 标记(1) [剩余有效期(varint)] 有效期(varint) key长度(uvarint) key value长度(uvarint) value
+//
+// 位置从0开始，0是最先被淘汰的元素，恢复时按位置从小到大写入
+// 剩余有效期是软过期时间减去快照时间，只有标记中有snapshotExpire时才写入
+const (
+	snapshotMagic      = "V4SN"
+	SnapshotVersion    = 1
+	snapshotHeaderSize = 4 + 2 + 2 + 8 + 8 + 4
+	snapshotReadChunk  = 64 << 10 // 读取元素时缓冲区最少增长的大小
+
+	snapshotExpire  = 1 << 0 // 有过期时间
+	snapshotSliding = 1 << 1 // 滑动过期
+)
+
+var (
+	// ErrSnapshot 快照格式错误或者校验失败，可以用errors.Is判断
+	ErrSnapshot = errors.New("快照格式错误")
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// 快照中的一个元素
+type snapshotEntry[K comparable, V any] struct {
+	pos     uint64
+	key     K
+	val     V
+	soft    int64 // 软过期时间的UnixNano，0表示永不过期
+	ttl     time.Duration
+	sliding bool
+}
+
+// 可以按淘汰顺序遍历元素的策略，快照按这个顺序记录元素的位置
+type orderedPolicy[K comparable, V any] interface {
+	// 从最先被淘汰的元素开始遍历
+	ascend(fn func(e *elem[K, V]))
+}
+
+// 从链表尾到链表头遍历
+func (l *list[K, V]) ascend(fn func(e *elem[K, V])) {
+	for e := l.tail; e != nil; e = e.prev {
+		fn(e)
+	}
+}
+
+func (p *lruPolicy[K, V]) ascend(fn func(e *elem[K, V]))  { p.list.ascend(fn) }
+func (p *fifoPolicy[K, V]) ascend(fn func(e *elem[K, V])) { p.list.ascend(fn) }
+
+// SaveSnapshot 把所有没有过期的元素写入w
+// 只在复制元素时持有写锁，编码和写入w时不阻塞其他操作，快照是复制那一刻的状态
+// LRU、FIFO记录元素的淘汰顺序，其他策略的顺序不保证
+// key、value使用WithCodec配置的Codec编码，默认为GobCodec
+func (c *lruCache[K, V]) SaveSnapshot(w io.Writer) error {
+	now, entries, err := c.snapshotEntries(0)
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, now, entries, c.codec)
+}
+
+// LoadSnapshot 按快照中的顺序写入元素，恢复淘汰顺序，已经过期的元素被跳过
+// 不清空已有的元素，同一个key被快照中的值覆盖，快照中的元素比已有的元素更新
+// 先读取并校验整个快照，快照错误时不写入任何元素，返回ErrSnapshot
+func (c *lruCache[K, V]) LoadSnapshot(r io.Reader) error {
+	entries, err := readSnapshot[K, V](r, c.codec)
+	if err != nil {
+		return err
+	}
+	return c.restore(entries)
+}
+
+// 复制所有没有过期的元素，位置从base开始
+func (c *lruCache[K, V]) snapshotEntries(base uint64) (time.Time, []snapshotEntry[K, V], error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	now := c.clock.Now()
+	if c.isClosed() {
+		return now, nil, ErrClosed
+	}
+	return now, c.copyEntries(now, base), nil
+}
+
+// 按淘汰顺序复制没有过期的元素，必须持有写锁
+func (c *lruCache[K, V]) copyEntries(now time.Time, base uint64) []snapshotEntry[K, V] {
+	// 回放访问记录，复制的顺序是最新的
+	c.drainReads()
+	entries := make([]snapshotEntry[K, V], 0, c.elemCount)
+	add := func(e *elem[K, V]) {
+		if !e.alive(now) {
+			return
+		}
+		entries = append(entries, snapshotEntry[K, V]{
+			pos:     base + uint64(len(entries)),
+			key:     e.key,
+			val:     e.val,
+			soft:    e.getSoft(),
+			ttl:     e.ttl,
+			sliding: e.sliding,
+		})
+	}
+	if p, ok := c.policy.(orderedPolicy[K, V]); ok {
+		p.ascend(add)
+	} else {
+		for _, e := range c.m {
+			add(e)
+		}
+	}
+	return entries
+}
+
+// 按位置写入元素，已经过期的元素被跳过，不影响已有的同名key
+func (c *lruCache[K, V]) restore(entries []snapshotEntry[K, V]) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].pos < entries[j].pos
+	})
+	now := c.clock.Now().UnixNano()
+	for _, e := range entries {
+		if e.soft != 0 && e.soft <= now {
+			continue
+		}
+		if err := c.set(e.key, e.val, e.soft, e.ttl, e.sliding, false); err == ErrClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSnapshot[K comparable, V any](w io.Writer, now time.Time, entries []snapshotEntry[K, V], codec Codec) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[4:], SnapshotVersion)
+	binary.BigEndian.PutUint64(header[8:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(header[16:], uint64(len(entries)))
+	binary.BigEndian.PutUint32(header[24:], crc32.Checksum(header[:24], crcTable))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	var payload, buf []byte
+	for i := range entries {
+		var err error
+		payload, err = encodeEntry(payload[:0], now, &entries[i], codec)
+		if err != nil {
+			return err
+		}
+		buf = appendUvarint(buf[:0], uint64(len(payload)))
+		buf = append(buf, payload...)
+		buf = appendUint32(buf, crc32.Checksum(payload, crcTable))
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func encodeEntry[K comparable, V any](b []byte, now time.Time, e *snapshotEntry[K, V], codec Codec) ([]byte, error) {
+	b = appendUvarint(b, e.pos)
+	var flags byte
+	if e.soft != 0 {
+		flags |= snapshotExpire
+	}
+	if e.sliding {
+		flags |= snapshotSliding
+	}
+	b = append(b, flags)
+	if e.soft != 0 {
+		b = appendVarint(b, e.soft-now.UnixNano())
+	}
+	b = appendVarint(b, int64(e.ttl))
+	b, err := appendEncoded(b, codec, &e.key)
+	if err != nil {
+		return nil, fmt.Errorf("编码key失败: %w", err)
+	}
+	if b, err = appendEncoded(b, codec, &e.val); err != nil {
+		return nil, fmt.Errorf("编码value失败: %w", err)
+	}
+	return b, nil
+}
+
+func readSnapshot[K comparable, V any](r io.Reader, codec Codec) ([]snapshotEntry[K, V], error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: 读取头部失败: %v", ErrSnapshot, err)
+	}
+	if string(header[:4]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: 不是快照文件", ErrSnapshot)
+	}
+	if crc32.Checksum(header[:24], crcTable) != binary.BigEndian.Uint32(header[24:]) {
+		return nil, fmt.Errorf("%w: 头部校验失败", ErrSnapshot)
+	}
+	if v := binary.BigEndian.Uint16(header[4:]); v != SnapshotVersion {
+		return nil, fmt.Errorf("%w: 不支持的版本%d", ErrSnapshot, v)
+	}
+	snapTime := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:])))
+	count := binary.BigEndian.Uint64(header[16:])
+	var entries []snapshotEntry[K, V]
+	var payload []byte
+	for i := uint64(0); i < count; i++ {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: 第%d个元素: %v", ErrSnapshot, i, err)
+		}
+		if n > uint64(MaxMemory) {
+			return nil, fmt.Errorf("%w: 第%d个元素长度%d错误", ErrSnapshot, i, n)
+		}
+		if payload, err = readGrow(br, payload, int(n+4)); err != nil {
+			return nil, fmt.Errorf("%w: 第%d个元素: %v", ErrSnapshot, i, err)
+		}
+		if crc32.Checksum(payload[:n], crcTable) != binary.BigEndian.Uint32(payload[n:]) {
+			return nil, fmt.Errorf("%w: 第%d个元素校验失败", ErrSnapshot, i)
+		}
+		e, err := decodeEntry[K, V](payload[:n], snapTime, codec)
+		if err != nil {
+			return nil, fmt.Errorf("%w: 第%d个元素: %v", ErrSnapshot, i, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// 读取n个字节，buf的容量不够时随读到的数据增长，每次最多扩大一倍
+// 长度被损坏时，不会在读到数据之前按损坏的长度分配内存
+func readGrow(r io.Reader, buf []byte, n int) ([]byte, error) {
+	buf = buf[:0]
+	for len(buf) < n {
+		if len(buf) == cap(buf) {
+			grow := cap(buf)
+			if grow < snapshotReadChunk {
+				grow = snapshotReadChunk
+			}
+			if grow > n-len(buf) {
+				grow = n - len(buf)
+			}
+			nb := make([]byte, len(buf), len(buf)+grow)
+			copy(nb, buf)
+			buf = nb
+		}
+		end := cap(buf)
+		if end > n {
+			end = n
+		}
+		m, err := io.ReadFull(r, buf[len(buf):end])
+		buf = buf[:len(buf)+m]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeEntry[K comparable, V any](b []byte, snapTime time.Time, codec Codec) (snapshotEntry[K, V], error) {
+	var e snapshotEntry[K, V]
+	r := bytes.NewReader(b)
+	var err error
+	if e.pos, err = binary.ReadUvarint(r); err != nil {
+		return e, err
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return e, err
+	}
+	if flags&snapshotExpire != 0 {
+		remaining, err := binary.ReadVarint(r)
+		if err != nil {
+			return e, err
+		}
+		// 0表示永不过期，已经过期的元素至少是快照时间，写入时会被跳过
+		e.soft = snapTime.UnixNano() + remaining
+		if e.soft <= 0 {
+			e.soft = 1
+		}
+	}
+	e.sliding = flags&snapshotSliding != 0
+	ttl, err := binary.ReadVarint(r)
+	if err != nil {
+		return e, err
+	}
+	e.ttl = time.Duration(ttl)
+	if err := readDecoded(r, codec, &e.key); err != nil {
+		return e, fmt.Errorf("解码key失败: %w", err)
+	}
+	if err := readDecoded(r, codec, &e.val); err != nil {
+		return e, fmt.Errorf("解码value失败: %w", err)
+	}
+	return e, nil
+}
+
+// 编码v，追加长度(uvarint)+内容
+func appendEncoded(b []byte, codec Codec, v interface{}) ([]byte, error) {
+	data, err := codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...), nil
+}
+
+// 读取长度(uvarint)+内容，解码到v
+func readDecoded(r *bytes.Reader, codec Codec, v interface{}) error {
+	data, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	return codec.Decode(data, v)
+}
+
+// 读取长度(uvarint)+内容
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
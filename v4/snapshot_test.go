@@ -0,0 +1,142 @@
+package v4
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	src := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	src.Set("a", 1, 0)
+	src.Set("b", 2, time.Minute)
+	src.SetSliding("c", 3, time.Second*30)
+	src.Set("d", 4, time.Second*5)
+	var buf bytes.Buffer
+	assert.Nil(src.SaveSnapshot(&buf))
+
+	// 进程重启期间d过期
+	clock.Advance(time.Second * 10)
+	dst := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	assert.Nil(dst.LoadSnapshot(bytes.NewReader(buf.Bytes())))
+	assert.Equal(int64(3), dst.Keys())
+	val, _ := dst.Get("a")
+	assert.Equal(1, val)
+	assert.False(dst.Exists("d"))
+	d, _ := dst.TTL("a")
+	assert.Equal(NoExpire, d)
+	d, _ = dst.TTL("b")
+	assert.Equal(time.Second*50, d)
+	// 滑动过期按设置时的有效期延长
+	dst.Get("c")
+	d, _ = dst.TTL("c")
+	assert.Equal(time.Second*30, d)
+}
+
+// 恢复后淘汰顺序与快照时相同
+func TestSnapshotOrder(t *testing.T) {
+	assert := assert.New(t)
+	for _, p := range []Policy{PolicyLRU, PolicyFIFO} {
+		opts := []Option{
+			WithEvictionPolicy(p),
+			WithMaxMemory("1KB"),
+			WithCost(func(key string, val int) int { return 100 }),
+		}
+		src := newTestCache[string, int](t, opts...)
+		for i := 0; i < 10; i++ {
+			src.Set(strconv.Itoa(i), i, 0)
+		}
+		src.Get("0")
+		src.Get("1")
+		var buf bytes.Buffer
+		assert.Nil(src.SaveSnapshot(&buf))
+
+		dst := newTestCache[string, int](t, opts...)
+		assert.Nil(dst.LoadSnapshot(&buf))
+		for i := 0; i < 10; i++ {
+			assert.Equal(src.policy.Victim().key, dst.policy.Victim().key, p)
+			src.remove(src.policy.Victim(), ReasonCapacity)
+			dst.remove(dst.policy.Victim(), ReasonCapacity)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, interface{}]()
+	defer cache.Close()
+	cache.Set("a", "abc", 0)
+	cache.Set("b", []byte("abc"), 0)
+	cache.Set("c", 1.5, 0)
+	var buf bytes.Buffer
+	assert.Nil(cache.SaveSnapshot(&buf))
+	data := buf.Bytes()
+
+	dst := NewCache[string, interface{}]()
+	defer dst.Close()
+	assert.Nil(dst.LoadSnapshot(bytes.NewReader(data)))
+	val, _ := dst.Get("b")
+	assert.Equal([]byte("abc"), val)
+	val, _ = dst.Get("c")
+	assert.Equal(1.5, val)
+	dst.Flush()
+
+	// 截断、修改内容、错误的magic都返回ErrSnapshot，不写入任何元素
+	for _, b := range [][]byte{
+		data[:len(data)-1],
+		append(append([]byte{}, data[:len(data)-2]...), data[len(data)-2]^0xff, data[len(data)-1]),
+		append([]byte("XXXX"), data[4:]...),
+		data[:10],
+	} {
+		err := dst.LoadSnapshot(bytes.NewReader(b))
+		assert.True(errors.Is(err, ErrSnapshot), err)
+		assert.Equal(int64(0), dst.Keys())
+	}
+
+	// 第一个元素的长度被改为接近MaxMemory，不按这个长度分配内存
+	b := append([]byte{}, data[:snapshotHeaderSize]...)
+	b = appendUvarint(b, uint64(MaxMemory))
+	b = append(b, data[snapshotHeaderSize+1:]...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := dst.LoadSnapshot(bytes.NewReader(b))
+	runtime.ReadMemStats(&after)
+	assert.True(errors.Is(err, ErrSnapshot), err)
+	assert.Less(after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	cache.Close()
+	assert.Equal(ErrClosed, cache.SaveSnapshot(&buf))
+}
+
+// 分片数不同的cache之间可以互相恢复
+func TestShardedSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	src, err := NewShardedCache[int, string](4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 100; i++ {
+		src.Set(i, strconv.Itoa(i), 0)
+	}
+	var buf bytes.Buffer
+	assert.Nil(src.SaveSnapshot(&buf))
+	dst, err := NewShardedCache[int, string](8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	assert.Nil(dst.LoadSnapshot(&buf))
+	assert.Equal(int64(100), dst.Keys())
+	val, _ := dst.Get(42)
+	assert.Equal("42", val)
+}
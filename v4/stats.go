@@ -0,0 +1,212 @@
+package v4
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// 计数器在statStripe中的下标
+const (
+	statHits = iota
+	statMisses
+	statSets
+	statDeletes
+	statEvictions
+	statExpirations
+	statGCRuns
+	statGCTime
+	statLoadSuccess
+	statLoadFailure
+	statLoadTime
+	statDropped
+	statGCHist // gc耗时的直方图，每个桶占一个下标
+	statCount  = statGCHist + len(gcBuckets) + 1
+)
+
+// gc耗时直方图的上边界，最后还有一个超过所有边界的桶
+var gcBuckets = [...]time.Duration{
+	time.Microsecond * 100,
+	time.Millisecond,
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+}
+
+// GCDurationBuckets gc耗时直方图每个桶的上边界，Stats.GCHistogram比它多一个超过所有边界的桶
+func GCDurationBuckets() []time.Duration {
+	return append([]time.Duration(nil), gcBuckets[:]...)
+}
+
+// 耗时d所在的桶
+func gcBucket(d time.Duration) int {
+	for i, b := range gcBuckets {
+		if d <= b {
+			return i
+		}
+	}
+	return len(gcBuckets)
+}
+
+// Stats cache的统计数据，由Stats()返回的快照
+type Stats struct {
+	Hits        int64 // Get命中次数
+	Misses      int64 // Get未命中次数
+	Sets        int64 // 写入次数，包括loader加载后的写入
+	Deletes     int64 // Del删除的元素个数
+	Evictions   int64 // 内存不足淘汰的元素个数
+	Expirations int64 // 过期删除的元素个数
+	GCRuns      int64
+	GCTime      time.Duration // gc累计耗时
+	// 每次gc的耗时按GCDurationBuckets划分后的次数，不是累计值
+	GCHistogram []int64
+	LoadSuccess int64         // loader成功的次数
+	LoadFailure int64         // loader返回error或者panic的次数
+	LoadTime    time.Duration // loader累计耗时
+	Dropped     int64         // OnEvict的回调太慢、队列超过MaxRemovalQueue时丢弃的通知个数
+	Keys        int64         // 当前元素个数
+	MemoryUsed  int           // 当前元素占用的内存
+	MaxMemory   int
+}
+
+// HitRatio Get的命中率，没有Get时返回0
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// AvgLoadTime loader的平均耗时，没有加载过时返回0
+func (s Stats) AvgLoadTime() time.Duration {
+	total := s.LoadSuccess + s.LoadFailure
+	if total == 0 {
+		return 0
+	}
+	return s.LoadTime / time.Duration(total)
+}
+
+func (s *Stats) add(o Stats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Sets += o.Sets
+	s.Deletes += o.Deletes
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.GCRuns += o.GCRuns
+	s.GCTime += o.GCTime
+	if s.GCHistogram == nil {
+		s.GCHistogram = make([]int64, len(o.GCHistogram))
+	}
+	for i, n := range o.GCHistogram {
+		s.GCHistogram[i] += n
+	}
+	s.LoadSuccess += o.LoadSuccess
+	s.LoadFailure += o.LoadFailure
+	s.LoadTime += o.LoadTime
+	s.Dropped += o.Dropped
+	s.Keys += o.Keys
+	s.MemoryUsed += o.MemoryUsed
+	s.MaxMemory += o.MaxMemory
+}
+
+// 一段计数器，不同的key累加到不同的段，降低并发Get之间的竞争
+type statStripe struct {
+	n [statCount]int64
+	_ [64]byte // 避免相邻的段处于同一个cache line
+}
+
+// 分段的原子计数器，读取时累加所有段
+type statCounters []statStripe
+
+func newStatCounters() statCounters {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 {
+		n <<= 1
+	}
+	return make(statCounters, n)
+}
+
+// hash决定累加到哪一段，持有写锁时的计数不存在竞争，使用0
+func (s statCounters) add(hash uint64, i int, n int64) {
+	atomic.AddInt64(&s[hash&uint64(len(s)-1)].n[i], n)
+}
+
+func (s statCounters) sum(i int) int64 {
+	var n int64
+	for j := range s {
+		n += atomic.LoadInt64(&s[j].n[i])
+	}
+	return n
+}
+
+func (s statCounters) reset() {
+	for j := range s {
+		for i := range s[j].n {
+			atomic.StoreInt64(&s[j].n[i], 0)
+		}
+	}
+}
+
+// Stats 统计数据的快照，各个计数器分别读取，彼此之间不保证一致
+func (c *lruCache[K, V]) Stats() Stats {
+	s := Stats{
+		Hits:        c.stats.sum(statHits),
+		Misses:      c.stats.sum(statMisses),
+		Sets:        c.stats.sum(statSets),
+		Deletes:     c.stats.sum(statDeletes),
+		Evictions:   c.stats.sum(statEvictions),
+		Expirations: c.stats.sum(statExpirations),
+		GCRuns:      c.stats.sum(statGCRuns),
+		GCTime:      time.Duration(c.stats.sum(statGCTime)),
+		LoadSuccess: c.stats.sum(statLoadSuccess),
+		LoadFailure: c.stats.sum(statLoadFailure),
+		LoadTime:    time.Duration(c.stats.sum(statLoadTime)),
+		Dropped:     c.stats.sum(statDropped),
+		GCHistogram: make([]int64, len(gcBuckets)+1),
+	}
+	for i := range s.GCHistogram {
+		s.GCHistogram[i] = c.stats.sum(statGCHist + i)
+	}
+	c.l.RLock()
+	s.Keys = int64(c.elemCount)
+	s.MemoryUsed = c.elemSize
+	s.MaxMemory = c.maxMemory
+	c.l.RUnlock()
+	return s
+}
+
+// ResetStats 计数器清零，Keys、MemoryUsed、MaxMemory是当前的状态，不受影响
+func (c *lruCache[K, V]) ResetStats() {
+	c.stats.reset()
+}
+
+// 按删除的原因计数，持有写锁，不存在竞争，都累加到第0段
+func (c *lruCache[K, V]) countRemoval(reason RemovalReason) {
+	switch reason {
+	case ReasonCapacity:
+		c.stats.add(0, statEvictions, 1)
+	case ReasonExpired:
+		c.stats.add(0, statExpirations, 1)
+	case ReasonExplicit:
+		c.stats.add(0, statDeletes, 1)
+	}
+}
+
+// 记录一次gc的耗时
+func (c *lruCache[K, V]) countGC(d time.Duration) {
+	c.stats.add(0, statGCRuns, 1)
+	c.stats.add(0, statGCTime, int64(d))
+	c.stats.add(0, statGCHist+gcBucket(d), 1)
+}
+
+// 记录一次loader的结果和耗时
+func (c *lruCache[K, V]) countLoad(d time.Duration, err error) {
+	if err == nil {
+		c.stats.add(0, statLoadSuccess, 1)
+	} else {
+		c.stats.add(0, statLoadFailure, 1)
+	}
+	c.stats.add(0, statLoadTime, int64(d))
+}
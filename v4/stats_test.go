@@ -0,0 +1,106 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t,
+		WithClock(clock),
+		WithGCPeriod(MinGCPeriod),
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val int) int { return 100 }),
+	)
+	for i := 0; i < 11; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("0")
+	cache.Del("3")
+	cache.Set("a", 1, time.Second)
+	clock.Advance(MinGCPeriod * 2)
+	lockedGC(cache)
+
+	s := cache.Stats()
+	assert.Equal(int64(12), s.Sets)
+	assert.Equal(int64(2), s.Hits)
+	assert.Equal(int64(1), s.Misses)
+	assert.InDelta(2.0/3, s.HitRatio(), 0.0001)
+	assert.Equal(int64(1), s.Deletes)
+	assert.Equal(int64(1), s.Evictions)
+	assert.Equal(int64(1), s.Expirations)
+	assert.Equal(int64(1), s.GCRuns)
+	// FakeClock的时间不变，耗时为0
+	assert.Equal([]int64{1, 0, 0, 0, 0, 0}, s.GCHistogram)
+	assert.Equal(int64(9), s.Keys)
+	assert.Equal(900, s.MemoryUsed)
+	assert.Equal(UnitKB, s.MaxMemory)
+
+	cache.ResetStats()
+	s = cache.Stats()
+	assert.Equal(int64(0), s.Sets)
+	assert.Equal(int64(0), s.Hits)
+	assert.Equal(0.0, s.HitRatio())
+	assert.Equal(int64(9), s.Keys)
+}
+
+func TestStatsLoad(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewCache[string, int]()
+	defer cache.Close()
+	ctx := context.Background()
+	cache.GetOrLoad(ctx, "a", func(ctx context.Context) (int, time.Duration, error) {
+		time.Sleep(time.Millisecond * 10)
+		return 1, 0, nil
+	})
+	cache.GetOrLoad(ctx, "b", func(ctx context.Context) (int, time.Duration, error) {
+		return 0, 0, errors.New("load error")
+	})
+	cache.GetOrLoad(ctx, "c", func(ctx context.Context) (int, time.Duration, error) {
+		panic("load panic")
+	})
+	s := cache.Stats()
+	assert.Equal(int64(1), s.LoadSuccess)
+	assert.Equal(int64(2), s.LoadFailure)
+	assert.GreaterOrEqual(s.LoadTime, time.Millisecond*10)
+	assert.Equal(s.LoadTime/3, s.AvgLoadTime())
+	assert.Equal(int64(3), s.Misses)
+}
+
+// 并发Get的计数不丢失
+func TestStatsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	cache, err := NewShardedCache[string, int](4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cache.Get("a")
+				cache.Get("b" + strconv.Itoa(j))
+			}
+		}()
+	}
+	wg.Wait()
+	s := cache.Stats()
+	assert.Equal(int64(8000), s.Hits)
+	assert.Equal(int64(8000), s.Misses)
+	assert.Equal(int64(1), s.Sets)
+	assert.Equal(LRUDefaultMemory, s.MaxMemory)
+}
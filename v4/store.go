@@ -0,0 +1,265 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFlushInterval = time.Second // write-behind默认的写入间隔
+	DefaultFlushBatch    = 100         // write-behind默认的批量写入阈值
+)
+
+// ErrNotFound GetOrLoad没有传入loader时，从store中也没有加载到key
+var ErrNotFound = errors.New("key不存在")
+
+// Store cache背后的持久化存储，通过WithWriteThrough、WithWriteBehind配置
+// 会被多个goroutine同时调用，实现需要并发安全
+type Store[K comparable, V any] interface {
+	// key不存在时返回false
+	Load(ctx context.Context, key K) (V, bool, error)
+	Save(ctx context.Context, key K, val V) error
+	Delete(ctx context.Context, key K) error
+}
+
+// 一次还没有写入store的修改，del为true时删除key
+type pendingWrite[V any] struct {
+	val V
+	del bool
+}
+
+// write-behind的写入队列，每个key只保留最后一次修改
+// 定时或者队列达到batch时由后台goroutine批量写入store
+type writeBehind[K comparable, V any] struct {
+	store Store[K, V]
+	batch int
+	l     sync.Mutex
+	// 等待写入的修改
+	pending map[K]pendingWrite[V]
+	// 淘汰时从pending移出的修改，由淘汰它的调用方释放写锁后写入
+	evicted map[K]pendingWrite[V]
+	// 正在写入的修改，写入完成前store.Load可能读到旧值，加载时先查找pending和flushing
+	flushing map[K]pendingWrite[V]
+	// 串行化对store的写入，同一个key的修改按顺序写入
+	flushMu sync.Mutex
+	kick    chan struct{} // 队列达到batch时通知后台goroutine
+	stopCh  chan struct{}
+	done    chan struct{} // 后台goroutine退出后关闭
+}
+
+func newWriteBehind[K comparable, V any](store Store[K, V], batch int) *writeBehind[K, V] {
+	return &writeBehind[K, V]{
+		store:   store,
+		batch:   batch,
+		pending: make(map[K]pendingWrite[V]),
+		evicted: make(map[K]pendingWrite[V]),
+		kick:    make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// 定时写入，直到stop
+// 写入失败的修改留在队列中，下一次重试
+func (w *writeBehind[K, V]) run(ticker Ticker) {
+	defer close(w.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C():
+			w.flush()
+		case <-w.kick:
+			w.flush()
+		}
+	}
+}
+
+// 停止后台goroutine，写入队列中剩余的修改，返回第一个错误
+// 调用前cache必须已经关闭，不会再有新的修改
+func (w *writeBehind[K, V]) stop() error {
+	close(w.stopCh)
+	<-w.done
+	return w.flush()
+}
+
+// 加入队列，覆盖同一个key之前的修改
+func (w *writeBehind[K, V]) add(key K, p pendingWrite[V]) {
+	w.l.Lock()
+	w.pending[key] = p
+	full := len(w.pending) >= w.batch
+	w.l.Unlock()
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 写入失败时放回队列，队列中已经有更新的修改时丢弃
+func (w *writeBehind[K, V]) retry(key K, p pendingWrite[V]) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	if _, ok := w.pending[key]; !ok {
+		w.pending[key] = p
+	}
+}
+
+// 还没有写入store的修改
+func (w *writeBehind[K, V]) lookup(key K) (pendingWrite[V], bool) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	if p, ok := w.pending[key]; ok {
+		return p, true
+	}
+	if p, ok := w.evicted[key]; ok {
+		return p, true
+	}
+	p, ok := w.flushing[key]
+	return p, ok
+}
+
+// 写入队列中的全部修改，返回第一个错误
+func (w *writeBehind[K, V]) flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.l.Lock()
+	batch := w.pending
+	w.pending = make(map[K]pendingWrite[V])
+	// 同一个key在pending中的修改更新
+	for key, p := range w.evicted {
+		if _, ok := batch[key]; !ok {
+			batch[key] = p
+		}
+	}
+	w.evicted = make(map[K]pendingWrite[V])
+	w.flushing = batch
+	w.l.Unlock()
+	return w.writeBatch(batch)
+}
+
+// 淘汰的key还有没写入store的修改时，从队列移到evicted，必须持有cache的写锁
+func (w *writeBehind[K, V]) evict(key K) bool {
+	w.l.Lock()
+	defer w.l.Unlock()
+	p, ok := w.pending[key]
+	if ok {
+		delete(w.pending, key)
+		w.evicted[key] = p
+	}
+	return ok
+}
+
+// 写入淘汰的元素还没有写入store的修改，返回时store中已经是淘汰时的值
+// 正在写入的批次可能包含淘汰的修改，先等待它完成；淘汰后又加入队列的修改更新，留给后台goroutine写入
+// 写入失败的修改放回队列，下一次重试
+func (w *writeBehind[K, V]) flushEvicted() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.l.Lock()
+	batch := w.evicted
+	w.evicted = make(map[K]pendingWrite[V])
+	for key := range batch {
+		if _, ok := w.pending[key]; ok {
+			delete(batch, key)
+		}
+	}
+	w.flushing = batch
+	w.l.Unlock()
+	return w.writeBatch(batch)
+}
+
+// 写入一批修改，写入失败的放回队列，返回第一个错误，必须持有flushMu
+func (w *writeBehind[K, V]) writeBatch(batch map[K]pendingWrite[V]) error {
+	var err error
+	for key, p := range batch {
+		if e := w.write(key, p); e != nil {
+			if err == nil {
+				err = e
+			}
+			w.retry(key, p)
+		}
+	}
+	w.l.Lock()
+	w.flushing = nil
+	w.l.Unlock()
+	return err
+}
+
+func (w *writeBehind[K, V]) write(key K, p pendingWrite[V]) error {
+	if p.del {
+		return w.store.Delete(context.Background(), key)
+	}
+	return w.store.Save(context.Background(), key, p.val)
+}
+
+// 从store加载key的loader，write-behind模式下优先返回还没有写入store的修改
+// 加载的元素永不过期，内存不足时照常淘汰
+func (c *lruCache[K, V]) storeLoader(key K) func(ctx context.Context) (V, time.Duration, error) {
+	return func(ctx context.Context) (V, time.Duration, error) {
+		var zero V
+		if c.wb != nil {
+			if p, ok := c.wb.lookup(key); ok {
+				if p.del {
+					return zero, 0, ErrNotFound
+				}
+				return p.val, 0, nil
+			}
+		}
+		val, ok, err := c.store.Load(ctx, key)
+		if err != nil {
+			return zero, 0, err
+		}
+		if !ok {
+			return zero, 0, ErrNotFound
+		}
+		return val, 0, nil
+	}
+}
+
+// write-through模式下写入store，其他模式不做任何操作
+func (c *lruCache[K, V]) saveThrough(key K, val V) error {
+	if c.store == nil || c.wb != nil {
+		return nil
+	}
+	return c.store.Save(context.Background(), key, val)
+}
+
+// write-through模式下从store删除，其他模式不做任何操作
+func (c *lruCache[K, V]) deleteThrough(key K) error {
+	if c.store == nil || c.wb != nil {
+		return nil
+	}
+	return c.store.Delete(context.Background(), key)
+}
+
+// write-behind模式下把修改加入写入队列，必须持有写锁，保证队列与cache中的顺序一致
+func (c *lruCache[K, V]) markDirty(key K, p pendingWrite[V]) {
+	if c.wb != nil {
+		c.wb.add(key, p)
+	}
+}
+
+// write-behind模式下淘汰还没有写入store的元素时，把修改移出队列，必须持有写锁
+// 持有写锁时不访问store，由unlock在释放锁之后写入，写入前加载时仍然能找到这个修改
+func (c *lruCache[K, V]) writeBack(key K) {
+	if c.wb != nil && c.wb.evict(key) {
+		c.evictedDirty = true
+	}
+}
+
+// 释放写锁，持有锁期间淘汰了还没有写入store的元素时，同步写入store后再返回
+// 其他调用方不需要等待store，淘汰元素的写入方返回时store中已经是淘汰时的值
+// 写入失败的修改放回队列由后台goroutine重试，不影响这次写入的结果
+func (c *lruCache[K, V]) unlock() {
+	flush := c.evictedDirty
+	c.evictedDirty = false
+	c.l.Unlock()
+	if flush {
+		c.wb.flushEvicted()
+	}
+}
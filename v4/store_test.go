@@ -0,0 +1,381 @@
+package v4
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 内存中的store，记录每个key的写入次数
+type memStore struct {
+	l      sync.Mutex
+	m      map[string]int
+	saves  int
+	err    error // 不为nil时Save、Delete返回err
+	loaded int
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[string]int)}
+}
+
+func (s *memStore) Load(ctx context.Context, key string) (int, bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.loaded++
+	val, ok := s.m[key]
+	return val, ok, nil
+}
+
+func (s *memStore) Save(ctx context.Context, key string, val int) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.saves++
+	s.m[key] = val
+	return nil
+}
+
+func (s *memStore) Delete(ctx context.Context, key string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.m, key)
+	return nil
+}
+
+func (s *memStore) get(key string) (int, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	val, ok := s.m[key]
+	return val, ok
+}
+
+func (s *memStore) setErr(err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.err = err
+}
+
+func (s *memStore) len() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.m)
+}
+
+// 等待store中key的值变为val
+func waitStore(s *memStore, key string, val int) bool {
+	for i := 0; i < 100; i++ {
+		if v, ok := s.get(key); ok && v == val {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestWriteThrough(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	cache := newTestCache[string, int](t, WithWriteThrough[string, int](store))
+	ctx := context.Background()
+
+	cache.Set("a", 1, 0)
+	cache.SetSliding("b", 2, time.Minute)
+	val, ok := store.get("a")
+	assert.True(ok)
+	assert.Equal(1, val)
+	val, _ = store.get("b")
+	assert.Equal(2, val)
+	// 不在cache中的key也从store删除
+	store.m["c"] = 3
+	assert.True(cache.Del("a"))
+	assert.False(cache.Del("c"))
+	assert.Equal(1, store.len())
+
+	// 从store加载的值不写回store
+	saves := store.saves
+	cache.Flush()
+	val, err := cache.GetOrLoad(ctx, "b", nil)
+	assert.Nil(err)
+	assert.Equal(2, val)
+	assert.Equal(saves, store.saves)
+	_, err = cache.GetOrLoad(ctx, "a", nil)
+	assert.Equal(ErrNotFound, err)
+
+	// 写入失败时不修改cache
+	storeErr := errors.New("store error")
+	store.setErr(storeErr)
+	assert.Equal(storeErr, cache.TrySet("b", 3, 0))
+	val, _ = cache.Get("b")
+	assert.Equal(2, val)
+	assert.False(cache.Del("b"))
+	assert.True(cache.Exists("b"))
+}
+
+// 写入store失败时CompareAndSet、CompareAndDelete不修改cache
+func TestCompareAndSetWriteThrough(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t, WithClock(NewFakeClock(time.Now())), WithWriteThrough[string, int](store))
+	version, err := c.CompareAndSet("a", 1, time.Minute, 0)
+	assert.Nil(err)
+	val, _ := store.get("a")
+	assert.Equal(1, val)
+
+	storeErr := errors.New("store error")
+	store.setErr(storeErr)
+	v, err := c.CompareAndSet("a", 2, 0, version)
+	assert.Equal(storeErr, err)
+	assert.Equal(uint64(0), v)
+	val, cur, _ := c.GetVersion("a")
+	assert.Equal(1, val)
+	d, _ := c.TTL("a")
+	assert.Equal(time.Minute, d)
+	// 恢复后的元素有新的版本号，之前的版本号不能再写入
+	assert.NotEqual(version, cur)
+	_, err = c.CompareAndSet("b", 1, 0, 0)
+	assert.Equal(storeErr, err)
+	assert.False(c.Exists("b"))
+	ok, err := c.CompareAndDelete("a", cur)
+	assert.False(ok)
+	assert.Equal(storeErr, err)
+	val, _ = c.Get("a")
+	assert.Equal(1, val)
+
+	store.setErr(nil)
+	_, cur, _ = c.GetVersion("a")
+	ok, err = c.CompareAndDelete("a", cur)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal(0, store.len())
+}
+
+// cache不会接受的写入不写入store
+func TestWriteThroughRejected(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t,
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val int) int { return val }),
+		WithWriteThrough[string, int](store),
+	)
+	assert.Equal(ErrTooLarge, c.TrySet("a", 2*UnitKB, 0))
+	assert.Equal(ErrTooLarge, c.TrySetSliding("a", 2*UnitKB, time.Minute))
+	_, err := c.CompareAndSet("a", 2*UnitKB, 0, 0)
+	assert.Equal(ErrTooLarge, err)
+	assert.Equal(0, store.len())
+	assert.Nil(c.Close())
+	assert.Equal(ErrClosed, c.TrySet("a", 1, 0))
+	_, err = c.CompareAndSet("a", 1, 0, 0)
+	assert.Equal(ErrClosed, err)
+	assert.Equal(0, store.len())
+}
+
+func TestWriteBehind(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	store := newMemStore()
+	cache := newTestCache[string, int](t, WithClock(clock), WithWriteBehind[string, int](store, time.Second, 100))
+	ctx := context.Background()
+
+	cache.Set("a", 1, 0)
+	cache.Set("a", 2, 0)
+	cache.Set("b", 3, 0)
+	assert.Equal(0, store.len())
+	// 还没有写入store时，加载得到最新的修改
+	cache.Flush()
+	val, err := cache.GetOrLoad(ctx, "a", nil)
+	assert.Nil(err)
+	assert.Equal(2, val)
+	assert.Equal(0, store.loaded)
+	cache.Del("b")
+	_, err = cache.GetOrLoad(ctx, "b", nil)
+	assert.Equal(ErrNotFound, err)
+
+	// 到了写入间隔，同一个key只写入最后一次修改
+	clock.Advance(time.Second)
+	assert.True(waitStore(store, "a", 2))
+	assert.Equal(1, store.saves)
+	_, ok := store.get("b")
+	assert.False(ok)
+}
+
+// 队列达到batch时立即写入
+func TestWriteBehindBatch(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t, WithWriteBehind[string, int](store, time.Hour, 3))
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(0, store.len())
+	c.Set("c", 3, 0)
+	assert.True(waitStore(store, "a", 1))
+	assert.True(waitStore(store, "b", 2))
+	assert.True(waitStore(store, "c", 3))
+}
+
+// 淘汰还没有写入的元素时，淘汰它的Set返回前写入store
+func TestWriteBehindEvict(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t,
+		WithMaxMemory("2KB"),
+		WithCost(func(key string, val int) int { return 200 }),
+		WithWriteBehind[string, int](store, time.Hour, 100),
+	)
+	for i := 0; i < 10; i++ {
+		c.Set(string(rune('a'+i)), i, 0)
+	}
+	assert.Equal(0, store.len())
+	c.Set("k", 10, 0)
+	assert.False(c.Exists("a"))
+	val, ok := store.get("a")
+	assert.True(ok)
+	assert.Equal(0, val)
+	assert.Equal(1, store.len())
+	// 加载的值写入cache时淘汰了"b"
+	val, err := c.GetOrLoad(context.Background(), "a", nil)
+	assert.Nil(err)
+	assert.Equal(0, val)
+	val, _ = store.get("b")
+	assert.Equal(1, val)
+
+	// 调小最大内存淘汰的元素同样在返回前写入
+	c.SetMaxMemory("1KB")
+	assert.Equal(int64(5), c.Keys())
+	assert.Equal(7, store.len())
+	val, _ = store.get("g")
+	assert.Equal(6, val)
+}
+
+// 超过最大内存的元素不写入cache，也不加入写入队列
+func TestWriteBehindTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t,
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val int) int { return val }),
+		WithWriteBehind[string, int](store, time.Hour, 100),
+	)
+	assert.Equal(ErrTooLarge, c.TrySet("a", 2*UnitKB, 0))
+	assert.Nil(c.Close())
+	assert.Equal(0, store.len())
+}
+
+// store很慢时只有淘汰元素的Set等待写入，不持有锁，不阻塞cache的其他操作
+func TestWriteBehindEvictSlowStore(t *testing.T) {
+	assert := assert.New(t)
+	store := &slowStore{memStore: newMemStore(), release: make(chan struct{})}
+	c := newTestCache[string, int](t,
+		WithMaxMemory("1KB"),
+		WithCost(func(key string, val int) int { return 100 }),
+		WithWriteBehind[string, int](store, time.Hour, 100),
+	)
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+	}
+	evicted := make(chan struct{})
+	go func() {
+		defer close(evicted)
+		// 淘汰"0"，阻塞在store中
+		c.Set("10", 10, 0)
+	}()
+	for i := 0; i < 100 && !c.Exists("10"); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 10; i++ {
+			c.Get(strconv.Itoa(i))
+			c.Set(strconv.Itoa(i), i+1, 0)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		assert.Fail("其他操作等待了store的写入")
+	}
+	select {
+	case <-evicted:
+		assert.Fail("淘汰元素的Set没有等待写入")
+	default:
+	}
+	close(store.release)
+	<-evicted
+	val, ok := store.get("0")
+	assert.True(ok)
+	assert.Equal(0, val)
+}
+
+// Save在release关闭之前阻塞
+type slowStore struct {
+	*memStore
+	release chan struct{}
+}
+
+func (s *slowStore) Save(ctx context.Context, key string, val int) error {
+	<-s.release
+	return s.memStore.Save(ctx, key, val)
+}
+
+// Close时写入队列中剩余的修改，写入失败时返回错误
+func TestWriteBehindClose(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	c := newTestCache[string, int](t, WithWriteBehind[string, int](store, time.Hour, 100))
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Del("b")
+	assert.Nil(c.Close())
+	val, ok := store.get("a")
+	assert.True(ok)
+	assert.Equal(1, val)
+	assert.Equal(1, store.len())
+	assert.Equal(ErrClosed, c.Close())
+
+	storeErr := errors.New("store error")
+	store.setErr(storeErr)
+	c = newTestCache[string, int](t, WithWriteBehind[string, int](store, time.Hour, 100))
+	c.Set("c", 3, 0)
+	assert.Equal(storeErr, c.Close())
+
+	// 通过ctx关闭时，写入的错误由第一次Close返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cc, err := NewContext[string, int](ctx, WithWriteBehind[string, int](store, time.Hour, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Set("d", 4, 0)
+	cancel()
+	assert.Equal(storeErr, cc.Close())
+	assert.Equal(ErrClosed, cc.Close())
+}
+
+func TestStoreOptions(t *testing.T) {
+	assert := assert.New(t)
+	store := newMemStore()
+	_, err := New[string, int](WithWriteThrough[string, int](nil))
+	assert.True(errors.Is(err, ErrOption))
+	_, err = New[string, int](WithWriteBehind[string, int](store, 0, 1))
+	assert.True(errors.Is(err, ErrOption))
+	_, err = New[string, int](WithWriteBehind[string, int](store, time.Second, 0))
+	assert.True(errors.Is(err, ErrOption))
+	_, err = New[string, string](WithWriteThrough[string, int](store))
+	assert.True(errors.Is(err, ErrOption))
+
+	c := newTestCache[string, int](t)
+	_, err = c.GetOrLoad(context.Background(), "a", nil)
+	assert.True(errors.Is(err, ErrOption))
+}
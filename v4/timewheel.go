@@ -0,0 +1,207 @@
+package v4
+
+import "time"
+
+const (
+	// 时间轮的精度，过期时间向上取整到tick，元素过期后最多再保留一个tick
+	wheelTick = time.Second
+	// 每层的槽数，必须是2的幂
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+	// 层数，wheelLevels层可以覆盖2^30个tick，约34年，更远的元素放在最高层，降级时重新计算位置
+	wheelLevels = 5
+	// 一次推进超过该tick数时，不再逐个tick推进，直接重建时间轮
+	wheelMaxAdvance = wheelSlots * wheelSlots
+)
+
+// 时间轮的一个槽，元素通过wnext,wprev组成双链表
+type wheelSlot[K comparable, V any] struct {
+	head *elem[K, V]
+}
+
+func (s *wheelSlot[K, V]) push(e *elem[K, V]) {
+	e.wslot = s
+	e.wprev = nil
+	e.wnext = s.head
+	if s.head != nil {
+		s.head.wprev = e
+	}
+	s.head = e
+}
+
+func (s *wheelSlot[K, V]) del(e *elem[K, V]) {
+	if e.wprev != nil {
+		e.wprev.wnext = e.wnext
+	} else {
+		s.head = e.wnext
+	}
+	if e.wnext != nil {
+		e.wnext.wprev = e.wprev
+	}
+	e.wslot = nil
+	e.wnext = nil
+	e.wprev = nil
+}
+
+// 取出槽中所有元素，槽置空
+func (s *wheelSlot[K, V]) take() *elem[K, V] {
+	head := s.head
+	s.head = nil
+	return head
+}
+
+// 分层时间轮，按过期时间索引元素
+//
+//	第0层每个槽是一个tick，第l层每个槽是64^l个tick
+//	元素按距离过期的tick数放入对应的层，低层转完一圈时，把高层对应槽中的元素降级到低层
+//	每推进一个tick只处理第0层的一个槽，槽中的元素都已过期，不需要遍历全部元素
+//	永不过期的元素不放入时间轮
+type timingWheel[K comparable, V any] struct {
+	levels [wheelLevels][wheelSlots]wheelSlot[K, V]
+	now    int64 // 已经处理到的tick
+	len    int   // 时间轮中的元素个数
+}
+
+func newTimingWheel[K comparable, V any](now time.Time) *timingWheel[K, V] {
+	return &timingWheel[K, V]{now: wheelTicks(now)}
+}
+
+// t所在的tick，向下取整
+func wheelTicks(t time.Time) int64 {
+	return floorDiv(t.UnixNano(), int64(wheelTick))
+}
+
+// 过期时间所在的tick，向上取整，推进到这个tick时元素一定已经过期
+func expireTicks(expire int64) int64 {
+	return -floorDiv(-expire, int64(wheelTick))
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// 按e.expire放入对应的槽，已经在时间轮中的元素会先删除
+func (w *timingWheel[K, V]) add(e *elem[K, V]) {
+	if e.wslot != nil {
+		w.del(e)
+	}
+	if e.persistent() {
+		return
+	}
+	w.slot(w.pending(e)).push(e)
+	w.len++
+}
+
+func (w *timingWheel[K, V]) del(e *elem[K, V]) {
+	if e.wslot == nil {
+		return
+	}
+	e.wslot.del(e)
+	w.len--
+}
+
+// 元素的过期tick，已经过期的元素放入下一个tick，下一次推进时删除
+func (w *timingWheel[K, V]) pending(e *elem[K, V]) int64 {
+	expire := expireTicks(e.getExpire())
+	if expire <= w.now {
+		expire = w.now + 1
+	}
+	return expire
+}
+
+// 过期tick对应的槽，expire不能小于当前tick
+func (w *timingWheel[K, V]) slot(expire int64) *wheelSlot[K, V] {
+	delta := expire - w.now
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	if delta >= 1<<(wheelBits*wheelLevels) {
+		expire = w.now + 1<<(wheelBits*wheelLevels) - 1
+	}
+	return &w.levels[level][(expire>>(wheelBits*level))&wheelMask]
+}
+
+// 推进到now，对所有过期的元素调用expire，expire负责把元素从cache中删除
+func (w *timingWheel[K, V]) advance(now time.Time, expire func(e *elem[K, V])) {
+	target := wheelTicks(now)
+	if w.len == 0 || target-w.now > wheelMaxAdvance {
+		w.rebuild(target)
+	}
+	for w.now < target {
+		w.now++
+		// 从高层到低层依次降级，高层降级的元素可能落入低层当前要降级的槽
+		top := 0
+		for top < wheelLevels-1 && w.now&(1<<(wheelBits*(top+1))-1) == 0 {
+			top++
+		}
+		for level := top; level > 0; level-- {
+			w.cascade(&w.levels[level][(w.now>>(wheelBits*level))&wheelMask])
+		}
+		w.expire(&w.levels[0][w.now&wheelMask], now, expire)
+	}
+}
+
+// 把高层槽中的元素重新放入低层，降级时元素的过期tick不小于当前tick
+func (w *timingWheel[K, V]) cascade(s *wheelSlot[K, V]) {
+	for e := s.take(); e != nil; {
+		next := e.wnext
+		e.wslot = nil
+		w.slot(expireTicks(e.getExpire())).push(e)
+		e = next
+	}
+}
+
+func (w *timingWheel[K, V]) expire(s *wheelSlot[K, V], now time.Time, expire func(e *elem[K, V])) {
+	for e := s.head; e != nil; {
+		next := e.wnext
+		if !e.alive(now) {
+			w.del(e)
+			expire(e)
+		} else {
+			// 滑动过期延长了有效期，按新的过期时间重新放入
+			w.add(e)
+		}
+		e = next
+	}
+}
+
+// 直接跳到target，所有元素重新计算位置，已过期的元素放入下一个tick
+func (w *timingWheel[K, V]) rebuild(target int64) {
+	if w.len == 0 {
+		w.now = target
+		return
+	}
+	var all *elem[K, V]
+	for level := range w.levels {
+		for i := range w.levels[level] {
+			for e := w.levels[level][i].take(); e != nil; {
+				next := e.wnext
+				e.wnext = all
+				all = e
+				e = next
+			}
+		}
+	}
+	w.now = target - 1
+	for e := all; e != nil; {
+		next := e.wnext
+		e.wslot = nil
+		w.slot(w.pending(e)).push(e)
+		e = next
+	}
+}
+
+func (w *timingWheel[K, V]) reset() {
+	for level := range w.levels {
+		for i := range w.levels[level] {
+			w.levels[level][i].head = nil
+		}
+	}
+	w.len = 0
+}
@@ -0,0 +1,158 @@
+package v4
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newWheelElem(key string, expire time.Time) *elem[string, int] {
+	e := &elem[string, int]{key: key}
+	if !expire.IsZero() {
+		e.expire = expire.UnixNano()
+	}
+	return e
+}
+
+// 每个元素恰好在过期的那个tick被删除，不会提前也不会遗漏
+func TestTimingWheel(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1600000000, 0)
+	w := newTimingWheel[string, int](start)
+	r := rand.New(rand.NewSource(1))
+	expires := map[string]time.Time{}
+	// 覆盖第0层到第2层，以及跨层的边界
+	for i := 0; i < 2000; i++ {
+		d := time.Duration(r.Intn(3*wheelSlots*wheelSlots)+1) * time.Second
+		key := strconv.Itoa(i)
+		expires[key] = start.Add(d)
+		w.add(newWheelElem(key, start.Add(d)))
+	}
+	for _, d := range []int{1, wheelSlots - 1, wheelSlots, wheelSlots + 1, wheelSlots * wheelSlots, wheelSlots*wheelSlots + 1} {
+		key := "edge" + strconv.Itoa(d)
+		expires[key] = start.Add(time.Duration(d) * time.Second)
+		w.add(newWheelElem(key, expires[key]))
+	}
+	// 永不过期的元素不放入时间轮
+	forever := newWheelElem("forever", time.Time{})
+	w.add(forever)
+	assert.Nil(forever.wslot)
+	assert.Equal(len(expires), w.len)
+
+	now := start
+	for len(expires) > 0 {
+		now = now.Add(time.Second)
+		w.advance(now, func(e *elem[string, int]) {
+			assert.Equal(expires[e.key].Unix(), now.Unix(), e.key)
+			delete(expires, e.key)
+		})
+		for key, expire := range expires {
+			if !expire.After(now) {
+				assert.Fail("元素没有按时过期", key)
+			}
+		}
+		if t.Failed() {
+			return
+		}
+	}
+	assert.Equal(0, w.len)
+}
+
+func TestTimingWheelDel(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1600000000, 0)
+	w := newTimingWheel[string, int](start)
+	a := newWheelElem("a", start.Add(time.Second*10))
+	b := newWheelElem("b", start.Add(time.Hour))
+	w.add(a)
+	w.add(b)
+	w.del(a)
+	assert.Nil(a.wslot)
+	// 修改过期时间，重新放入
+	b.expire = start.Add(time.Second * 5).UnixNano()
+	w.add(b)
+	assert.Equal(1, w.len)
+	expired := []string{}
+	w.advance(start.Add(time.Minute), func(e *elem[string, int]) {
+		expired = append(expired, e.key)
+	})
+	assert.Equal([]string{"b"}, expired)
+	assert.Equal(0, w.len)
+}
+
+// 一次推进很远时重建时间轮，已过期的元素一次删除
+func TestTimingWheelRebuild(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1600000000, 0)
+	w := newTimingWheel[string, int](start)
+	w.add(newWheelElem("day", start.Add(time.Hour*24)))
+	w.add(newWheelElem("year", start.Add(time.Hour*24*365)))
+	w.add(newWheelElem("century", start.Add(time.Hour*24*365*100)))
+	expired := []string{}
+	onExpire := func(e *elem[string, int]) {
+		expired = append(expired, e.key)
+	}
+	w.advance(start.Add(time.Hour*24*30), onExpire)
+	assert.Equal([]string{"day"}, expired)
+	w.advance(start.Add(time.Hour*24*366), onExpire)
+	assert.Equal([]string{"day", "year"}, expired)
+	assert.Equal(1, w.len)
+	// 超出时间轮范围的元素仍然在时间轮中
+	w.advance(start.Add(time.Hour*24*365*100+time.Second), onExpire)
+	assert.Equal([]string{"day", "year", "century"}, expired)
+}
+
+// 不足一个tick的过期时间向上取整，推进到该tick时元素一定已经过期
+func TestTimingWheelSubSecond(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Unix(1600000000, 0)
+	w := newTimingWheel[string, int](start)
+	w.add(newWheelElem("a", start.Add(time.Millisecond*1500)))
+	expired := []string{}
+	onExpire := func(e *elem[string, int]) {
+		expired = append(expired, e.key)
+	}
+	w.advance(start.Add(time.Millisecond*1999), onExpire)
+	assert.Empty(expired)
+	w.advance(start.Add(time.Second*2), onExpire)
+	assert.Equal([]string{"a"}, expired)
+	assert.Equal(int64(-1), floorDiv(-1, 1000))
+	assert.Equal(int64(-1), expireTicks(-int64(time.Second)))
+}
+
+// gc只删除到期的元素
+func TestGCTimingWheel(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, time.Duration(i+1)*time.Minute)
+	}
+	cache.Set("forever", 0, 0)
+	assert.Equal(100, cache.expirer.(*timingWheel[string, int]).len)
+
+	clock.Advance(time.Minute*50 + time.Second)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.Equal(int64(51), cache.Keys())
+	assert.Equal(50, cache.expirer.(*timingWheel[string, int]).len)
+	assert.False(cache.Exists("49"))
+	assert.True(cache.Exists("50"))
+
+	// 更新过期时间后，按新的时间过期
+	cache.Set("99", 99, time.Second*10)
+	cache.Del("98")
+	assert.Equal(49, cache.expirer.(*timingWheel[string, int]).len)
+	clock.Advance(time.Second * 11)
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+	assert.False(cache.Exists("99"))
+	assert.Equal(int64(49), cache.Keys())
+	assert.True(cache.Flush())
+	assert.Equal(0, cache.expirer.(*timingWheel[string, int]).len)
+}
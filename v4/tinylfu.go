@@ -0,0 +1,230 @@
+package v4
+
+const (
+	// 窗口占全部元素的比例
+	tinyLFUWindowRatio = 0.01
+	// 保护区占主缓存的比例
+	tinyLFUProtectedRatio = 0.8
+	// count-min sketch的最小宽度
+	sketchMinWidth = 1 << 10
+	// sketch的行数，每行使用不同的hash
+	sketchDepth = 4
+	// 计数器上限，与4bit计数器一致
+	sketchMaxCount = 15
+	// 累计增加width*sketchResetRatio次后，所有计数器减半
+	sketchResetRatio = 10
+)
+
+// 元素所在的链表
+const (
+	segWindow    uint8 = iota // 窗口
+	segProbation              // 主缓存试用区
+	segProtected              // 主缓存保护区
+)
+
+// W-TinyLFU
+//
+//	新元素先进入窗口LRU，窗口满后，窗口尾部的元素作为候选者，与主缓存的淘汰者比较访问频率
+//	频率更高的留下，进入主缓存的试用区，另一个被淘汰。一次性扫描的key频率很低，无法挤掉主缓存中的热点元素
+//	主缓存是分段LRU，试用区中再次被访问的元素晋升到保护区，保护区满后，尾部元素降级回试用区
+//	访问频率由count-min sketch估算，定期减半，使旧的热点逐渐冷却
+type tinyLFUPolicy[K comparable, V any] struct {
+	window    list[K, V]
+	probation list[K, V]
+	protected list[K, V]
+	sketch    *countMinSketch
+}
+
+func newTinyLFUPolicy[K comparable, V any]() *tinyLFUPolicy[K, V] {
+	return &tinyLFUPolicy[K, V]{
+		sketch: newCountMinSketch(sketchMinWidth),
+	}
+}
+
+func (p *tinyLFUPolicy[K, V]) OnInsert(e *elem[K, V]) {
+	p.ensureCapacity()
+	p.sketch.increment(e.hash)
+	e.seg = segWindow
+	p.window.lpush(e)
+	// cache未满时，窗口溢出的元素直接进入试用区
+	if p.window.len > p.windowMax() {
+		c := p.window.rpop()
+		c.seg = segProbation
+		p.probation.lpush(c)
+	}
+}
+
+func (p *tinyLFUPolicy[K, V]) OnAccess(e *elem[K, V]) {
+	p.sketch.increment(e.hash)
+	switch e.seg {
+	case segWindow:
+		p.window.moveToHead(e)
+	case segProbation:
+		// 晋升到保护区
+		p.probation.del(e)
+		e.seg = segProtected
+		p.protected.lpush(e)
+		if p.protected.len > p.protectedMax() {
+			d := p.protected.rpop()
+			d.seg = segProbation
+			p.probation.lpush(d)
+		}
+	case segProtected:
+		p.protected.moveToHead(e)
+	}
+}
+
+func (p *tinyLFUPolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) { p.OnAccess(e) }
+
+func (p *tinyLFUPolicy[K, V]) OnRemove(e *elem[K, V]) {
+	p.segment(e.seg).del(e)
+	e.seg = 0
+}
+
+// 窗口已满时，窗口尾部的候选者与主缓存的淘汰者比较频率，返回频率低的一个
+// 候选者胜出时进入试用区，新元素随后写入窗口
+func (p *tinyLFUPolicy[K, V]) Victim() *elem[K, V] {
+	victim := p.mainVictim()
+	if p.window.len == 0 {
+		return victim
+	}
+	if victim == nil {
+		return p.window.tail
+	}
+	if p.window.len < p.windowMax() {
+		return victim
+	}
+	candidate := p.window.tail
+	if p.sketch.estimate(candidate.hash) <= p.sketch.estimate(victim.hash) {
+		// 候选者被拒绝
+		return candidate
+	}
+	p.window.del(candidate)
+	candidate.seg = segProbation
+	p.probation.lpush(candidate)
+	return victim
+}
+
+func (p *tinyLFUPolicy[K, V]) Len() int {
+	return p.window.len + p.probation.len + p.protected.len
+}
+
+func (p *tinyLFUPolicy[K, V]) Reset() {
+	p.window.reset()
+	p.probation.reset()
+	p.protected.reset()
+	p.sketch = newCountMinSketch(sketchMinWidth)
+}
+
+// 主缓存的淘汰者，优先淘汰试用区
+func (p *tinyLFUPolicy[K, V]) mainVictim() *elem[K, V] {
+	if p.probation.tail != nil {
+		return p.probation.tail
+	}
+	return p.protected.tail
+}
+
+func (p *tinyLFUPolicy[K, V]) segment(seg uint8) *list[K, V] {
+	switch seg {
+	case segProbation:
+		return &p.probation
+	case segProtected:
+		return &p.protected
+	default:
+		return &p.window
+	}
+}
+
+func (p *tinyLFUPolicy[K, V]) windowMax() int {
+	n := int(float64(p.Len()) * tinyLFUWindowRatio)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func (p *tinyLFUPolicy[K, V]) protectedMax() int {
+	n := int(float64(p.Len()-p.windowMax()) * tinyLFUProtectedRatio)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// 元素个数超过sketch宽度时，扩大一倍，计数重新开始
+func (p *tinyLFUPolicy[K, V]) ensureCapacity() {
+	if n := p.Len(); n >= p.sketch.width() {
+		width := p.sketch.width()
+		for width <= n {
+			width <<= 1
+		}
+		p.sketch = newCountMinSketch(width)
+	}
+}
+
+// count-min sketch，估算key的访问频率
+// sketchDepth行计数器，每行使用不同的下标，估算值取所有行的最小值
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int // 累计增加次数
+	resetAt   int // 达到后所有计数器减半
+}
+
+// width必须是2的幂
+func newCountMinSketch(width int) *countMinSketch {
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: width * sketchResetRatio,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) width() int {
+	return int(s.mask + 1)
+}
+
+func (s *countMinSketch) index(h uint64, i int) uint64 {
+	// 双重hash，低32位与高32位组合出每行的下标
+	return (h + uint64(i)*(h>>32|1)) & s.mask
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	added := false
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+			added = true
+		}
+	}
+	if added {
+		s.additions++
+		if s.additions >= s.resetAt {
+			s.reset()
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(h uint64) int {
+	min := sketchMaxCount
+	for i := range s.rows {
+		if c := int(s.rows[i][s.index(h, i)]); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// 所有计数器减半，旧的热点逐渐冷却
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,143 @@
+package v4
+
+import (
+	"errors"
+	"time"
+)
+
+// NoExpire TTL对永不过期的key返回NoExpire
+const NoExpire time.Duration = -1
+
+// SetSliding ttl<=0时panic，元素大小超过最大内存时不会存入
+func (c *lruCache[K, V]) SetSliding(key K, val V, ttl time.Duration) {
+	if err := c.TrySetSliding(key, val, ttl); errors.Is(err, ErrExpire) {
+		panic(err)
+	}
+}
+
+// TrySetSliding ttl<=0时返回*ExpireErr，元素大小超过最大内存时返回ErrTooLarge
+func (c *lruCache[K, V]) TrySetSliding(key K, val V, ttl time.Duration) error {
+	if ttl <= 0 {
+		return &ExpireErr{ttl}
+	}
+	return c.write(key, val, expireAt(ttl, c.clock.Now()), ttl, true)
+}
+
+func (c *lruCache[K, V]) TTL(key K) (time.Duration, bool) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	now := c.clock.Now()
+	e, ok := c.get(key)
+	if !ok || !e.alive(now) || c.isClosed() {
+		return 0, false
+	}
+	soft := e.getSoft()
+	if soft == 0 {
+		return NoExpire, true
+	}
+	// 宽限期内返回0
+	if soft <= now.UnixNano() {
+		return 0, true
+	}
+	return time.Duration(soft - now.UnixNano()), true
+}
+
+func (c *lruCache[K, V]) Expire(key K, d time.Duration) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	now := c.clock.Now()
+	e, ok := c.lookup(key, now)
+	if !ok {
+		return false
+	}
+	if d < 0 {
+		c.logDel(key)
+		c.remove(e, ReasonExpired)
+		return true
+	}
+	e.setExpire(expireAt(d, now), d, c.grace)
+	if d == 0 {
+		e.sliding = false
+	}
+	c.expirer.add(e)
+	c.logExpire(e)
+	c.bumpVersion(e)
+	return true
+}
+
+func (c *lruCache[K, V]) ExpireAt(key K, deadline time.Time) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	now := c.clock.Now()
+	e, ok := c.lookup(key, now)
+	if !ok {
+		return false
+	}
+	expire, ttl := deadlineAt(deadline, now)
+	if expire != 0 && expire <= now.UnixNano() {
+		c.logDel(key)
+		c.remove(e, ReasonExpired)
+		return true
+	}
+	e.setExpire(expire, ttl, c.grace)
+	// 按绝对时间过期，不再滑动
+	e.sliding = false
+	c.expirer.add(e)
+	c.logExpire(e)
+	c.bumpVersion(e)
+	return true
+}
+
+func (c *lruCache[K, V]) Persist(key K) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	e, ok := c.lookup(key, c.clock.Now())
+	if !ok {
+		return false
+	}
+	e.setExpire(0, 0, 0)
+	e.sliding = false
+	c.expirer.add(e)
+	c.logExpire(e)
+	c.bumpVersion(e)
+	return true
+}
+
+func (c *lruCache[K, V]) Touch(key K) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	now := c.clock.Now()
+	e, ok := c.lookup(key, now)
+	if !ok {
+		return false
+	}
+	if !e.persistent() {
+		e.setExpire(expireAt(e.ttl, now), e.ttl, c.grace)
+		c.expirer.add(e)
+		c.logExpire(e)
+		c.bumpVersion(e)
+	}
+	c.policy.OnAccess(e)
+	return true
+}
+
+// 有效期修改后分配新的版本号，读取值和有效期后再CompareAndSet的调用不会覆盖这次修改，必须持有写锁
+// 滑动过期在Get时延长有效期，不改变版本号
+func (c *lruCache[K, V]) bumpVersion(e *elem[K, V]) {
+	c.version++
+	e.version = c.version
+}
+
+// 查找没有过期的元素，cache关闭后返回false，必须持有锁
+func (c *lruCache[K, V]) lookup(key K, now time.Time) (*elem[K, V], bool) {
+	e, ok := c.get(key)
+	if !ok || !e.alive(now) || c.isClosed() {
+		return nil, false
+	}
+	return e, true
+}
+
+// 滑动过期，只持有读锁，并发的Get都会写入接近的时间，保留任意一个即可
+func (e *elem[K, V]) slide(now time.Time, grace time.Duration) {
+	e.storeExpire(expireAt(e.ttl, now), grace)
+}
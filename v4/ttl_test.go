@@ -0,0 +1,207 @@
+package v4
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lockedGC[K comparable, V any](cache *lruCache[K, V]) {
+	cache.l.Lock()
+	cache.gc()
+	cache.l.Unlock()
+}
+
+func TestTTL(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	cache.Set("a", 1, time.Second*10)
+	cache.Set("b", 2, 0)
+	d, ok := cache.TTL("a")
+	assert.True(ok)
+	assert.Equal(time.Second*10, d)
+	clock.Advance(time.Millisecond * 2500)
+	d, _ = cache.TTL("a")
+	assert.Equal(time.Millisecond*7500, d)
+	d, ok = cache.TTL("b")
+	assert.True(ok)
+	assert.Equal(NoExpire, d)
+	_, ok = cache.TTL("c")
+	assert.False(ok)
+	clock.Advance(time.Millisecond * 7500)
+	_, ok = cache.TTL("a")
+	assert.False(ok)
+}
+
+func TestExpire(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	cache.Set("a", 1, time.Hour)
+	cache.Set("b", 2, 0)
+	assert.True(cache.Expire("a", time.Second*5))
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*5, d)
+	// 永不过期的key也可以设置有效期
+	assert.True(cache.Expire("b", time.Second*5))
+	d, _ = cache.TTL("b")
+	assert.Equal(time.Second*5, d)
+	assert.False(cache.Expire("c", time.Second))
+
+	// 按新的有效期被gc删除，时间轮的精度为1秒
+	clock.Advance(time.Second*5 + wheelTick)
+	lockedGC(cache)
+	assert.Equal(int64(0), cache.Keys())
+
+	cache.Set("a", 1, time.Second)
+	assert.True(cache.Expire("a", 0))
+	d, _ = cache.TTL("a")
+	assert.Equal(NoExpire, d)
+	assert.True(cache.Expire("a", -1))
+	assert.False(cache.Exists("a"))
+	// 已经过期的key不能修改有效期
+	cache.Set("a", 1, time.Second)
+	clock.Advance(time.Second)
+	assert.False(cache.Expire("a", time.Hour))
+}
+
+func TestExpireAt(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	cache.Set("a", 1, 0)
+	deadline := clock.Now().Add(time.Minute)
+	assert.True(cache.ExpireAt("a", deadline))
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Minute, d)
+	assert.True(cache.ExpireAt("a", time.Time{}))
+	d, _ = cache.TTL("a")
+	assert.Equal(NoExpire, d)
+	// 超出范围的deadline不会溢出
+	assert.True(cache.ExpireAt("a", time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(cache.Exists("a"))
+	assert.True(cache.ExpireAt("a", clock.Now()))
+	assert.False(cache.Exists("a"))
+	assert.False(cache.ExpireAt("a", deadline))
+}
+
+func TestPersist(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	cache.Set("a", 1, time.Second)
+	assert.True(cache.Persist("a"))
+	assert.Equal(0, cache.expirer.(*timingWheel[string, int]).len)
+	clock.Advance(time.Hour)
+	lockedGC(cache)
+	assert.True(cache.Exists("a"))
+	assert.False(cache.Persist("b"))
+}
+
+func TestTouch(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithMaxMemory("1KB"),
+		WithCost(func(string, int) int { return 256 }))
+	cache.Set("a", 1, time.Second*10)
+	cache.Set("b", 2, 0)
+	clock.Advance(time.Second * 8)
+	assert.True(cache.Touch("a"))
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*10, d)
+	clock.Advance(time.Second * 8)
+	assert.True(cache.Exists("a"))
+	// 永不过期的key只记录访问
+	assert.True(cache.Touch("b"))
+	d, _ = cache.TTL("b")
+	assert.Equal(NoExpire, d)
+	assert.False(cache.Touch("c"))
+
+	// Touch算一次访问，LRU先淘汰a
+	cache.Set("c", 3, 0)
+	cache.Set("d", 4, 0)
+	assert.True(cache.Touch("a"))
+	cache.Set("e", 5, 0)
+	assert.False(cache.Exists("b"))
+	assert.True(cache.Exists("a"))
+}
+
+func TestSliding(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	assert.True(errors.Is(cache.TrySetSliding("a", 1, 0), ErrExpire))
+	assert.Panics(func() { cache.SetSliding("a", 1, -time.Second) })
+
+	cache.SetSliding("a", 1, time.Second*10)
+	cache.Set("b", 2, time.Second*10)
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second * 8)
+		_, ok := cache.Get("a")
+		assert.True(ok)
+		d, _ := cache.TTL("a")
+		assert.Equal(time.Second*10, d)
+		// 时间轮中的位置没有更新，gc时按新的过期时间重新放入
+		lockedGC(cache)
+	}
+	assert.False(cache.Exists("b"))
+	// Exists不延长有效期
+	clock.Advance(time.Second * 8)
+	assert.True(cache.Exists("a"))
+	clock.Advance(time.Second * 2)
+	assert.False(cache.Exists("a"))
+	lockedGC(cache)
+	assert.Equal(int64(0), cache.Keys())
+	assert.Equal(0, cache.expirer.(*timingWheel[string, int]).len)
+
+	// 重新Set后不再滑动
+	cache.SetSliding("a", 1, time.Second*10)
+	cache.Set("a", 1, time.Second*10)
+	clock.Advance(time.Second * 8)
+	cache.Get("a")
+	d, _ := cache.TTL("a")
+	assert.Equal(time.Second*2, d)
+}
+
+func TestSlidingActiveExpire(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod), WithActiveExpire(20, 1, time.Second))
+	seedSampler(cache)
+	cache.SetSliding("a", 1, time.Second*10)
+	clock.Advance(time.Second * 8)
+	cache.Get("a")
+	clock.Advance(time.Second * 8)
+	lockedGC(cache)
+	assert.True(cache.Exists("a"))
+	clock.Advance(time.Second * 2)
+	lockedGC(cache)
+	assert.Equal(int64(0), cache.Keys())
+}
+
+// 并发Get延长有效期的同时gc，go test -race下检查数据竞争
+func TestSlidingConcurrent(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	cache := newTestCache[string, int](t, WithClock(clock), WithGCPeriod(MinGCPeriod))
+	cache.SetSliding("a", 1, time.Second*10)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				cache.Get("a")
+				cache.TTL("a")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Millisecond * 100)
+		lockedGC(cache)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,103 @@
+package v4
+
+const (
+	// A1in占最大内存的比例
+	twoQueueInRatio = 0.25
+)
+
+// 2Q中元素所在的链表
+const (
+	twoQueueA1in  uint8 = iota // 第一次写入，FIFO
+	twoQueueAm                 // 再次写入，LRU
+	twoQueueA1out              // 从A1in淘汰的幽灵元素
+)
+
+// 2Q
+//
+//	新元素进入FIFO队列A1in，在A1in中再次访问不改变顺序
+//	A1in超过最大内存的25%时，优先淘汰A1in尾部的元素，并把key记录到幽灵队列A1out
+//	写入的key命中A1out，说明它不是一次性访问，直接进入LRU队列Am
+//	只访问过一次的元素只能在A1in中停留，无法挤掉Am中的热点元素
+type twoQueuePolicy[K comparable, V any] struct {
+	a1in     sizedList[K, V]
+	am       sizedList[K, V]
+	a1out    list[K, V]
+	ghosts   ghostSet[K, V]
+	capacity int
+	victim   *elem[K, V] // Victim选出的元素，从A1in删除时记录到幽灵队列
+}
+
+func newTwoQueuePolicy[K comparable, V any](ghostBudget int) *twoQueuePolicy[K, V] {
+	return &twoQueuePolicy[K, V]{
+		ghosts:   newGhostSet[K, V](ghostBudget),
+		capacity: LRUDefaultMemory,
+	}
+}
+
+func (p *twoQueuePolicy[K, V]) setCapacity(maxMemory int) {
+	p.capacity = maxMemory
+}
+
+func (p *twoQueuePolicy[K, V]) OnInsert(e *elem[K, V]) {
+	if ghost, ok := p.ghosts.get(e.key); ok {
+		p.ghosts.del(&p.a1out, ghost)
+		e.seg = twoQueueAm
+		p.am.push(e)
+		return
+	}
+	e.seg = twoQueueA1in
+	p.a1in.push(e)
+}
+
+func (p *twoQueuePolicy[K, V]) OnAccess(e *elem[K, V]) {
+	if e.seg == twoQueueAm {
+		p.am.moveToHead(e)
+	}
+}
+
+func (p *twoQueuePolicy[K, V]) OnUpdate(e *elem[K, V], oldSize int) {
+	p.list(e.seg).bytes += e.size - oldSize
+	p.OnAccess(e)
+}
+
+func (p *twoQueuePolicy[K, V]) OnRemove(e *elem[K, V]) {
+	p.list(e.seg).remove(e)
+	if p.victim == e {
+		if e.seg == twoQueueA1in {
+			p.ghosts.push(&p.a1out, e, twoQueueA1out)
+			for p.ghosts.full() {
+				p.ghosts.del(&p.a1out, p.a1out.tail)
+			}
+		}
+		p.victim = nil
+	}
+	e.seg = 0
+}
+
+func (p *twoQueuePolicy[K, V]) Victim() *elem[K, V] {
+	if p.a1in.len > 0 && (float64(p.a1in.bytes) > float64(p.capacity)*twoQueueInRatio || p.am.len == 0) {
+		p.victim = p.a1in.tail
+	} else {
+		p.victim = p.am.tail
+	}
+	return p.victim
+}
+
+func (p *twoQueuePolicy[K, V]) Len() int {
+	return p.a1in.len + p.am.len
+}
+
+func (p *twoQueuePolicy[K, V]) Reset() {
+	p.a1in.clear()
+	p.am.clear()
+	p.a1out.reset()
+	p.ghosts.reset()
+	p.victim = nil
+}
+
+func (p *twoQueuePolicy[K, V]) list(seg uint8) *sizedList[K, V] {
+	if seg == twoQueueA1in {
+		return &p.a1in
+	}
+	return &p.am
+}